@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/jovik31/tenant/pkg/cni"
+	"github.com/jovik31/tenant/pkg/network/backend"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+// Interface of the pod in one of its tenants
+type attachment struct {
+	tenant    string
+	bridge    *current.Interface
+	host      *current.Interface
+	container *current.Interface
+	address   *net.IPNet
+	gateway   net.IP
+	dns       *types.DNS
+}
+
+// Interface name of the pod in its n-th tenant, the first tenant takes the interface requested by the runtime
+func attachmentIfName(ifName string, index int) string {
+
+	if index == 0 {
+		return ifName
+	}
+	return fmt.Sprintf("net%d", index)
+}
+
+// Allocates an IP from the tenant and attaches the pod to the tenant bridge.
+// Only the primary interface gets the requested IP, the default route and the extra ipam routes
+func addAttachment(conf *cni.NetConf, args *skel.CmdArgs, k8sArgs *cni.K8sArgs, netns ns.NetNS, tenant string, ifName string, requestedIP net.IP, primary bool) (*attachment, error) {
+
+	storage, err := loadStorage(conf)
+	if err != nil {
+		return nil, err
+	}
+	tenantStore, err := ipam.NewTenantStore(storage, tenant)
+	if err != nil {
+		log.Printf("Error creating tenant store: %s", err.Error())
+		return nil, err
+	}
+	if err := tenantStore.LoadTenantData(); err != nil {
+		log.Printf("Error loading tenant store: %s", err.Error())
+		return nil, fmt.Errorf("failed to load tenant %s: %w", tenant, err)
+	}
+	tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+	if err != nil {
+		log.Printf("Error creating tenant ipam: %s", err.Error())
+		return nil, err
+	}
+	tim.Strategy = ipam.Strategy(conf.IPAM.Strategy)
+	tim.Quarantine = conf.QuarantineDuration()
+	tim.Audit = loadAuditLog(conf)
+	//get tenant bridge name and gateway
+	gateway := tim.TenantStore.Data.Bridge.Gateway
+	bridge := tim.TenantStore.Data.Bridge.Name
+	log.Printf("Tenant: %s, Bridge: %s, Gateway: %s", tenant, bridge, gateway)
+
+	//Allocate the requested IP or the next free IP from the specific tenant to the Pod
+	info := ipam.ContainerNetInfo{
+		ID:        args.ContainerID,
+		IFname:    ifName,
+		NetNS:     args.Netns,
+		Name:      k8sArgs.PodName(),
+		Namespace: k8sArgs.PodNamespace(),
+		UID:       k8sArgs.PodUID(),
+	}
+	var ip net.IP
+	if requestedIP != nil {
+		ip, err = tim.AllocateStaticIP(requestedIP, info)
+	} else {
+		ip, err = tim.AllocateIP(info)
+	}
+	if err != nil {
+		log.Printf("Error allocating IP address: %s", err.Error())
+		return nil, err
+	}
+	log.Printf("Allocated IP: %s on %s", ip.String(), ifName)
+	//Check if bridge exists, if not create:
+	gtw := net.ParseIP(gateway.String())
+	br, err := backend.CreateTenantBridge(bridge, conf.MTU, tim.IPNet(gtw))
+	if err != nil {
+		log.Print("Error creating bridge", err.Error())
+		return nil, err
+	}
+	log.Printf("Bridge created: %s", br.Attrs().Name)
+
+	var routeGateway net.IP
+	var routes []*types.Route
+	if primary {
+		routeGateway = gtw
+		routes = conf.IPAM.Routes
+	}
+	hostIface, containerIface, err := backend.SetupVeth(netns, br, conf.MTU, args.ContainerID, ifName, tim.IPNet(ip), routeGateway, conf.HairpinMode, routes)
+	if err != nil {
+		log.Printf("Error setting up veth: %s", err.Error())
+		return nil, err
+	}
+
+	return &attachment{
+		tenant:    tenant,
+		bridge:    &current.Interface{Name: br.Attrs().Name, Mac: br.Attrs().HardwareAddr.String()},
+		host:      hostIface,
+		container: containerIface,
+		address:   tim.IPNet(ip),
+		gateway:   gtw,
+		dns:       tim.TenantStore.Data.DNS,
+	}, nil
+}
+
+// Validates the pod interface in one of its tenants, only the primary interface has a default route
+func checkAttachment(conf *cni.NetConf, args *skel.CmdArgs, netns ns.NetNS, tenant string, ifName string, primary bool) error {
+
+	storage, err := loadStorage(conf)
+	if err != nil {
+		return err
+	}
+	tenantStore, err := ipam.NewTenantStore(storage, tenant)
+	if err != nil {
+		log.Printf("Error creating tenant store: %s", err.Error())
+		return err
+	}
+	if err := tenantStore.LoadTenantData(); err != nil {
+		log.Printf("Error loading tenant store: %s", err.Error())
+		return fmt.Errorf("failed to load tenant %s: %w", tenant, err)
+	}
+	tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+	if err != nil {
+		log.Printf("Error creating tenant ipam: %s", err.Error())
+		return err
+	}
+	ip, err := tim.CheckIP(args.ContainerID)
+	if err != nil {
+		log.Printf("Error checking IP: %s", err.Error())
+		return err
+	}
+	if err := checkPrevResult(conf, args.Netns, ifName, ip); err != nil {
+		log.Printf("Error checking prevResult: %s", err.Error())
+		return err
+	}
+
+	var gateway net.IP
+	if primary {
+		gateway = net.ParseIP(tim.TenantStore.Data.Bridge.Gateway.String())
+	}
+	if err := backend.CheckVeth(netns, args.ContainerID, ifName, tim.IPNet(ip), gateway, tim.TenantStore.Data.Bridge.Name, conf.MTU); err != nil {
+		log.Printf("Error checking veth: %s", err.Error())
+		return err
+	}
+
+	//The backend decides which devices the tenant needs, e.g. vxlan tenants alone on the node have no vtep
+	be, err := backend.New(tim.TenantStore.Data.Backend)
+	if err != nil {
+		return err
+	}
+	local, err := tim.TenantStore.Data.BackendTenant()
+	if err != nil {
+		return err
+	}
+	if err := be.CheckTenant(local); err != nil {
+		log.Printf("Error checking %s backend: %s", be.Type(), err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/jovik31/tenant/pkg/cni"
+	"github.com/jovik31/tenant/pkg/k8s"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+const (
+	//Re-read the pod store periodically in case a change notification is missed
+	lookupPollInterval = 2 * time.Second
+)
+
+// Resolves the tenant registration of the pod within the configured deadline. The pod store is re-read every time the
+// daemon writes it, and the pod annotation is read from the API server when a kubeconfig is configured.
+func resolveTenant(conf *cni.NetConf, k8sArgs *cni.K8sArgs) (ipam.PodInfo, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.LookupTimeout())
+	defer cancel()
+
+	var events chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Error creating pod store watcher, falling back to polling: %s", err.Error())
+	} else {
+		defer watcher.Close()
+		if err := watchPodStore(watcher, conf); err != nil {
+			log.Printf("Error watching pod store, falling back to polling: %s", err.Error())
+		} else {
+			events = watcher.Events
+		}
+	}
+
+	apiChecked := false
+	for {
+		podInfo, err := getTenantPod(conf, k8sArgs)
+		if err != nil {
+			//The daemon may be writing the store, wait for the next change
+			log.Printf("Error getting tenant name: %s", err.Error())
+		}
+		if len(podInfo.Tenants) > 0 {
+			return podInfo, nil
+		}
+
+		if !apiChecked && conf.TenantLookup.Kubeconfig != "" {
+			apiChecked = true
+			podInfo, err := getTenantAPI(conf.TenantLookup.Kubeconfig, k8sArgs)
+			if err != nil {
+				log.Printf("Error getting tenant name from API server: %s", err.Error())
+			} else {
+				return podInfo, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ipam.PodInfo{}, types.NewError(types.ErrTryAgainLater,
+				fmt.Sprintf("failed to resolve tenant of pod %s/%s", k8sArgs.PodNamespace(), k8sArgs.PodName()),
+				fmt.Sprintf("pod not registered by tenantcnid within %s", conf.LookupTimeout()))
+		case <-events:
+		case <-time.After(lookupPollInterval):
+		}
+	}
+}
+
+// Watches the path changed when the daemon writes the pod store, fails when the storage cannot be watched
+func watchPodStore(watcher *fsnotify.Watcher, conf *cni.NetConf) error {
+
+	storage, err := loadStorage(conf)
+	if err != nil {
+		return err
+	}
+	path := ipam.PodStoreWatchPath(storage)
+	if path == "" {
+		return fmt.Errorf("storage %s cannot be watched", conf.Storage)
+	}
+	return watcher.Add(path)
+}
+
+// Returns the pod registration recorded by the daemon, with an empty tenant if the pod is not registered yet
+func getTenantPod(conf *cni.NetConf, k8sArgs *cni.K8sArgs) (ipam.PodInfo, error) {
+
+	storage, err := loadStorage(conf)
+	if err != nil {
+		return ipam.PodInfo{}, err
+	}
+	podStore, err := ipam.NewPodStore(storage)
+	if err != nil {
+		log.Printf("Error creating pod store: %s", err.Error())
+		return ipam.PodInfo{}, err
+	}
+
+	podStore.RLock()
+	defer podStore.RUnlock()
+	if err := podStore.LoadPodData(); err != nil {
+		log.Printf("Error loading pod store: %s", err.Error())
+		return ipam.PodInfo{}, err
+	}
+	pim, err := ipam.NewPodIPAM(podStore)
+	if err != nil {
+		log.Printf("Error creating pod ipam: %s", err.Error())
+		return ipam.PodInfo{}, err
+	}
+
+	podInfo, _ := pim.PodStore.GetPod(k8sArgs.PodNamespace(), k8sArgs.PodName(), k8sArgs.PodUID())
+	return podInfo, nil
+}
+
+// Reads the tenant and IP annotations of the pod from the API server
+func getTenantAPI(kubeconfig string, k8sArgs *cni.K8sArgs) (ipam.PodInfo, error) {
+
+	clientset, err := k8s.GetKubeClientSetFromFile(kubeconfig)
+	if err != nil {
+		return ipam.PodInfo{}, err
+	}
+	pod, err := k8s.GetPod(clientset, k8sArgs.PodNamespace(), k8sArgs.PodName(), k8sArgs.PodUID())
+	if err != nil {
+		return ipam.PodInfo{}, err
+	}
+	return ipam.PodInfo{
+		UID:     string(pod.UID),
+		Tenants: k8s.PodTenants(pod),
+		IP:      k8s.PodRequestedIP(pod),
+	}, nil
+}
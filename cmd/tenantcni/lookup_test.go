@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/jovik31/tenant/pkg/cni"
+	"github.com/jovik31/tenant/pkg/k8s"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+func loadLookupConf(t *testing.T, conf []byte, lookup map[string]interface{}) *cni.NetConf {
+
+	t.Helper()
+	netConf, err := cni.LoadNetConf(withConf(t, conf, map[string]interface{}{"tenantLookup": lookup}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netConf
+}
+
+func TestResolveTenantDuringWatch(t *testing.T) {
+
+	storage, conf := setupDelNode(t, []string{"t1", "t2"})
+	netConf := loadLookupConf(t, conf, map[string]interface{}{"timeout": "10s"})
+	k8sArgs, err := cni.LoadK8sArgs(testArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The daemon registers the pod after the plugin started waiting
+	registered := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		podStore, err := ipam.NewPodStore(storage)
+		if err == nil {
+			err = podStore.LoadPodData()
+		}
+		if err == nil {
+			podStore.SetPod("default", "pod1", ipam.PodInfo{UID: "uid1", Tenants: []string{"t2", "t1"}})
+			err = podStore.StorePodData()
+		}
+		registered <- err
+	}()
+	start := time.Now()
+	podInfo, err := resolveTenant(netConf, k8sArgs)
+	if err := <-registered; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(podInfo.Tenants, []string{"t2", "t1"}) {
+		t.Fatalf("tenants %v, expected [t2 t1]", podInfo.Tenants)
+	}
+	//The store change wakes the lookup up before the next poll
+	if elapsed := time.Since(start); elapsed >= lookupPollInterval {
+		t.Fatalf("pod resolved after %s, the store change was not watched", elapsed)
+	}
+}
+
+func TestResolveTenantDeadline(t *testing.T) {
+
+	_, conf := setupDelNode(t, []string{"t1"})
+	netConf := loadLookupConf(t, conf, map[string]interface{}{"timeout": "300ms"})
+	k8sArgs, err := cni.LoadK8sArgs(testArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = resolveTenant(netConf, k8sArgs)
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) || cniErr.Code != types.ErrTryAgainLater {
+		t.Fatalf("expected ErrTryAgainLater, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > lookupPollInterval {
+		t.Fatalf("lookup gave up after %s, expected the 300ms deadline", elapsed)
+	}
+}
+
+// Kubeconfig of an API server serving the test pod with its tenant annotation
+func fakeAPIServer(t *testing.T, uid string, tenants string) string {
+
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods/pod1" {
+			http.NotFound(w, r)
+			return
+		}
+		pod := corev1.Pod{
+			TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "pod1",
+				UID:         k8stypes.UID(uid),
+				Annotations: map[string]string{k8s.PodTenantAnnotationKey: tenants},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&pod)
+	}))
+	t.Cleanup(server.Close)
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user: {}
+`, server.URL)
+	if err := os.WriteFile(kubeconfig, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return kubeconfig
+}
+
+func TestResolveTenantAPIFallback(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		uid     string
+		want    []string
+		wantErr bool
+	}{
+		{name: "pod annotation", uid: "uid1", want: []string{"t2", "t1"}},
+		//A pod recreated under the same name is not the pod of the ADD, the lookup waits for the daemon
+		{name: "recreated pod", uid: "uid2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, conf := setupDelNode(t, []string{"t1", "t2"})
+			kubeconfig := fakeAPIServer(t, tt.uid, "t2, t1")
+			netConf := loadLookupConf(t, conf, map[string]interface{}{"timeout": "300ms", "kubeconfig": kubeconfig})
+			k8sArgs, err := cni.LoadK8sArgs(testArgs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			podInfo, err := resolveTenant(netConf, k8sArgs)
+			if tt.wantErr {
+				var cniErr *types.Error
+				if !errors.As(err, &cniErr) || cniErr.Code != types.ErrTryAgainLater {
+					t.Fatalf("expected ErrTryAgainLater, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(podInfo.Tenants, tt.want) || podInfo.UID != tt.uid {
+				t.Fatalf("pod %+v, expected tenants %v", podInfo, tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"log"
 	"net"
-	"regexp"
+	"os"
+	"slices"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -15,89 +15,59 @@ import (
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 
+	"github.com/jovik31/tenant/pkg/cni"
 	llog "github.com/jovik31/tenant/pkg/log"
 	"github.com/jovik31/tenant/pkg/network/backend"
 	"github.com/jovik31/tenant/pkg/network/ipam"
-
-	retry "github.com/jdvr/go-again"
 )
 
 const (
-	plugin_name    = "tenantcni"
-	defaultNodeDir = "/var/lib/cni/tenantcni"
+	plugin_name = "tenantcni"
+
+	//STATUS error code defined by the CNI 1.1 spec for a plugin that cannot service ADD requests
+	errPluginNotAvailable uint = 50
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString(plugin_name))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString(plugin_name))
 
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
 
-	//Context for retry tenant loading
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	file := llog.LoadLogFile()
-	defer file.Close()
-	log.Print("Command: ADD")
-	pod_name := get_regex(args.Args)
-
-	//Fetches tenant name from the pod name, retries if failed
-	tenant, err := retry.Retry[string](ctx, func(ctx context.Context) (string, error) {
-
-		tenantName, err := getTenantPod(pod_name)
-		if err != nil {
-			log.Printf("Error getting tenant name: %s", err.Error())
-			return "", err
-		}
-		if tenantName == "" {
-			log.Printf("Tenant name not found, retrying")
-			return "", errors.New("tenant name not found")
-		}
-
-		return tenantName, nil
-	})
-
+	conf, err := cni.LoadNetConf(args.StdinData)
 	if err != nil {
-		log.Printf("Error getting tenant name: %s", err.Error())
 		return err
 	}
-	//Debug
-	log.Printf("Pod name %s, Tenant name: %s", pod_name, tenant)
 
-	//With tenant name get tenant store
-	tenantStore, err := ipam.NewTenantStore(defaultNodeDir, tenant)
-	if err != nil {
-		log.Printf("Error creating tenant store: %s", err.Error())
-		return err
-	}
-	tenantStore.LoadTenantData()
-	tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+	file := loadLogFile(conf)
+	defer file.Close()
+	log.Print("Command: ADD")
+	k8sArgs, err := cni.LoadK8sArgs(args.Args)
 	if err != nil {
-		log.Printf("Error creating tenant ipam: %s", err.Error())
+		log.Printf("Error parsing CNI_ARGS: %s", err.Error())
 		return err
 	}
-	//get tenant bridge name and gateway
-	gateway := tim.TenantStore.Data.Bridge.Gateway
-	bridge := tim.TenantStore.Data.Bridge.Name
-	log.Printf("Bridge: %s, Gateway: %s", bridge, gateway)
 
-	//Allocate IP address from the specific tenant to the next Pod
-	ip, err := tim.AllocateIP(args.ContainerID, args.IfName, args.Netns, pod_name)
+	//Waits for the tenant of the pod until the lookup deadline
+	podInfo, err := resolveTenant(conf, k8sArgs)
 	if err != nil {
-		log.Printf("Error allocating IP address: %s", err.Error())
+		log.Printf("Error getting tenant name: %s", err.Error())
 		return err
 	}
-	log.Printf("Allocated IP: %s", ip.String())
-	//Check if bridge exists, if not create:
-	mtu := 1500
-	br, err := backend.CreateTenantBridge(bridge, mtu, gateway)
+	llog.Debugf("Pod %s/%s, Tenants: %v", k8sArgs.PodNamespace(), k8sArgs.PodName(), podInfo.Tenants)
+
+	requestedIP, err := requestedIP(conf, k8sArgs, podInfo)
 	if err != nil {
-		log.Print("Error creating bridge", err.Error())
+		log.Printf("Error parsing requested IP: %s", err.Error())
 		return err
 	}
-	log.Printf("Bridge created: %s", br.Attrs().Name)
 
 	//Get namespace
 	netns, err := ns.GetNS(args.Netns)
@@ -106,207 +76,444 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	gatewayString := gateway.String()
-	gtw := net.ParseIP(gatewayString)
-
-	if err := backend.SetupVeth(netns, br, mtu, args.IfName, tim.IPNet(ip), gtw); err != nil {
-		log.Printf("Error setting up veth: %s", err.Error())
-		return err
+	//One interface per tenant, a failure is cleaned up by the DEL issued by the runtime
+	attachments := []*attachment{}
+	for index, tenant := range podInfo.Tenants {
+		var ip net.IP
+		if index == 0 {
+			ip = requestedIP
+		}
+		a, err := addAttachment(conf, args, k8sArgs, netns, tenant, attachmentIfName(args.IfName, index), ip, index == 0)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, a)
 	}
 
 	result := &current.Result{
-		CNIVersion: "0.3.1",
-		IPs: []*current.IPConfig{
-			{
-				Address: net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)},
-				Gateway: net.ParseIP(gateway.String()),
-			},
-		},
+		CNIVersion: current.ImplementedSpecVersion,
+	}
+	for _, a := range attachments {
+		result.Interfaces = append(result.Interfaces, a.bridge, a.host, a.container)
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Interface: current.Int(len(result.Interfaces) - 1),
+			Address:   *a.address,
+			Gateway:   a.gateway,
+		})
+	}
+
+	//Routes and DNS come from the primary tenant
+	primary := attachments[0]
+	result.Routes = []*types.Route{
+		{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, GW: primary.gateway},
+	}
+	for _, r := range conf.IPAM.Routes {
+		route := &types.Route{Dst: r.Dst, GW: r.GW}
+		if route.GW == nil {
+			route.GW = primary.gateway
+		}
+		result.Routes = append(result.Routes, route)
+	}
+
+	//Tenant DNS settings take precedence over the network configuration
+	if primary.dns != nil {
+		result.DNS = *primary.dns
+	} else {
+		result.DNS = conf.DNS
 	}
+
+	//When chained after another plugin, extend its result instead of replacing it
+	if conf.PrevResult != nil {
+		result, err = mergePrevResult(conf, result)
+		if err != nil {
+			log.Printf("Error merging prevResult: %s", err.Error())
+			return err
+		}
+	}
+
 	resultBytes, err := json.Marshal(result)
 	if err != nil {
 		return err
 	}
-	log.Printf("Result: %s", resultBytes)
-	return types.PrintResult(result, result.CNIVersion)
+	llog.Debugf("Result: %s", resultBytes)
+	return types.PrintResult(result, conf.CNIVersion)
 }
 
+// DEL succeeds on partial state and repeated calls so the runtime never retries it forever
 func cmdDel(args *skel.CmdArgs) error {
 
-	//Context for retry tenant loading
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	conf, err := cni.LoadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
 
-	file := llog.LoadLogFile()
+	file := loadLogFile(conf)
 	defer file.Close()
 	log.Print("Command: DEL")
-	pod_name := get_regex(args.Args)
 
-	//Fetches tenant name from the pod name, retries if failed
-	tenant, err := retry.Retry[string](ctx, func(ctx context.Context) (string, error) {
-
-		tenantName, err := getTenantPod(pod_name)
+	//DEL must not wait for the daemon, the pod store is read once
+	var tenants []string
+	k8sArgs, err := cni.LoadK8sArgs(args.Args)
+	if err != nil {
+		log.Printf("Error parsing CNI_ARGS, releasing by container ID: %s", err.Error())
+	} else {
+		podInfo, err := getTenantPod(conf, k8sArgs)
 		if err != nil {
 			log.Printf("Error getting tenant name: %s", err.Error())
-			return "", err
-		}
-		if tenantName == "" {
-			log.Printf("Tenant name not found, retrying")
-			return "", errors.New("tenant name not found")
 		}
+		tenants = podInfo.Tenants
+	}
 
-		return tenantName, nil
-	})
+	ifNames, err := releaseContainerIP(conf, tenants, args.ContainerID)
 	if err != nil {
-		log.Printf("Error getting tenant name: %s", err.Error())
+		log.Printf("Error releasing IP: %s", err.Error())
 		return err
 	}
-	tenantStore, err := ipam.NewTenantStore(defaultNodeDir, tenant)
+	if !slices.Contains(ifNames, args.IfName) {
+		ifNames = append(ifNames, args.IfName)
+	}
+
+	//Container side veths are only removed when the netns still exists
+	if args.Netns != "" {
+		netns, err := ns.GetNS(args.Netns)
+		if err == nil {
+			defer netns.Close()
+			for _, ifName := range ifNames {
+				if err := backend.DelVeth(netns, ifName); err != nil {
+					log.Printf("Error deleting veth: %s", err.Error())
+					return err
+				}
+			}
+		} else {
+			switch err.(type) {
+			case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+				log.Printf("Namespace %s is gone, skipping container veth removal", args.Netns)
+			default:
+				log.Printf("Error getting namespace: %s", err.Error())
+				return err
+			}
+		}
+	}
+
+	for _, ifName := range ifNames {
+		if err := backend.DelHostVeth(args.ContainerID, ifName); err != nil {
+			log.Printf("Error deleting host veth: %s", err.Error())
+			return err
+		}
+	}
+
+	if k8sArgs != nil {
+		if err := deletePod(conf, k8sArgs); err != nil {
+			log.Printf("Error deleting pod: %s", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the IP requested for the pod, runtimeConfig takes precedence over CNI_ARGS and the pod annotation
+func requestedIP(conf *cni.NetConf, k8sArgs *cni.K8sArgs, podInfo ipam.PodInfo) (net.IP, error) {
+
+	ip, err := conf.RequestedIP()
+	if err != nil || ip != nil {
+		return ip, err
+	}
+	if k8sArgs.IP != nil {
+		return k8sArgs.IP, nil
+	}
+	if podInfo.IP != "" {
+		ip := net.ParseIP(podInfo.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip annotation %q", podInfo.IP)
+		}
+		return ip, nil
+	}
+	return nil, nil
+}
+
+// Releases the container IPs from the tenants of the pod, or from every tenant store when the tenants are unknown.
+// Returns the interfaces the released IPs were assigned to
+func releaseContainerIP(conf *cni.NetConf, tenants []string, containerID string) ([]string, error) {
+
+	storage, err := loadStorage(conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		nodeStore, err := loadNodeStore(conf)
+		if err != nil {
+			log.Printf("Node store not available, no IP to release: %s", err.Error())
+			return nil, nil
+		}
+		for name := range nodeStore.Data.TenantList {
+			tenants = append(tenants, name)
+		}
+	}
+
+	ifNames := []string{}
+	audit := loadAuditLog(conf)
+	for _, name := range tenants {
+		if !ipam.TenantStoreExists(storage, name) {
+			log.Printf("Tenant store %s does not exist, nothing to release", name)
+			continue
+		}
+		tenantStore, err := ipam.NewTenantStore(storage, name)
+		if err != nil {
+			return nil, err
+		}
+		tim, err := ipam.NewTenantIPAM(tenantStore, name)
+		if err != nil {
+			return nil, err
+		}
+		tim.Quarantine = conf.QuarantineDuration()
+		tim.Audit = audit
+		info, err := tim.ReleaseIP(containerID)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil && info.IFname != "" && !slices.Contains(ifNames, info.IFname) {
+			ifNames = append(ifNames, info.IFname)
+		}
+	}
+	return ifNames, nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+
+	conf, err := cni.LoadNetConf(args.StdinData)
 	if err != nil {
-		log.Printf("Error creating tenant store: %s", err.Error())
 		return err
 	}
-	tenantStore.LoadTenantData()
-	tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+
+	file := loadLogFile(conf)
+	defer file.Close()
+	log.Print("Command: CHECK")
+	k8sArgs, err := cni.LoadK8sArgs(args.Args)
 	if err != nil {
-		log.Printf("Error creating tenant ipam: %s", err.Error())
+		log.Printf("Error parsing CNI_ARGS: %s", err.Error())
 		return err
 	}
-	if err := tim.ReleaseIP(args.ContainerID); err != nil {
+
+	//Waits for the tenant of the pod until the lookup deadline
+	podInfo, err := resolveTenant(conf, k8sArgs)
+	if err != nil {
+		log.Printf("Error getting tenant name: %s", err.Error())
 		return err
 	}
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-
 		log.Printf("Error getting namespace: %s", err.Error())
 		return err
 	}
 	defer netns.Close()
 
-	if err := deletePod(pod_name); err != nil {
-		log.Printf("Error deleting pod: %s", err.Error())
-		return err
+	for index, tenant := range podInfo.Tenants {
+		if err := checkAttachment(conf, args, netns, tenant, attachmentIfName(args.IfName, index), index == 0); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return backend.DelVeth(netns, args.IfName)
+// Appends the interfaces, IPs and routes of this plugin to the result of the previous plugin in the chain
+func mergePrevResult(conf *cni.NetConf, result *current.Result) (*current.Result, error) {
 
-}
+	prevResult, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, err
+	}
 
-func cmdCheck(args *skel.CmdArgs) error {
+	offset := len(prevResult.Interfaces)
+	prevResult.Interfaces = append(prevResult.Interfaces, result.Interfaces...)
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil {
+			ipc.Interface = current.Int(*ipc.Interface + offset)
+		}
+		prevResult.IPs = append(prevResult.IPs, ipc)
+	}
+	prevResult.Routes = append(prevResult.Routes, result.Routes...)
 
-	//Context for retry tenant loading
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	//DNS from the previous plugin is kept when set
+	if len(prevResult.DNS.Nameservers) == 0 && prevResult.DNS.Domain == "" {
+		prevResult.DNS = result.DNS
+	}
+	prevResult.CNIVersion = current.ImplementedSpecVersion
+	return prevResult, nil
+}
 
-	file := llog.LoadLogFile()
-	defer file.Close()
-	log.Print("Command: CHECK")
-	pod_name := get_regex(args.Args)
+// Validates the prevResult handed by the runtime matches the address stored for the container interface
+func checkPrevResult(conf *cni.NetConf, netnsPath string, ifName string, ip net.IP) error {
 
-	//Fetches tenant name from the pod name, retries if failed
-	tenant, err := retry.Retry[string](ctx, func(ctx context.Context) (string, error) {
+	if conf.PrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	prevResult, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return err
+	}
 
-		tenantName, err := getTenantPod(pod_name)
-		if err != nil {
-			log.Printf("Error getting tenant name: %s", err.Error())
-			return "", err
+	for _, ipc := range prevResult.IPs {
+		if ipc.Interface == nil || *ipc.Interface < 0 || *ipc.Interface >= len(prevResult.Interfaces) {
+			continue
 		}
-		if tenantName == "" {
-			log.Printf("Tenant name not found, retrying")
-			return "", errors.New("tenant name not found")
+		iface := prevResult.Interfaces[*ipc.Interface]
+		if iface.Name != ifName || iface.Sandbox != netnsPath {
+			continue
 		}
+		if !ipc.Address.IP.Equal(ip) {
+			return fmt.Errorf("prevResult address %s does not match stored address %s", ipc.Address.IP.String(), ip.String())
+		}
+		return nil
+	}
+	return fmt.Errorf("prevResult has no address for interface %s", ifName)
+}
 
-		return tenantName, nil
-	})
+// Releases every tenant IP whose container has no attachment listed in cni.dev/valid-attachments
+func cmdGC(args *skel.CmdArgs) error {
+
+	conf, err := cni.LoadNetConf(args.StdinData)
 	if err != nil {
-		log.Printf("Error getting tenant name: %s", err.Error())
 		return err
 	}
-	tenantStore, err := ipam.NewTenantStore(defaultNodeDir, tenant)
-	if err != nil {
-		log.Printf("Error creating tenant store: %s", err.Error())
-		return err
+
+	file := loadLogFile(conf)
+	defer file.Close()
+	log.Print("Command: GC")
+
+	//Interfaces in the secondary tenants belong to the attachment of the container, so a valid attachment
+	//keeps every tenant IP of its container
+	valid := make(map[string]bool)
+	for _, a := range conf.ValidAttachments {
+		valid[a.ContainerID] = true
 	}
-	tenantStore.LoadTenantData()
-	tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
-	if err != nil {
-		log.Printf("Error creating tenant ipam: %s", err.Error())
-		return err
+	isValid := func(id string, ifName string) bool {
+		return valid[id]
 	}
-	ip, err := tim.CheckIP(args.ContainerID)
+
+	nodeStore, err := loadNodeStore(conf)
 	if err != nil {
-		log.Printf("Error checking IP: %s", err.Error())
+		log.Printf("Error loading node store: %s", err.Error())
 		return err
 	}
-	netns, err := ns.GetNS(args.Netns)
+
+	audit := conf.AuditLog(nodeStore.Key)
+	for tenant := range nodeStore.Data.TenantList {
+		tenantStore, err := ipam.NewTenantStore(nodeStore.Storage, tenant)
+		if err != nil {
+			log.Printf("Error creating tenant store: %s", err.Error())
+			return err
+		}
+		tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+		if err != nil {
+			log.Printf("Error creating tenant ipam: %s", err.Error())
+			return err
+		}
+		tim.Quarantine = conf.QuarantineDuration()
+		tim.Audit = audit
+		released, err := tim.ReleaseStaleIPs(isValid)
+		if err != nil {
+			log.Printf("Error releasing stale IPs for tenant %s: %s", tenant, err.Error())
+			return err
+		}
+		for _, ip := range released {
+			log.Printf("Released stale IP %s from tenant %s", ip.String(), tenant)
+		}
+	}
+	return nil
+}
+
+// Reports the plugin as not ready until the tenantcnid daemon has initialised the node store
+func cmdStatus(args *skel.CmdArgs) error {
+
+	conf, err := cni.LoadNetConf(args.StdinData)
 	if err != nil {
-		log.Printf("Error getting namespace: %s", err.Error())
 		return err
 	}
-	defer netns.Close()
 
-	return backend.CheckVeth(netns, args.IfName, ip)
+	file := loadLogFile(conf)
+	defer file.Close()
+	log.Print("Command: STATUS")
+
+	nodeStore, err := loadNodeStore(conf)
+	if err != nil {
+		log.Printf("Node store not available: %s", err.Error())
+		return types.NewError(errPluginNotAvailable, "tenantcnid has not initialised the node store", err.Error())
+	}
+	if nodeStore.Data.NodeCIDR == "" {
+		return types.NewError(errPluginNotAvailable, "tenantcnid has not initialised the node store", "node CIDR not set")
+	}
+	return nil
 }
 
-// Check errors with regex
-func get_regex(arg string) string {
+// Opens the IPAM storage selected by the network configuration, shared with the tenantcnid daemon
+func loadStorage(conf *cni.NetConf) (ipam.Storage, error) {
+	return ipam.NewStorage(conf.Storage, conf.DataDir)
+}
 
-	var re = regexp.MustCompile(`(-?)K8S_POD_NAME=(.+?)(;|$)`)
-	mf := re.FindStringSubmatch(arg)
-	return mf[2]
+// Audit log of the node, entries carry the node recorded by the daemon
+func loadAuditLog(conf *cni.NetConf) *ipam.AuditLog {
 
+	nodeName, err := ipam.LoadNodeName(conf.DataDir)
+	if err != nil {
+		log.Printf("Node name not available for the audit log: %s", err.Error())
+	}
+	return conf.AuditLog(nodeName)
 }
 
-func getTenantPod(podname string) (string, error) {
+// Loads the node store initialised by the tenantcnid daemon
+func loadNodeStore(conf *cni.NetConf) (*ipam.NodeStore, error) {
 
-	podStore, err := ipam.NewPodStore()
+	nodeName, err := ipam.LoadNodeName(conf.DataDir)
 	if err != nil {
-		log.Printf("Error creating pod store: %s", err.Error())
-		return "", err
+		return nil, err
 	}
-
-	podStore.LoadPodData()
-	pim, err := ipam.NewPodIPAM(podStore)
+	storage, err := loadStorage(conf)
 	if err != nil {
-		log.Printf("Error creating pod ipam: %s", err.Error())
-		return "", err
+		return nil, err
 	}
-	podData := pim.PodStore.Data
-	podList := podData.Pods
-
-	for name, tenant := range podList {
-		if name == podname && tenant != "" {
-			return tenant, nil
-		}
+	nodeStore, err := ipam.NewNodeStore(storage, nodeName)
+	if err != nil {
+		return nil, err
 	}
-	return "", nil
+	if err := nodeStore.LoadNodeData(); err != nil {
+		return nil, err
+	}
+	return nodeStore, nil
 }
 
-func deletePod(podname string) error {
+// Opens the configured log file and applies the configured log level
+func loadLogFile(conf *cni.NetConf) *os.File {
 
-	podStore, err := ipam.NewPodStore()
+	file := llog.LoadLogFile(conf.LogFile)
+	llog.SetLevel(conf.LogLevel)
+	return file
+}
+
+func deletePod(conf *cni.NetConf, k8sArgs *cni.K8sArgs) error {
+
+	storage, err := loadStorage(conf)
+	if err != nil {
+		return err
+	}
+	podStore, err := ipam.NewPodStore(storage)
 	if err != nil {
 		log.Printf("Error creating pod store: %s", err.Error())
 		return err
 	}
 
-	podStore.LoadPodData()
+	podStore.Lock()
+	defer podStore.Unlock()
+	if err := podStore.LoadPodData(); err != nil {
+		log.Printf("Error loading pod store: %s", err.Error())
+		return err
+	}
 	pim, err := ipam.NewPodIPAM(podStore)
 	if err != nil {
 		log.Printf("Error creating pod ipam: %s", err.Error())
 		return err
 	}
-	podData := pim.PodStore.Data
-	podList := podData.Pods
 
-	for name := range podList {
-		if name == podname {
-			delete(podList, name)
-		}
-	}
-	podData.Pods = podList
-	pim.PodStore.Data = podData
-	pim.PodStore.StorePodData()
-	return nil
+	pim.PodStore.DelPod(k8sArgs.PodNamespace(), k8sArgs.PodName(), k8sArgs.PodUID())
+	return pim.PodStore.StorePodData()
 }
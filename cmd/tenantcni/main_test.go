@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/types/create"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/jovik31/tenant/pkg/cni"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+const (
+	testNode      = "node1"
+	testContainer = "c0ffee"
+	testArgs      = "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod1;K8S_POD_UID=uid1"
+)
+
+// Node with the tenants allocated and one IP per tenant held by the test container
+func setupDelNode(t *testing.T, tenants []string) (ipam.Storage, []byte) {
+
+	t.Helper()
+	dataDir := t.TempDir()
+	storage := ipam.NewFileStorage(dataDir)
+	if err := ipam.StoreNodeName(dataDir, testNode); err != nil {
+		t.Fatal(err)
+	}
+	nodeStore, err := ipam.NewNodeStore(storage, testNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nim, err := ipam.NewNodeIPAM(nodeStore, testNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nim.InitNode("192.168.0.10", "10.244.0.0/22"); err != nil {
+		t.Fatal(err)
+	}
+	for i, tenant := range tenants {
+		if err := nim.AllocateTenant(tenant, i+1, 24); err != nil {
+			t.Fatal(err)
+		}
+		tenantStore, err := ipam.NewTenantStore(storage, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := ipam.ContainerNetInfo{ID: testContainer, IFname: attachmentIfName("eth0", i), Namespace: "default", Name: "pod1", UID: "uid1"}
+		if _, err := tim.AllocateIP(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, err := json.Marshal(map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"name":       "tenantcni",
+		"type":       "tenantcni",
+		"dataDir":    dataDir,
+		"logFile":    filepath.Join(dataDir, "tenantcni.log"),
+		"audit":      map[string]interface{}{"disabled": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, conf
+}
+
+func registerPod(t *testing.T, storage ipam.Storage, tenants []string) {
+
+	t.Helper()
+	podStore, err := ipam.NewPodStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := podStore.LoadPodData(); err != nil {
+		t.Fatal(err)
+	}
+	podStore.SetPod("default", "pod1", ipam.PodInfo{UID: "uid1", Tenants: tenants})
+	if err := podStore.StorePodData(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fails the test if any tenant store still holds an IP of the test container
+func assertReleased(t *testing.T, storage ipam.Storage, tenants []string) {
+
+	t.Helper()
+	for _, tenant := range tenants {
+		if !ipam.TenantStoreExists(storage, tenant) {
+			continue
+		}
+		tenantStore, err := ipam.NewTenantStore(storage, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tenantStore.LoadTenantData(); err != nil {
+			t.Fatal(err)
+		}
+		if ip, ok := tenantStore.GetIPByID(testContainer); ok {
+			t.Errorf("IP %s of tenant %s leaked", ip.String(), tenant)
+		}
+	}
+}
+
+func TestCmdDelPartialState(t *testing.T) {
+
+	tests := []struct {
+		name string
+		//Pod store entry, no entry when nil
+		podTenants []string
+		//Tenant stores removed before the DEL
+		deleted []string
+		args    string
+		netns   string
+		//DEL issued twice
+		repeat bool
+	}{
+		{
+			name:       "missing netns",
+			podTenants: []string{"t1", "t2"},
+			args:       testArgs,
+			netns:      "/var/run/netns/tenantcni-test-missing",
+		},
+		{
+			name: "missing pod entry",
+			args: testArgs,
+		},
+		{
+			name:       "deleted tenant store",
+			podTenants: []string{"t1", "t2"},
+			deleted:    []string{"t2"},
+			args:       testArgs,
+		},
+		{
+			name:       "unparsable CNI_ARGS",
+			podTenants: []string{"t1", "t2"},
+			args:       "K8S_POD_NAME",
+		},
+		{
+			name:       "repeated DEL",
+			podTenants: []string{"t1", "t2"},
+			args:       testArgs,
+			repeat:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tenants := []string{"t1", "t2"}
+			storage, conf := setupDelNode(t, tenants)
+			if tt.podTenants != nil {
+				registerPod(t, storage, tt.podTenants)
+			}
+			for _, tenant := range tt.deleted {
+				if err := ipam.DeleteTenantStore(storage, tenant); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := &skel.CmdArgs{
+				ContainerID: testContainer,
+				Netns:       tt.netns,
+				IfName:      "eth0",
+				Args:        tt.args,
+				StdinData:   conf,
+			}
+			calls := 1
+			if tt.repeat {
+				calls = 2
+			}
+			for i := 0; i < calls; i++ {
+				if err := cmdDel(args); err != nil {
+					t.Fatalf("DEL %d: %v", i+1, err)
+				}
+			}
+			assertReleased(t, storage, tenants)
+		})
+	}
+}
+
+// Network configuration with the fields replaced
+func withConf(t *testing.T, conf []byte, fields map[string]interface{}) []byte {
+
+	t.Helper()
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(conf, &m); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range fields {
+		m[key] = value
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func allocateTestIP(t *testing.T, storage ipam.Storage, tenant string, id string, ifName string) {
+
+	t.Helper()
+	tenantStore, err := ipam.NewTenantStore(storage, tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tim, err := ipam.NewTenantIPAM(tenantStore, tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tim.AllocateIP(ipam.ContainerNetInfo{ID: id, IFname: ifName}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func heldByContainer(t *testing.T, storage ipam.Storage, tenant string, id string) bool {
+
+	t.Helper()
+	tenantStore, err := ipam.NewTenantStore(storage, tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenantStore.LoadTenantData(); err != nil {
+		t.Fatal(err)
+	}
+	_, ok := tenantStore.GetIPByID(id)
+	return ok
+}
+
+func TestCmdGC(t *testing.T) {
+
+	tenants := []string{"t1", "t2"}
+	storage, conf := setupDelNode(t, tenants)
+	allocateTestIP(t, storage, "t1", "stale", "eth0")
+	allocateTestIP(t, storage, "t2", "stale", "net1")
+
+	//The attachment of the test container is valid and keeps the IPs of both its interfaces
+	conf = withConf(t, conf, map[string]interface{}{
+		"cniVersion": "1.1.0",
+		"cni.dev/valid-attachments": []map[string]string{
+			{"containerID": testContainer, "ifname": "eth0"},
+		},
+	})
+	if err := cmdGC(&skel.CmdArgs{StdinData: conf}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tenant := range tenants {
+		if !heldByContainer(t, storage, tenant, testContainer) {
+			t.Errorf("IP of valid attachment %s released from tenant %s", testContainer, tenant)
+		}
+		if heldByContainer(t, storage, tenant, "stale") {
+			t.Errorf("IP of stale attachment kept in tenant %s", tenant)
+		}
+	}
+}
+
+func TestCmdStatus(t *testing.T) {
+
+	tests := []struct {
+		name string
+		//Node name recorded and node store written, NodeCIDR of the node store
+		nodeName string
+		nodeCIDR string
+		wantCode uint
+	}{
+		{name: "node store missing", wantCode: errPluginNotAvailable},
+		{name: "node CIDR missing", nodeName: testNode, wantCode: errPluginNotAvailable},
+		{name: "node initialised", nodeName: testNode, nodeCIDR: "10.244.0.0/22"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dataDir := t.TempDir()
+			if tt.nodeName != "" {
+				if err := ipam.StoreNodeName(dataDir, tt.nodeName); err != nil {
+					t.Fatal(err)
+				}
+				nodeStore, err := ipam.NewNodeStore(ipam.NewFileStorage(dataDir), tt.nodeName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := nodeStore.AddNodeCIDR(tt.nodeCIDR); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conf, err := json.Marshal(map[string]interface{}{
+				"cniVersion": "1.1.0",
+				"name":       "tenantcni",
+				"type":       "tenantcni",
+				"dataDir":    dataDir,
+				"logFile":    filepath.Join(dataDir, "tenantcni.log"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = cmdStatus(&skel.CmdArgs{StdinData: conf})
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var cniErr *types.Error
+			if !errors.As(err, &cniErr) || cniErr.Code != tt.wantCode {
+				t.Fatalf("expected error code %d, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+// Runs the command with its stdout captured
+func captureStdout(t *testing.T, cmd func() error) ([]byte, error) {
+
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	cmdErr := cmd()
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, cmdErr
+}
+
+func TestCmdAddResultVersion(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("ADD creates bridges and veths, requires root")
+	}
+
+	for _, cniVersion := range []string{"1.0.0", "0.4.0", "0.3.1"} {
+		t.Run(cniVersion, func(t *testing.T) {
+
+			//The bridge and host veth live in a namespace of their own instead of the host namespace
+			hostNS, err := testutils.NewNS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer testutils.UnmountNS(hostNS)
+			defer hostNS.Close()
+			containerNS, err := testutils.NewNS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer testutils.UnmountNS(containerNS)
+			defer containerNS.Close()
+
+			storage, conf := setupDelNode(t, []string{"t1"})
+			registerPod(t, storage, []string{"t1"})
+			args := &skel.CmdArgs{
+				ContainerID: "add0",
+				Netns:       containerNS.Path(),
+				IfName:      "eth0",
+				Args:        testArgs,
+				StdinData:   withConf(t, conf, map[string]interface{}{"cniVersion": cniVersion}),
+			}
+
+			var out []byte
+			err = hostNS.Do(func(ns.NetNS) error {
+				out, err = captureStdout(t, func() error { return cmdAdd(args) })
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := create.CreateFromBytes(out)
+			if err != nil {
+				t.Fatalf("decoding result %s: %v", out, err)
+			}
+			if result.Version() != cniVersion {
+				t.Fatalf("result version %s, expected %s", result.Version(), cniVersion)
+			}
+			res, err := current.NewResultFromResult(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, tenantCIDR, _ := net.ParseCIDR("10.244.0.0/24")
+			if len(res.IPs) != 1 || !tenantCIDR.Contains(res.IPs[0].Address.IP) {
+				t.Fatalf("result IPs %v, expected one IP of %s", res.IPs, tenantCIDR)
+			}
+		})
+	}
+}
+
+func TestRequestedIP(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		runtimeConfig []string
+		args          string
+		annotation    string
+		want          string
+		wantErr       bool
+	}{
+		{name: "none"},
+		{name: "annotation", annotation: "10.244.0.30", want: "10.244.0.30"},
+		{name: "CNI_ARGS over annotation", args: ";IP=10.244.0.20", annotation: "10.244.0.30", want: "10.244.0.20"},
+		{name: "runtimeConfig over CNI_ARGS and annotation", runtimeConfig: []string{"10.244.0.10/24"}, args: ";IP=10.244.0.20", annotation: "10.244.0.30", want: "10.244.0.10"},
+		{name: "first IPv4 of runtimeConfig", runtimeConfig: []string{"fd00::10", "10.244.0.10"}, want: "10.244.0.10"},
+		{name: "invalid runtimeConfig", runtimeConfig: []string{"10.244.0"}, args: ";IP=10.244.0.20", wantErr: true},
+		{name: "invalid annotation", annotation: "10.244.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			fields := map[string]interface{}{"cniVersion": "1.0.0", "name": "tenantcni", "type": "tenantcni"}
+			if tt.runtimeConfig != nil {
+				fields["runtimeConfig"] = map[string]interface{}{"ips": tt.runtimeConfig}
+			}
+			raw, err := json.Marshal(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf, err := cni.LoadNetConf(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k8sArgs, err := cni.LoadK8sArgs(testArgs + tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ip, err := requestedIP(conf, k8sArgs, ipam.PodInfo{IP: tt.annotation})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (tt.want == "" && ip != nil) || (tt.want != "" && !ip.Equal(net.ParseIP(tt.want))) {
+				t.Fatalf("requested IP %v, expected %q", ip, tt.want)
+			}
+		})
+	}
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	tenant "github.com/jovik31/tenant/pkg/client/clientset/versioned"
 	tenantInformerFactory "github.com/jovik31/tenant/pkg/client/informers/externalversions"
+	"github.com/jovik31/tenant/pkg/cni"
 	tenantController "github.com/jovik31/tenant/pkg/controller"
 	tenantRegistration "github.com/jovik31/tenant/pkg/crd"
 	kubecnf "github.com/jovik31/tenant/pkg/k8s"
@@ -15,6 +20,7 @@ import (
 
 	confType "github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
 
+	"github.com/jovik31/tenant/pkg/network/backend"
 	"github.com/jovik31/tenant/pkg/network/ipam"
 	"github.com/jovik31/tenant/pkg/network/routing"
 )
@@ -22,10 +28,19 @@ import (
 var (
 	defaultNodeDir = "/var/lib/cni/tenantcni"
 	confMap        = "tenantcni-config"
+
+	cniConfDir      = flag.String("cni-conf-dir", "/etc/cni/net.d", "directory where the CNI conflist is installed")
+	cniConfTemplate = flag.String("cni-conf-template", "/etc/tenantcni/cni-conf.json", "tenantcni plugin configuration wrapped in the conflist")
+	cniChain        = flag.String("cni-chain", strings.Join(cni.DefaultChain, ","), "comma separated plugins chained after tenantcni, empty disables chaining")
+	gcInterval      = flag.Duration("gc-interval", 5*time.Minute, "interval between collections of IPs leaked by a missing CNI DEL, 0 disables the collection")
+	gcGrace         = flag.Duration("gc-grace", 10*time.Minute, "time an IP must stay stale before it is reclaimed")
+	usageInterval   = flag.Duration("usage-interval", time.Minute, "interval between IPAM usage reports, 0 disables the reports")
+	usageThreshold  = flag.Float64("usage-threshold", 0.8, "fraction of a tenant subnet, or of the node CIDR, in use above which a warning is raised")
 )
 
 func main() {
 
+	flag.Parse()
 	log.Println("Starting tenant operator")
 	ctx := signals.SetupSignalHandler()
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
@@ -64,23 +79,56 @@ func main() {
 	}
 	log.Printf("Current node IP: %s", currentNodeIP)
 
+	//Use the storage configured for the CNI plugin, both must read and write the same stores
+	cniConf := loadNetConf(*cniConfTemplate)
+	dataDir := cniConf.DataDir
+	storage, err := ipam.NewStorage(cniConf.Storage, dataDir)
+	if err != nil {
+		log.Printf("Error loading IPAM storage: %s", err.Error())
+	}
+
+	//Stores restored from their previous generation before the controller exists are reported once it does
+	recoveries := &storeRecoveries{}
+	if fileStorage, ok := storage.(*ipam.FileStorage); ok {
+		fileStorage.OnRecover = recoveries.record
+	}
+
+	//Roll back a tenant creation or deletion interrupted by a restart before touching the stores
+	if err := ipam.RecoverJournal(storage); err != nil {
+		log.Printf("Error recovering IPAM journal: %s", err.Error())
+	}
+
 	//Create a new node store for the current node with the nodeCIDR
-	nodeStore, err := ipam.NewNodeStore(defaultNodeDir, currentNodeName)
+	nodeStore, err := ipam.NewNodeStore(storage, currentNodeName)
 	if err != nil {
 		log.Printf("Error creating node store: %s", err.Error())
 	}
 
+	//Stores written by a newer tenantcni cannot be read, nor overwritten, by this binary
+	if err := ipam.CheckSchemaVersions(storage, currentNodeName); err != nil {
+		log.Fatalf("Refusing to start: %s", err.Error())
+	}
+
 	nim, err := ipam.NewNodeIPAM(nodeStore, currentNodeName)
 	if err != nil {
 		log.Printf("Error creating node IPAM: %s", err.Error())
 	}
 
-	nim.NodeStore.AddNodeIP(currentNodeIP)
-	nim.NodeStore.AddNodeCIDR(nodeCIDR)
+	//Tenant subnets are carved out of the node CIDR with the prefix of each tenant, the subnets of the tenants
+	//restored from the node store stay allocated
+	if err := nim.InitNode(currentNodeIP, nodeCIDR); err != nil {
+		log.Printf("Error initialising node store: %s", err.Error())
+	}
 
-	//List all available subnets for tenants in the current node
-	availList := ipam.ListSubnets(nodeCIDR, 24)
-	nim.NodeStore.AddAvailableTenantList(availList)
+	//Signal the CNI plugin that the node store is initialised
+	if err := ipam.StoreNodeName(dataDir, currentNodeName); err != nil {
+		log.Printf("Error storing node name: %s", err.Error())
+	}
+
+	//Install the CNI conflist once the node is initialised, chaining the configured plugins
+	if err := installConfList(*cniConfTemplate, *cniConfDir, *cniChain); err != nil {
+		log.Printf("Error installing CNI conflist: %s", err.Error())
+	}
 
 	//Get tenant client to start  controller and to be able to register our default tenant
 	tenantClient, err := tenant.NewForConfig(config)
@@ -106,6 +154,17 @@ func main() {
 	}
 	log.Printf("PodCIDR: %s", configMap.PodCIDR)
 
+	//Backend of new tenants, an unknown backend falls back to vxlan
+	backendType := configMap.Backend["Type"]
+	if _, err := backend.New(backendType); err != nil {
+		log.Printf("Error selecting backend from config map, using %s: %s", backend.TypeVxlan, err.Error())
+		backendType = backend.TypeVxlan
+	}
+	if backendType == "" {
+		backendType = backend.TypeVxlan
+	}
+	log.Printf("Backend: %s", backendType)
+
 	//Enable post routing for the node CIDR
 	//if err := routing.AllowPostRouting(nodeCIDR); err != nil {
 	//	log.Printf("Error enabling post routing: %s", err.Error())
@@ -121,13 +180,100 @@ func main() {
 	tInformersFactory := tenantInformerFactory.NewSharedInformerFactory(tenantClient, 10*time.Minute)
 
 	c := tenantController.NewController(ctx, tenantClient, kubeclientset,
-		tInformersFactory.Jovik31().V1alpha1().Tenants(), kubeInformerFactory.Core().V1().Pods())
+		tInformersFactory.Jovik31().V1alpha1().Tenants(), kubeInformerFactory.Core().V1().Pods(), storage, configMap.PodCIDR,
+		cniConf.AuditLog(currentNodeName), backendType)
+
+	//Report stores restored from their previous generation on the node
+	recoveries.start(func(key string, cause error) {
+		c.RecordStoreRecovery(currentNodeName, key, cause)
+	})
 
 	tInformersFactory.Start(ctx.Done())
 	kubeInformerFactory.Start(ctx.Done())
 
+	//Rebuild the devices and forwarding state of the tenants kept in the stores before processing tenant events
+	c.RestoreNode(ctx, currentNodeName, cniConf.MTU)
+
+	//Reclaim the IPs of containers removed without a CNI DEL
+	go c.RunIPGC(ctx, currentNodeName, *gcInterval, *gcGrace, cniConf.QuarantineDuration())
+
+	//Report the usage of the node and tenant subnets as events and node conditions
+	go c.RunUsageReport(ctx, currentNodeName, *usageInterval, *usageThreshold)
+
 	if err := c.Run(ctx); err != nil {
 		log.Printf("Error running controller: %s\n", err.Error())
 	}
 
 }
+
+func installConfList(template string, confDir string, chain string) error {
+
+	base, err := os.ReadFile(template)
+	if err != nil {
+		return err
+	}
+	plugins := []string{}
+	for _, plugin := range strings.Split(chain, ",") {
+		if plugin = strings.TrimSpace(plugin); plugin != "" {
+			plugins = append(plugins, plugin)
+		}
+	}
+	confList, err := cni.GenerateConfList(base, plugins)
+	if err != nil {
+		return err
+	}
+	log.Printf("Installing CNI conflist in %s chaining %v", confDir, plugins)
+	return cni.WriteConfList(confDir, confList)
+}
+
+// Returns the plugin configuration of the template, the defaults when it cannot be loaded
+func loadNetConf(template string) *cni.NetConf {
+
+	base, err := os.ReadFile(template)
+	if err == nil {
+		var conf *cni.NetConf
+		conf, err = cni.LoadNetConf(base)
+		if err == nil {
+			return conf
+		}
+	}
+	log.Printf("Error loading %s, using the default configuration: %s", template, err.Error())
+	conf := cni.DefaultNetConf()
+	conf.DataDir = defaultNodeDir
+	return conf
+}
+
+// Stores restored from their previous generation, held until the controller can record them as events
+type storeRecoveries struct {
+	mu      sync.Mutex
+	pending []storeRecovery
+	report  func(key string, cause error)
+}
+
+type storeRecovery struct {
+	key   string
+	cause error
+}
+
+func (r *storeRecoveries) record(key string, cause error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report == nil {
+		r.pending = append(r.pending, storeRecovery{key: key, cause: cause})
+		return
+	}
+	r.report(key, cause)
+}
+
+// Reports the held recoveries, and every later one as it happens
+func (r *storeRecoveries) start(report func(key string, cause error)) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, recovery := range r.pending {
+		report(recovery.key, recovery.cause)
+	}
+	r.pending = nil
+	r.report = report
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+func TestStoreRecoveriesBeforeStart(t *testing.T) {
+
+	dataDir := t.TempDir()
+	storage := ipam.NewFileStorage(dataDir)
+	recoveries := &storeRecoveries{}
+	storage.OnRecover = recoveries.record
+
+	for _, key := range []string{"node1", "tenant1"} {
+		for _, data := range []string{`{"v":1}`, `{"v":2}`} {
+			if err := storage.Store(key, []byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	corrupt := func(key string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dataDir, key, key+".json"), []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Load(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Recovered at startup, before the event recorder exists
+	corrupt("node1")
+	var reported []string
+	recoveries.start(func(key string, cause error) {
+		reported = append(reported, key)
+	})
+	if !slices.Equal(reported, []string{"node1"}) {
+		t.Fatalf("reported %v, expected the recovery held since startup", reported)
+	}
+
+	corrupt("tenant1")
+	if !slices.Equal(reported, []string{"node1", "tenant1"}) {
+		t.Fatalf("reported %v, expected the later recovery", reported)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jovik31/tenant/pkg/cni"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+const usage = `Usage: tenantctl <command> [flags]
+
+Commands:
+  export    write the IPAM state of the node to a snapshot archive
+  validate  check a snapshot archive without importing it
+  import    replace the IPAM state of the node with a snapshot archive
+  audit     show the owners of the IPs and subnets of the node at a point in time
+
+Run tenantctl <command> -h for the flags of a command.
+`
+
+func main() {
+
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = cmdExport(os.Args[2:])
+	case "validate":
+		err = cmdValidate(os.Args[2:])
+	case "import":
+		err = cmdImport(os.Args[2:])
+	case "audit":
+		err = cmdAudit(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Error: %s", err.Error())
+	}
+}
+
+// Flags selecting the stores, shared by the commands reading or writing the node state
+type storeFlags struct {
+	cniConf *string
+	dataDir *string
+	storage *string
+	node    *string
+}
+
+func addStoreFlags(fs *flag.FlagSet) *storeFlags {
+	return &storeFlags{
+		cniConf: fs.String("cni-conf", "/etc/tenantcni/cni-conf.json", "tenantcni plugin configuration selecting the data directory and storage"),
+		dataDir: fs.String("data-dir", "", "data directory of the stores, overrides the plugin configuration"),
+		storage: fs.String("storage", "", "storage of the stores (file or bolt), overrides the plugin configuration"),
+		node:    fs.String("node", "", "node name, the node recorded in the data directory when empty"),
+	}
+}
+
+// Opens the storage of the node the same way as the daemon and the plugin. The node defaults to the node recorded in
+// the data directory, then to defaultNode
+func (f *storeFlags) open(defaultNode string) (ipam.Storage, string, error) {
+
+	conf := cni.DefaultNetConf()
+	if raw, err := os.ReadFile(*f.cniConf); err == nil {
+		if conf, err = cni.LoadNetConf(raw); err != nil {
+			return nil, "", fmt.Errorf("loading %s: %w", *f.cniConf, err)
+		}
+	} else if *f.dataDir == "" {
+		log.Printf("Using the default data directory, %s not loaded: %s", *f.cniConf, err.Error())
+	}
+	if *f.dataDir != "" {
+		conf.DataDir = *f.dataDir
+	}
+	if *f.storage != "" {
+		conf.Storage = *f.storage
+	}
+
+	storage, err := ipam.NewStorage(conf.Storage, conf.DataDir)
+	if err != nil {
+		return nil, "", err
+	}
+	nodeName := *f.node
+	if nodeName == "" {
+		if nodeName, err = ipam.LoadNodeName(conf.DataDir); err != nil {
+			if defaultNode == "" {
+				return nil, "", fmt.Errorf("node name not set and not recorded in %s: %w", conf.DataDir, err)
+			}
+			nodeName = defaultNode
+		}
+	}
+	return storage, nodeName, nil
+}
+
+func cmdExport(args []string) error {
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	stores := addStoreFlags(fs)
+	output := fs.String("o", "", "archive to write, stdout when empty or -")
+	fs.Parse(args)
+
+	storage, nodeName, err := stores.open("")
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" && *output != "-" {
+		if file, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+		w = file
+	}
+	manifest, err := ipam.ExportSnapshot(storage, nodeName, w)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*output)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported node %s (%s) with %d stores", manifest.NodeName, manifest.NodeCIDR, len(manifest.Records))
+	return nil
+}
+
+func cmdValidate(args []string) error {
+
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("validate expects the snapshot archive")
+	}
+
+	snapshot, err := readSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	printSnapshot(snapshot)
+	return nil
+}
+
+func cmdImport(args []string) error {
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	stores := addStoreFlags(fs)
+	nodeCIDR := fs.String("node-cidr", "", "PodCIDR of the node, the snapshot must match it. The node CIDR of the current node store when empty")
+	force := fs.Bool("force", false, "replace the IPAM state already on the node")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("import expects the snapshot archive")
+	}
+
+	snapshot, err := readSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	//Importing into a data directory not initialised by the daemon keeps the node of the snapshot, to reproduce it
+	//offline
+	storage, nodeName, err := stores.open(snapshot.Manifest.NodeName)
+	if err != nil {
+		return err
+	}
+
+	if *nodeCIDR == "" {
+		nodeStore, err := ipam.NewNodeStore(storage, nodeName)
+		if err != nil {
+			return err
+		}
+		if err := nodeStore.LoadNodeData(); err != nil {
+			return err
+		}
+		*nodeCIDR = nodeStore.Data.NodeCIDR
+	}
+	if *nodeCIDR == "" {
+		log.Printf("Node %s has no node CIDR, importing without the node CIDR check", nodeName)
+	}
+
+	if err := ipam.ImportSnapshot(storage, snapshot, nodeName, *nodeCIDR, *force); err != nil {
+		return err
+	}
+	printSnapshot(snapshot)
+	log.Printf("Imported as node %s, restart tenantcnid to restore the tenant dataplane", nodeName)
+	return nil
+}
+
+func cmdAudit(args []string) error {
+
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	cniConf := fs.String("cni-conf", "/etc/tenantcni/cni-conf.json", "tenantcni plugin configuration locating the audit log")
+	file := fs.String("file", "", "audit log, the audit log of the plugin configuration when empty")
+	at := fs.String("at", "", "point in time as RFC3339, e.g. 2024-05-02T14:02:00Z, now when empty")
+	ip := fs.String("ip", "", "only show the owner of this IP")
+	tenant := fs.String("tenant", "", "only show this tenant")
+	pod := fs.String("pod", "", "only show the IPs of this pod, as namespace/name")
+	history := fs.Bool("history", false, "print the matching events up to the point in time instead of the owners")
+	fs.Parse(args)
+
+	if *file == "" {
+		conf := cni.DefaultNetConf()
+		if raw, err := os.ReadFile(*cniConf); err == nil {
+			if conf, err = cni.LoadNetConf(raw); err != nil {
+				return fmt.Errorf("loading %s: %w", *cniConf, err)
+			}
+		}
+		*file = conf.Audit.File
+	}
+	when := time.Now()
+	if *at != "" {
+		var err error
+		if when, err = time.Parse(time.RFC3339, *at); err != nil {
+			return fmt.Errorf("invalid time %q: %w", *at, err)
+		}
+	}
+
+	events, err := ipam.ReadAuditLog(*file)
+	if err != nil {
+		return err
+	}
+	match := func(event ipam.AuditEvent) bool {
+		if *ip != "" && event.IP != *ip {
+			return false
+		}
+		if *tenant != "" && event.Tenant != *tenant {
+			return false
+		}
+		if *pod != "" && event.Namespace+"/"+event.Name != *pod {
+			return false
+		}
+		return true
+	}
+
+	if *history {
+		for _, event := range events {
+			if event.Time.After(when) {
+				break
+			}
+			if match(event) {
+				printAuditEvent(event)
+			}
+		}
+		return nil
+	}
+
+	state := ipam.ReplayAudit(events, when)
+	if state.Since.IsZero() || state.Since.After(when) {
+		return fmt.Errorf("audit log starts after %s", when.Format(time.RFC3339))
+	}
+	fmt.Printf("Owners at %s, audit log since %s\n", when.Format(time.RFC3339), state.Since.Format(time.RFC3339))
+	if *ip == "" && *pod == "" {
+		for _, key := range sortedKeys(state.Subnets) {
+			if event := state.Subnets[key]; match(event) {
+				printAuditEvent(event)
+			}
+		}
+	}
+	found := false
+	for _, key := range sortedKeys(state.IPs) {
+		if event := state.IPs[key]; match(event) {
+			printAuditEvent(event)
+			found = true
+		}
+	}
+	if !found && *ip != "" {
+		fmt.Printf("IP %s not allocated at %s\n", *ip, when.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func printAuditEvent(event ipam.AuditEvent) {
+
+	address := event.IP
+	if address == "" {
+		address = event.CIDR
+	}
+	line := fmt.Sprintf("%s %-15s %-16s tenant=%s node=%s", event.Time.Format(time.RFC3339), event.Action, address, event.Tenant, event.Node)
+	if event.ContainerID != "" {
+		line += fmt.Sprintf(" pod=%s/%s uid=%s container=%s", event.Namespace, event.Name, event.UID, event.ContainerID)
+	}
+	if event.Reason != "" {
+		line += " reason=\"" + event.Reason + "\""
+	}
+	fmt.Println(line)
+}
+
+func sortedKeys(events map[string]ipam.AuditEvent) []string {
+
+	keys := make([]string, 0, len(events))
+	for key := range events {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readSnapshot(name string) (*ipam.Snapshot, error) {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ipam.ReadSnapshot(file)
+}
+
+func printSnapshot(snapshot *ipam.Snapshot) {
+
+	manifest := snapshot.Manifest
+	fmt.Printf("Node %s, node CIDR %s, taken %s, schema version %d\n", manifest.NodeName, manifest.NodeCIDR,
+		manifest.Created.Format(time.RFC3339), manifest.SchemaVersion)
+	for _, record := range manifest.Records {
+		if tenant, ok := snapshot.Tenants[record.Key]; ok && record.Kind == "tenant" {
+			fmt.Printf("  tenant %s: %s, %d IPs\n", record.Key, tenant.TenantCIDR, len(tenant.IPs))
+		}
+	}
+	fmt.Printf("  %d pods\n", len(snapshot.Pods.Pods))
+}
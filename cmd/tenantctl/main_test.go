@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+func captureStdout(t *testing.T, cmd func() error) ([]byte, error) {
+
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	cmdErr := cmd()
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, cmdErr
+}
+
+func TestCmdAudit(t *testing.T) {
+
+	start := time.Date(2024, 5, 2, 14, 0, 0, 0, time.UTC)
+	at := func(second int) time.Time { return start.Add(time.Duration(second) * time.Second) }
+
+	//10.244.0.2 is held by pod1 then by pod2, split over the rotated files
+	file := filepath.Join(t.TempDir(), "audit.log")
+	auditLog := ipam.NewAuditLog(file, "node1")
+	auditLog.MaxSize = 300
+	for _, event := range []ipam.AuditEvent{
+		{Time: at(0), Action: ipam.AuditAllocateSubnet, Tenant: "tenant1", CIDR: "10.244.0.0/24"},
+		{Time: at(1), Action: ipam.AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.2", ContainerID: "c1", Namespace: "default", Name: "pod1"},
+		{Time: at(2), Action: ipam.AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.3", ContainerID: "c2", Namespace: "default", Name: "pod2"},
+		{Time: at(3), Action: ipam.AuditReleaseIP, Tenant: "tenant1", IP: "10.244.0.2", ContainerID: "c1", Namespace: "default", Name: "pod1"},
+		{Time: at(4), Action: ipam.AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.2", ContainerID: "c3", Namespace: "default", Name: "pod3"},
+	} {
+		if err := auditLog.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(file + ".1"); err != nil {
+		t.Fatalf("audit log not rotated: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{
+			name:    "owner of the IP at a point in time",
+			args:    []string{"-at", at(2).Format(time.RFC3339), "-ip", "10.244.0.2"},
+			want:    []string{"container=c1"},
+			notWant: []string{"container=c2", "container=c3", "10.244.0.0/24"},
+		},
+		{
+			name:    "owner of the reused IP",
+			args:    []string{"-at", at(4).Format(time.RFC3339), "-ip", "10.244.0.2"},
+			want:    []string{"container=c3"},
+			notWant: []string{"container=c1", "container=c2"},
+		},
+		{
+			name: "released IP",
+			args: []string{"-at", at(3).Format(time.RFC3339), "-ip", "10.244.0.2"},
+			want: []string{"IP 10.244.0.2 not allocated"},
+		},
+		{
+			name:    "all owners",
+			args:    []string{"-at", at(2).Format(time.RFC3339)},
+			want:    []string{"10.244.0.0/24", "container=c1", "container=c2"},
+			notWant: []string{"container=c3"},
+		},
+		{
+			name:    "history of the IP",
+			args:    []string{"-history", "-ip", "10.244.0.2"},
+			want:    []string{"container=c1", "release-ip", "container=c3"},
+			notWant: []string{"container=c2"},
+		},
+		{
+			name:    "point in time before the log",
+			args:    []string{"-at", at(-1).Format(time.RFC3339)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			out, err := captureStdout(t, func() error {
+				return cmdAudit(append([]string{"-file", file}, tt.args...))
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got output %s", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(out), want) {
+					t.Fatalf("output missing %q:\n%s", want, out)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(string(out), notWant) {
+					t.Fatalf("output holds %q:\n%s", notWant, out)
+				}
+			}
+		})
+	}
+}
@@ -20,7 +20,17 @@ type TenantSpec struct{
 	Name string `json:"name"`//Tenant Name
 	VNI int `json:"vni"`//Tenant VNI identification
 	Prefix int `json:"prefix"`//Size of tenant CIDR to be deployed
+	ClusterCIDR string `json:"clusterCIDR,omitempty"`//Optional tenant CIDR, each node gets a block of the prefix size from it instead of the node PodCIDR
 	Nodes []Node `json:"nodes"`//Node list where the tenant is deployed
+	DNS *DNS `json:"dns,omitempty"`//Optional DNS settings returned to the pods of the tenant
+	Backend string `json:"backend,omitempty"`//Optional backend of the tenant, vxlan or host-gw, overrides the Backend of the ConfigMap
+}
+
+type DNS struct{
+	Nameservers []string `json:"nameservers,omitempty"`//DNS server IPs
+	Domain string `json:"domain,omitempty"`//Local domain used for short hostname lookups
+	Search []string `json:"search,omitempty"`//Search domains
+	Options []string `json:"options,omitempty"`//Resolver options
 }
 
 type Node struct{	
@@ -28,6 +38,7 @@ type Node struct{
 	VtepMac string `json:"vtepMac,omitempty"` //VTEP Mac address is saved using string format due to the fact that it generates an error with the cache informer, create string to Mac address 
 	VtepIp string `json:"vtepIp,omitempty"` //IP of the Vtep device for this specific node and tenant
 	NodeIP string `json:"nodeIP,omitempty"` //Node IP where the tenant is deployed
+	CIDR string `json:"cidr,omitempty"` //Block of the tenant cluster CIDR claimed by this node
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
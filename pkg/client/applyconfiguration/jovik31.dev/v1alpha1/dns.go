@@ -0,0 +1,71 @@
+/*
+Copyright The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Code generated by applyconfiguration-gen. DO NOT EDIT.
+
+package v1alpha1
+
+// DNSApplyConfiguration represents an declarative configuration of the DNS type for use
+// with apply.
+type DNSApplyConfiguration struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      *string  `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// DNSApplyConfiguration constructs an declarative configuration of the DNS type for use with
+// apply.
+func DNS() *DNSApplyConfiguration {
+	return &DNSApplyConfiguration{}
+}
+
+// WithNameservers adds the given value to the Nameservers field in the declarative configuration
+// and returns the receiver, so that objects can be build by chaining "With" function invocations.
+// If called multiple times, values provided by each call will be appended to the Nameservers field.
+func (b *DNSApplyConfiguration) WithNameservers(values ...string) *DNSApplyConfiguration {
+	for i := range values {
+		b.Nameservers = append(b.Nameservers, values[i])
+	}
+	return b
+}
+
+// WithDomain sets the Domain field in the declarative configuration to the given value
+// and returns the receiver, so that objects can be built by chaining "With" function invocations.
+// If called multiple times, the Domain field is set to the value of the last call.
+func (b *DNSApplyConfiguration) WithDomain(value string) *DNSApplyConfiguration {
+	b.Domain = &value
+	return b
+}
+
+// WithSearch adds the given value to the Search field in the declarative configuration
+// and returns the receiver, so that objects can be build by chaining "With" function invocations.
+// If called multiple times, values provided by each call will be appended to the Search field.
+func (b *DNSApplyConfiguration) WithSearch(values ...string) *DNSApplyConfiguration {
+	for i := range values {
+		b.Search = append(b.Search, values[i])
+	}
+	return b
+}
+
+// WithOptions adds the given value to the Options field in the declarative configuration
+// and returns the receiver, so that objects can be build by chaining "With" function invocations.
+// If called multiple times, values provided by each call will be appended to the Options field.
+func (b *DNSApplyConfiguration) WithOptions(values ...string) *DNSApplyConfiguration {
+	for i := range values {
+		b.Options = append(b.Options, values[i])
+	}
+	return b
+}
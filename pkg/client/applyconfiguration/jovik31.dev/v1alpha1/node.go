@@ -24,6 +24,7 @@ type NodeApplyConfiguration struct {
 	VtepMac *string `json:"vtepMac,omitempty"`
 	VtepIp  *string `json:"vtepIp,omitempty"`
 	NodeIP  *string `json:"nodeIP,omitempty"`
+	CIDR    *string `json:"cidr,omitempty"`
 }
 
 // NodeApplyConfiguration constructs an declarative configuration of the Node type for use with
@@ -63,3 +64,11 @@ func (b *NodeApplyConfiguration) WithNodeIP(value string) *NodeApplyConfiguratio
 	b.NodeIP = &value
 	return b
 }
+
+// WithCIDR sets the CIDR field in the declarative configuration to the given value
+// and returns the receiver, so that objects can be built by chaining "With" function invocations.
+// If called multiple times, the CIDR field is set to the value of the last call.
+func (b *NodeApplyConfiguration) WithCIDR(value string) *NodeApplyConfiguration {
+	b.CIDR = &value
+	return b
+}
@@ -20,10 +20,13 @@ package v1alpha1
 // TenantSpecApplyConfiguration represents an declarative configuration of the TenantSpec type for use
 // with apply.
 type TenantSpecApplyConfiguration struct {
-	Name   *string                  `json:"name,omitempty"`
-	VNI    *int                     `json:"vni,omitempty"`
-	Prefix *int                     `json:"prefix,omitempty"`
-	Nodes  []NodeApplyConfiguration `json:"nodes,omitempty"`
+	Name        *string                  `json:"name,omitempty"`
+	VNI         *int                     `json:"vni,omitempty"`
+	Prefix      *int                     `json:"prefix,omitempty"`
+	ClusterCIDR *string                  `json:"clusterCIDR,omitempty"`
+	Nodes       []NodeApplyConfiguration `json:"nodes,omitempty"`
+	DNS         *DNSApplyConfiguration   `json:"dns,omitempty"`
+	Backend     *string                  `json:"backend,omitempty"`
 }
 
 // TenantSpecApplyConfiguration constructs an declarative configuration of the TenantSpec type for use with
@@ -56,6 +59,14 @@ func (b *TenantSpecApplyConfiguration) WithPrefix(value int) *TenantSpecApplyCon
 	return b
 }
 
+// WithClusterCIDR sets the ClusterCIDR field in the declarative configuration to the given value
+// and returns the receiver, so that objects can be built by chaining "With" function invocations.
+// If called multiple times, the ClusterCIDR field is set to the value of the last call.
+func (b *TenantSpecApplyConfiguration) WithClusterCIDR(value string) *TenantSpecApplyConfiguration {
+	b.ClusterCIDR = &value
+	return b
+}
+
 // WithNodes adds the given value to the Nodes field in the declarative configuration
 // and returns the receiver, so that objects can be build by chaining "With" function invocations.
 // If called multiple times, values provided by each call will be appended to the Nodes field.
@@ -68,3 +79,19 @@ func (b *TenantSpecApplyConfiguration) WithNodes(values ...*NodeApplyConfigurati
 	}
 	return b
 }
+
+// WithDNS sets the DNS field in the declarative configuration to the given value
+// and returns the receiver, so that objects can be built by chaining "With" function invocations.
+// If called multiple times, the DNS field is set to the value of the last call.
+func (b *TenantSpecApplyConfiguration) WithDNS(value *DNSApplyConfiguration) *TenantSpecApplyConfiguration {
+	b.DNS = value
+	return b
+}
+
+// WithBackend sets the Backend field in the declarative configuration to the given value
+// and returns the receiver, so that objects can be built by chaining "With" function invocations.
+// If called multiple times, the Backend field is set to the value of the last call.
+func (b *TenantSpecApplyConfiguration) WithBackend(value string) *TenantSpecApplyConfiguration {
+	b.Backend = &value
+	return b
+}
@@ -28,6 +28,8 @@ import (
 func ForKind(kind schema.GroupVersionKind) interface{} {
 	switch kind {
 	// Group=jovik31.dev, Version=v1alpha1
+	case v1alpha1.SchemeGroupVersion.WithKind("DNS"):
+		return &jovik31devv1alpha1.DNSApplyConfiguration{}
 	case v1alpha1.SchemeGroupVersion.WithKind("Node"):
 		return &jovik31devv1alpha1.NodeApplyConfiguration{}
 	case v1alpha1.SchemeGroupVersion.WithKind("Tenant"):
@@ -0,0 +1,46 @@
+package cni
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// K8sArgs are the pod identifiers passed by the kubelet through CNI_ARGS
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	//Requested pod IP
+	IP net.IP
+}
+
+// LoadK8sArgs parses CNI_ARGS, pod name and namespace are mandatory while the pod UID is optional
+func LoadK8sArgs(args string) (*K8sArgs, error) {
+
+	k8sArgs := &K8sArgs{}
+	k8sArgs.IgnoreUnknown = true
+	if err := types.LoadArgs(args, k8sArgs); err != nil {
+		return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS", err.Error())
+	}
+	if k8sArgs.K8S_POD_NAME == "" || k8sArgs.K8S_POD_NAMESPACE == "" {
+		return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "missing pod identity in CNI_ARGS",
+			fmt.Sprintf("K8S_POD_NAME=%q K8S_POD_NAMESPACE=%q", k8sArgs.K8S_POD_NAME, k8sArgs.K8S_POD_NAMESPACE))
+	}
+	return k8sArgs, nil
+}
+
+func (a *K8sArgs) PodName() string {
+	return string(a.K8S_POD_NAME)
+}
+
+func (a *K8sArgs) PodNamespace() string {
+	return string(a.K8S_POD_NAMESPACE)
+}
+
+func (a *K8sArgs) PodUID() string {
+	return string(a.K8S_POD_UID)
+}
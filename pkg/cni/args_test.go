@@ -0,0 +1,62 @@
+package cni
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestLoadK8sArgs(t *testing.T) {
+
+	const pod = "K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod1"
+	tests := []struct {
+		name      string
+		args      string
+		wantErr   bool
+		wantUID   string
+		wantIP    string
+		wantInfra string
+	}{
+		{name: "pod identity", args: pod},
+		{name: "pod UID and infra container", args: pod + ";K8S_POD_UID=uid1;K8S_POD_INFRA_CONTAINER_ID=c0ffee", wantUID: "uid1", wantInfra: "c0ffee"},
+		{name: "unknown keys are ignored", args: "IgnoreUnknown=1;FOO=bar;" + pod + ";BAR=baz"},
+		{name: "requested IP", args: pod + ";IP=10.244.0.10", wantIP: "10.244.0.10"},
+		{name: "missing name", args: "K8S_POD_NAMESPACE=default", wantErr: true},
+		{name: "missing namespace", args: "K8S_POD_NAME=pod1", wantErr: true},
+		{name: "empty name", args: "K8S_POD_NAMESPACE=default;K8S_POD_NAME=", wantErr: true},
+		{name: "empty args", args: "", wantErr: true},
+		{name: "malformed IP", args: pod + ";IP=10.244.0", wantErr: true},
+		{name: "key without value", args: pod + ";K8S_POD_UID", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			k8sArgs, err := LoadK8sArgs(tt.args)
+			if tt.wantErr {
+				var cniErr *types.Error
+				if !errors.As(err, &cniErr) || cniErr.Code != types.ErrInvalidEnvironmentVariables {
+					t.Fatalf("expected ErrInvalidEnvironmentVariables, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k8sArgs.PodNamespace() != "default" || k8sArgs.PodName() != "pod1" {
+				t.Fatalf("pod %s/%s, expected default/pod1", k8sArgs.PodNamespace(), k8sArgs.PodName())
+			}
+			if k8sArgs.PodUID() != tt.wantUID {
+				t.Fatalf("pod UID %q, expected %q", k8sArgs.PodUID(), tt.wantUID)
+			}
+			if string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID) != tt.wantInfra {
+				t.Fatalf("infra container %q, expected %q", k8sArgs.K8S_POD_INFRA_CONTAINER_ID, tt.wantInfra)
+			}
+			if (tt.wantIP == "" && k8sArgs.IP != nil) || (tt.wantIP != "" && !k8sArgs.IP.Equal(net.ParseIP(tt.wantIP))) {
+				t.Fatalf("IP %v, expected %q", k8sArgs.IP, tt.wantIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+const (
+	defaultMTU           = 1500
+	defaultDataDir       = "/var/lib/cni/tenantcni"
+	defaultLogFile       = "/var/log/tenantcni.log"
+	defaultLogLevel      = "info"
+	defaultLookupTimeout = 30 * time.Second
+	defaultCNIVersion    = "0.1.0"
+	defaultQuarantine    = 60 * time.Second
+	defaultAuditFile     = "audit.log"
+
+	minMTU   = 576
+	maxMTU   = 9000
+	ipamType = "tenantcni"
+)
+
+// NetConf is the network configuration read from the 10-tenantcni.conf file installed on the node
+type NetConf struct {
+	types.NetConf
+
+	MTU          int          `json:"mtu,omitempty"`
+	DataDir      string       `json:"dataDir,omitempty"`
+	Storage      string       `json:"storage,omitempty"`
+	LogFile      string       `json:"logFile,omitempty"`
+	LogLevel     string       `json:"logLevel,omitempty"`
+	HairpinMode  bool         `json:"hairpinMode,omitempty"`
+	TenantLookup TenantLookup `json:"tenantLookup,omitempty"`
+	IPAM         IPAMConf     `json:"ipam,omitempty"`
+	Audit        AuditConf    `json:"audit,omitempty"`
+
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+}
+
+// RuntimeConfig holds the capability arguments injected by the runtime
+type RuntimeConfig struct {
+	//Requested pod IPs through the "ips" capability, with or without prefix length
+	IPs []string `json:"ips,omitempty"`
+}
+
+// TenantLookup configures how the plugin resolves the tenant of a pod
+type TenantLookup struct {
+	//Maximum time to wait for the daemon to register the pod tenant, as a Go duration string
+	Timeout string `json:"timeout,omitempty"`
+	//Optional kubeconfig used to read the pod annotation from the API server when the daemon has not registered the pod
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+
+	timeout time.Duration
+}
+
+// IPAMConf is the ipam section of the network configuration
+type IPAMConf struct {
+	Type string `json:"type,omitempty"`
+	//Allocation strategy of the pod IPs: sequential, random or lowest-free
+	Strategy string `json:"strategy,omitempty"`
+	//Extra routes installed on the pod through the tenant gateway
+	Routes []*types.Route `json:"routes,omitempty"`
+	//Time a released IP is held before it is handed out again, e.g. "60s". "0s" disables the quarantine
+	Quarantine string `json:"quarantine,omitempty"`
+
+	quarantine time.Duration
+}
+
+// AuditConf configures the audit log of the IP and subnet changes of the node
+type AuditConf struct {
+	//Absolute path of the audit log, audit.log in the data directory when empty
+	File string `json:"file,omitempty"`
+	//Size in bytes at which the audit log is rotated
+	MaxSize int64 `json:"maxSize,omitempty"`
+	//Rotated files kept
+	MaxFiles int  `json:"maxFiles,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// LoadNetConf parses the network configuration received on stdin, applies defaults and validates it
+func LoadNetConf(bytes []byte) (*NetConf, error) {
+
+	conf := &NetConf{}
+	if err := json.Unmarshal(bytes, conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	conf.setDefaults()
+
+	//Parse the previous result when chained or called for CHECK
+	if conf.RawPrevResult != nil {
+		if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+			return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+		}
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *NetConf) setDefaults() {
+
+	//The spec treats a missing cniVersion as the oldest version
+	if c.CNIVersion == "" {
+		c.CNIVersion = defaultCNIVersion
+	}
+	if c.MTU == 0 {
+		c.MTU = defaultMTU
+	}
+	if c.DataDir == "" {
+		c.DataDir = defaultDataDir
+	}
+	if c.Storage == "" {
+		c.Storage = ipam.StorageFile
+	}
+	if c.LogFile == "" {
+		c.LogFile = defaultLogFile
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = defaultLogLevel
+	}
+	if c.IPAM.Type == "" {
+		c.IPAM.Type = ipamType
+	}
+	if c.Audit.File == "" {
+		c.Audit.File = filepath.Join(c.DataDir, defaultAuditFile)
+	}
+	if c.Audit.MaxSize == 0 {
+		c.Audit.MaxSize = ipam.DefaultAuditMaxSize
+	}
+	if c.Audit.MaxFiles == 0 {
+		c.Audit.MaxFiles = ipam.DefaultAuditMaxFiles
+	}
+}
+
+func (c *NetConf) validate() error {
+
+	if !supportsVersion(c.CNIVersion) {
+		return types.NewError(types.ErrIncompatibleCNIVersion, "incompatible CNI versions",
+			fmt.Sprintf("config is %q, plugin supports %v", c.CNIVersion, version.All.SupportedVersions()))
+	}
+
+	if c.MTU < minMTU || c.MTU > maxMTU {
+		return fmt.Errorf("invalid mtu %d, must be between %d and %d", c.MTU, minMTU, maxMTU)
+	}
+	if !filepath.IsAbs(c.DataDir) {
+		return fmt.Errorf("invalid dataDir %q, must be an absolute path", c.DataDir)
+	}
+	//The memory storage is not shared with the daemon
+	if c.Storage != ipam.StorageFile && c.Storage != ipam.StorageBolt {
+		return fmt.Errorf("invalid storage %q, must be %q or %q", c.Storage, ipam.StorageFile, ipam.StorageBolt)
+	}
+	if !filepath.IsAbs(c.LogFile) {
+		return fmt.Errorf("invalid logFile %q, must be an absolute path", c.LogFile)
+	}
+	if c.TenantLookup.Kubeconfig != "" && !filepath.IsAbs(c.TenantLookup.Kubeconfig) {
+		return fmt.Errorf("invalid tenantLookup kubeconfig %q, must be an absolute path", c.TenantLookup.Kubeconfig)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid logLevel %q, must be one of debug, info, warn or error", c.LogLevel)
+	}
+	if !filepath.IsAbs(c.Audit.File) {
+		return fmt.Errorf("invalid audit file %q, must be an absolute path", c.Audit.File)
+	}
+	if c.Audit.MaxSize < 0 || c.Audit.MaxFiles < 0 {
+		return fmt.Errorf("invalid audit rotation, maxSize and maxFiles must not be negative")
+	}
+	if c.IPAM.Type != ipamType {
+		return fmt.Errorf("unsupported ipam type %q, only %q is supported", c.IPAM.Type, ipamType)
+	}
+	if _, err := ipam.ParseStrategy(c.IPAM.Strategy); err != nil {
+		return fmt.Errorf("invalid ipam strategy: %v", err)
+	}
+	c.IPAM.quarantine = defaultQuarantine
+	if c.IPAM.Quarantine != "" {
+		quarantine, err := time.ParseDuration(c.IPAM.Quarantine)
+		if err != nil {
+			return fmt.Errorf("invalid ipam quarantine %q: %v", c.IPAM.Quarantine, err)
+		}
+		if quarantine < 0 {
+			return fmt.Errorf("invalid ipam quarantine %q, must not be negative", c.IPAM.Quarantine)
+		}
+		c.IPAM.quarantine = quarantine
+	}
+
+	c.TenantLookup.timeout = defaultLookupTimeout
+	if c.TenantLookup.Timeout != "" {
+		timeout, err := time.ParseDuration(c.TenantLookup.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid tenantLookup timeout %q: %v", c.TenantLookup.Timeout, err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("invalid tenantLookup timeout %q, must be positive", c.TenantLookup.Timeout)
+		}
+		c.TenantLookup.timeout = timeout
+	}
+	return nil
+}
+
+// LookupTimeout returns the parsed tenant lookup timeout
+func (c *NetConf) LookupTimeout() time.Duration {
+	if c.TenantLookup.timeout == 0 {
+		return defaultLookupTimeout
+	}
+	return c.TenantLookup.timeout
+}
+
+// QuarantineDuration returns the parsed time released IPs are held, zero when the quarantine is disabled
+func (c *NetConf) QuarantineDuration() time.Duration {
+	return c.IPAM.quarantine
+}
+
+// AuditLog returns the audit log of the node, nil when disabled
+func (c *NetConf) AuditLog(nodeName string) *ipam.AuditLog {
+
+	if c.Audit.Disabled {
+		return nil
+	}
+	audit := ipam.NewAuditLog(c.Audit.File, nodeName)
+	audit.MaxSize = c.Audit.MaxSize
+	audit.MaxFiles = c.Audit.MaxFiles
+	return audit
+}
+
+// DefaultNetConf returns the configuration used when no network configuration is available
+func DefaultNetConf() *NetConf {
+
+	conf := &NetConf{}
+	conf.setDefaults()
+	conf.validate()
+	return conf
+}
+
+// RequestedIP returns the IPv4 address requested through runtimeConfig, nil when none is requested
+func (c *NetConf) RequestedIP() (net.IP, error) {
+
+	for _, requested := range c.RuntimeConfig.IPs {
+		ip, err := parseIP(requested)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() != nil {
+			return ip.To4(), nil
+		}
+	}
+	return nil, nil
+}
+
+// Parses an address with or without prefix length
+func parseIP(s string) (net.IP, error) {
+
+	if ip, _, err := net.ParseCIDR(s); err == nil {
+		return ip, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("invalid ip %q", s)
+}
+
+func supportsVersion(cniVersion string) bool {
+	for _, v := range version.All.SupportedVersions() {
+		if v == cniVersion {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	confListName   = "10-tenantcni.conflist"
+	legacyConfName = "10-tenantcni.conf"
+)
+
+var (
+	//Plugins chained after tenantcni when no chain is configured
+	DefaultChain = []string{"portmap", "bandwidth"}
+
+	//Configuration of the supported chained plugins
+	chainedPlugins = map[string]map[string]interface{}{
+		"portmap": {
+			"type":         "portmap",
+			"capabilities": map[string]bool{"portMappings": true},
+			"snat":         true,
+		},
+		"bandwidth": {
+			"type":         "bandwidth",
+			"capabilities": map[string]bool{"bandwidth": true},
+		},
+		"tuning": {
+			"type": "tuning",
+		},
+	}
+)
+
+// GenerateConfList wraps the tenantcni plugin configuration in a conflist followed by the chained plugins
+func GenerateConfList(base []byte, chain []string) ([]byte, error) {
+
+	conf, err := LoadNetConf(base)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Name == "" {
+		return nil, fmt.Errorf("network name missing in plugin configuration")
+	}
+
+	//Keep every field of the base configuration, only name and cniVersion move to the list
+	plugin := map[string]interface{}{}
+	if err := json.Unmarshal(base, &plugin); err != nil {
+		return nil, err
+	}
+	delete(plugin, "name")
+	delete(plugin, "cniVersion")
+
+	plugins := []interface{}{plugin}
+	for _, name := range chain {
+		chained, ok := chainedPlugins[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported chained plugin %q", name)
+		}
+		plugins = append(plugins, chained)
+	}
+
+	confList := map[string]interface{}{
+		"cniVersion": conf.CNIVersion,
+		"name":       conf.Name,
+		"plugins":    plugins,
+	}
+	return json.MarshalIndent(confList, "", "  ")
+}
+
+// WriteConfList atomically installs the conflist in the CNI configuration directory and removes the
+// single plugin configuration that would otherwise take precedence
+func WriteConfList(confDir string, confList []byte) error {
+
+	tmp, err := os.CreateTemp(confDir, "."+confListName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(confList); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(confDir, confListName)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(confDir, legacyConfName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net/netip"
 
 	"github.com/jovik31/tenant/pkg/k8s"
 	"github.com/jovik31/tenant/pkg/network/backend"
@@ -51,7 +53,7 @@ func (c *Controller) addTenant(key string) error {
 	newTenant := tenant.DeepCopy()
 	if existsNode(newTenant.Spec.Nodes, currentNodeName) {
 
-		s, err := ipam.NewNodeStore(defaultNodeDir, currentNodeName)
+		s, err := ipam.NewNodeStore(c.storage, currentNodeName)
 		if err != nil {
 			log.Print("Error creating node store: ", err.Error())
 		}
@@ -60,12 +62,45 @@ func (c *Controller) addTenant(key string) error {
 		if err != nil {
 			log.Print("Error creating node IPAM: ", err.Error())
 		}
+		nim.Audit = c.audit
+		//Backend of the tenant is recorded on its store with the allocation and kept for the life of the tenant on the node
+		nim.Backend = c.tenantBackendType(newTenant)
+		if _, err := backend.New(nim.Backend); err != nil {
+			log.Printf("Error selecting backend of tenant %s: %s", newTenant.Name, err.Error())
+			c.recorder.Event(newTenant, corev1.EventTypeWarning, "FailedAllocation", "Tenant backend could not be set up on node "+currentNodeName+": "+err.Error())
+			return err
+		}
 		//Allocate and configure the tenant files with the information necessary
-		nim.AllocateTenant(newTenant.Spec.Name, newTenant.Spec.VNI, newTenant.Spec.Prefix)
+		var block netip.Prefix
+		if newTenant.Spec.ClusterCIDR != "" {
+			//The tenant subnet of the node is a block of the tenant cluster CIDR instead of a subnet of the node CIDR
+			block, err = c.claimClusterBlock(namespace, name, currentNodeName)
+			if err != nil {
+				log.Printf("Error claiming block of cluster CIDR %s: %s", newTenant.Spec.ClusterCIDR, err.Error())
+				c.recorder.Event(newTenant, corev1.EventTypeWarning, "FailedAllocation", "Tenant block could not be claimed on node "+currentNodeName+": "+err.Error())
+				return err
+			}
+			if err := nim.AllocateTenantBlock(newTenant.Spec.Name, newTenant.Spec.VNI, newTenant.Spec.ClusterCIDR, block); err != nil {
+				log.Printf("Error allocating tenant block %s: %s", block.String(), err.Error())
+				c.recorder.Event(newTenant, corev1.EventTypeWarning, "FailedAllocation", "Tenant block "+block.String()+" could not be allocated on node "+currentNodeName+": "+err.Error())
+				return err
+			}
+		} else {
+			if err := nim.AllocateTenant(newTenant.Spec.Name, newTenant.Spec.VNI, newTenant.Spec.Prefix); err != nil {
+				log.Printf("Error allocating tenant subnet: %s", err.Error())
+				if errors.Is(err, ipam.ErrNoSubnets) {
+					c.recorder.Event(newTenant, corev1.EventTypeWarning, "SubnetsExhausted", "No subnet left for the tenant on node "+currentNodeName+": "+err.Error())
+					c.recordSubnetsExhausted(currentNodeName, newTenant.Name, err)
+				} else {
+					c.recorder.Event(newTenant, corev1.EventTypeWarning, "FailedAllocation", "Tenant subnet could not be allocated on node "+currentNodeName+": "+err.Error())
+				}
+				return err
+			}
+		}
 
 		//After configuring all the tenant files we need to set the currentNode annotations to show that the tenant is enabled
 		//And add the values for Vtep IP, Node IP and VtepMac Address on the tenant object
-		t, err := ipam.NewTenantStore(defaultNodeDir, newTenant.Name)
+		t, err := ipam.NewTenantStore(c.storage, newTenant.Name)
 		if err != nil {
 
 			log.Println("Error creating tenant store", err.Error())
@@ -77,6 +112,12 @@ func (c *Controller) addTenant(key string) error {
 		if err != nil {
 			log.Println("Error creating tenant IPAM", err.Error())
 		}
+		if err := tim.SetDNS(tenantDNS(newTenant.Spec)); err != nil {
+			log.Println("Error storing tenant DNS", err.Error())
+		}
+		if err := tim.SetRemoteNodes(remoteNodeNames(newTenant, currentNodeName)); err != nil {
+			log.Println("Error storing tenant remote nodes", err.Error())
+		}
 
 		//Set new tenant vxlan information to publish on the K8s API
 		for index, element := range newTenant.Spec.Nodes {
@@ -94,6 +135,9 @@ func (c *Controller) addTenant(key string) error {
 					newTenant.Spec.Nodes[index].NodeIP = nim.NodeStore.Data.NodeIP
 					newTenant.Spec.Nodes[index].VtepIp = tim.TenantStore.Data.Vxlan.VtepIP
 					newTenant.Spec.Nodes[index].VtepMac = tim.TenantStore.Data.Vxlan.VtepMac
+					if block.IsValid() {
+						newTenant.Spec.Nodes[index].CIDR = block.String()
+					}
 
 					//Try to update resource
 					_, err = c.tenantClient.Jovik31V1alpha1().Tenants(namespace).Update(context.TODO(), newTenant, v1.UpdateOptions{FieldManager: "tenant-controller"})
@@ -106,13 +150,16 @@ func (c *Controller) addTenant(key string) error {
 			}
 
 		}
-		//Tenant is present in more than one node. We need to setup vxlan for inter-node communication
+		//Tenant is present in more than one node. We need to setup the backend for inter-node communication
 		if len(newTenant.Spec.Nodes) > 1 {
-			vxlanDevice, err := backend.InitVxlanDevice(tim.TenantStore.Data.TenantCIDR, tim.TenantStore.Data.Vxlan.VtepName, tim.TenantStore.Data.Vxlan.VNI, tim.TenantStore.Data.Vxlan.VtepMac)
+			be, local, err := tenantBackend(tim.TenantStore.Data)
 			if err != nil {
-				log.Println("Failed to create vxlan device")
+				log.Printf("Error getting backend of tenant %s: %s", newTenant.Name, err.Error())
+			} else if err := be.InitTenant(local); err != nil {
+				log.Printf("Failed to initialize %s backend: %s", be.Type(), err.Error())
+			} else {
+				log.Printf("Backend %s initialized for tenant %s", be.Type(), newTenant.Name)
 			}
-			log.Println("Vxlan device created: ", vxlanDevice.Name)
 
 		}
 		//Retry the node annotation if it fails
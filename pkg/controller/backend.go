@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
+	"github.com/jovik31/tenant/pkg/network/backend"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+// Backend type a new tenant is set up with, the backend of the tenant spec overrides the Backend of the ConfigMap
+func (c *Controller) tenantBackendType(tenant *v1alpha1.Tenant) string {
+
+	if tenant.Spec.Backend != "" {
+		return tenant.Spec.Backend
+	}
+	return c.backendType
+}
+
+// Backend recorded in the tenant store, with the node local state of the tenant
+func tenantBackend(data *ipam.TenantData) (backend.Backend, *backend.Tenant, error) {
+
+	be, err := backend.New(data.Backend)
+	if err != nil {
+		return nil, nil, err
+	}
+	tenant, err := data.BackendTenant()
+	if err != nil {
+		return nil, nil, err
+	}
+	return be, tenant, nil
+}
+
+// Remote node of the tenant as published on the tenant resource, fails when the node has not published its vtep yet
+func remoteNode(tenant *v1alpha1.Tenant, node v1alpha1.Node) (*backend.RemoteNode, error) {
+
+	if node.NodeIP == "" || node.VtepIp == "" || node.VtepMac == "" {
+		return nil, fmt.Errorf("node %s not initialized", node.Name)
+	}
+	vtepMac, err := net.ParseMAC(node.VtepMac)
+	if err != nil {
+		return nil, err
+	}
+	remote := &backend.RemoteNode{
+		Name:    node.Name,
+		NodeIP:  net.ParseIP(node.NodeIP),
+		VtepIP:  net.ParseIP(node.VtepIp),
+		VtepMac: vtepMac,
+	}
+
+	//Remote nodes of a tenant cluster CIDR record their block, the others use the tenant prefix from the vtep IP
+	if _, block, err := net.ParseCIDR(node.CIDR); err == nil {
+		remote.CIDR = block
+		return remote, nil
+	}
+	prefix := tenant.Spec.Prefix
+	if prefix == 0 {
+		prefix = ipam.DefaultTenantPrefix
+	}
+	remote.CIDR = &net.IPNet{IP: remote.VtepIP.Mask(net.CIDRMask(prefix, 32)), Mask: net.CIDRMask(prefix, 32)}
+	return remote, nil
+}
+
+// Records the remote nodes of the tenant and makes their tenant subnets reachable through the backend of the tenant.
+// Backends replace the entries that exist, so the call is repeated safely on every update and on restore
+func (c *Controller) addRemoteNodes(tenant *v1alpha1.Tenant, currentNodeName string) {
+
+	t, err := ipam.NewTenantStore(c.storage, tenant.Name)
+	if err != nil {
+		log.Println("Error creating tenant store", err.Error())
+		return
+	}
+	if err := t.LoadTenantData(); err != nil || t.Data.TenantName == "" {
+		log.Printf("Tenant %s not allocated on this node", tenant.Name)
+		return
+	}
+	tim, err := ipam.NewTenantIPAM(t, tenant.Name)
+	if err != nil {
+		log.Println("Error creating tenant IPAM", err.Error())
+		return
+	}
+	if err := tim.SetRemoteNodes(remoteNodeNames(tenant, currentNodeName)); err != nil {
+		log.Println("Error storing tenant remote nodes", err.Error())
+	}
+	if len(tenant.Spec.Nodes) < 2 {
+		return
+	}
+	be, local, err := tenantBackend(t.Data)
+	if err != nil {
+		log.Printf("Error getting backend of tenant %s: %s", tenant.Name, err.Error())
+		return
+	}
+
+	//Devices of the tenant, created when the tenant was alone on the node until now or gone after a reboot
+	if err := be.InitTenant(local); err != nil {
+		log.Printf("Error initializing %s backend of tenant %s: %s", be.Type(), tenant.Name, err.Error())
+		return
+	}
+
+	for _, node := range tenant.Spec.Nodes {
+
+		if node.Name == currentNodeName {
+			continue
+		}
+		remote, err := remoteNode(tenant, node)
+		if err != nil {
+			log.Printf("Skipping remote node, update when node has been initialized: %s", err.Error())
+			continue
+		}
+		if err := be.AddRemoteNode(local, remote); err != nil {
+			log.Printf("Error adding remote node %s of tenant %s: %s", node.Name, tenant.Name, err.Error())
+		}
+	}
+}
+
+// Removes the entries reaching the tenant on nodes removed from the tenant
+func (c *Controller) removeRemoteNodes(tenant *v1alpha1.Tenant, removed []v1alpha1.Node, currentNodeName string) {
+
+	if len(removed) == 0 {
+		return
+	}
+	t, err := ipam.NewTenantStore(c.storage, tenant.Name)
+	if err != nil {
+		log.Println("Error creating tenant store", err.Error())
+		return
+	}
+	if err := t.LoadTenantData(); err != nil || t.Data.TenantName == "" {
+		return
+	}
+	be, local, err := tenantBackend(t.Data)
+	if err != nil {
+		log.Printf("Error getting backend of tenant %s: %s", tenant.Name, err.Error())
+		return
+	}
+
+	for _, node := range removed {
+		if node.Name == currentNodeName {
+			continue
+		}
+		remote, err := remoteNode(tenant, node)
+		if err != nil {
+			continue
+		}
+		if err := be.RemoveRemoteNode(local, remote); err != nil {
+			log.Printf("Error removing remote node %s of tenant %s: %s", node.Name, tenant.Name, err.Error())
+			continue
+		}
+		log.Printf("Removed remote node %s of tenant %s", node.Name, tenant.Name)
+	}
+}
+
+// Names of the nodes of the tenant other than the current node
+func remoteNodeNames(tenant *v1alpha1.Tenant, currentNodeName string) []string {
+
+	names := []string{}
+	for _, node := range tenant.Spec.Nodes {
+		if node.Name != currentNodeName {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// Nodes of the old node list missing from the new one
+func removedNodes(oldNodes []v1alpha1.Node, newNodes []v1alpha1.Node) []v1alpha1.Node {
+
+	removed := []v1alpha1.Node{}
+	for _, node := range oldNodes {
+		if !existsNode(newNodes, node.Name) {
+			removed = append(removed, node)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
+	"github.com/jovik31/tenant/pkg/network/backend"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+func TestTenantBackend(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		configMap   string
+		spec        string
+		want        string
+		wantInvalid bool
+	}{
+		{name: "vxlan of the ConfigMap", configMap: backend.TypeVxlan, want: backend.TypeVxlan},
+		{name: "host-gw of the ConfigMap", configMap: backend.TypeHostGW, want: backend.TypeHostGW},
+		{name: "spec overrides the ConfigMap", configMap: backend.TypeVxlan, spec: backend.TypeHostGW, want: backend.TypeHostGW},
+		{name: "spec same as the ConfigMap", configMap: backend.TypeHostGW, spec: backend.TypeHostGW, want: backend.TypeHostGW},
+		{name: "vxlan spec over a host-gw ConfigMap", configMap: backend.TypeHostGW, spec: backend.TypeVxlan, want: backend.TypeVxlan},
+		{name: "unsupported spec backend", configMap: backend.TypeVxlan, spec: "wireguard", want: "wireguard", wantInvalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c := &Controller{backendType: tt.configMap}
+			tenant := &v1alpha1.Tenant{
+				ObjectMeta: metav1.ObjectMeta{Name: "tenant1"},
+				Spec:       v1alpha1.TenantSpec{Backend: tt.spec},
+			}
+			backendType := c.tenantBackendType(tenant)
+			if backendType != tt.want {
+				t.Fatalf("backend %q, expected %q", backendType, tt.want)
+			}
+			if _, err := backend.New(backendType); (err != nil) != tt.wantInvalid {
+				t.Fatalf("backend %q error %v", backendType, err)
+			}
+			if tt.wantInvalid {
+				return
+			}
+
+			//The backend is recorded on the tenant store with the allocation and read back for the dataplane
+			nodeStore, err := ipam.NewNodeStore(ipam.NewMemoryStorage(), "node1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			nim, err := ipam.NewNodeIPAM(nodeStore, "node1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := nim.InitNode("192.168.0.10", "10.244.0.0/22"); err != nil {
+				t.Fatal(err)
+			}
+			nim.Backend = backendType
+			if err := nim.AllocateTenant(tenant.Name, 1, 24); err != nil {
+				t.Fatal(err)
+			}
+			tenantStore, err := ipam.NewTenantStore(nodeStore.Storage, tenant.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tenantStore.LoadTenantData(); err != nil {
+				t.Fatal(err)
+			}
+			be, local, err := tenantBackend(tenantStore.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if be.Type() != tt.want || local.Name != tenant.Name {
+				t.Fatalf("tenant %s recorded with backend %s, expected %s", local.Name, be.Type(), tt.want)
+			}
+		})
+	}
+}
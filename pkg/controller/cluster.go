@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Claims a block of the tenant cluster CIDR for the node by recording it on the node entry of the tenant resource.
+// Nodes claiming at the same time conflict on the resource version, the loser retries with the winner's block taken.
+// A block already recorded for the node is reused.
+func (c *Controller) claimClusterBlock(namespace string, name string, nodeName string) (netip.Prefix, error) {
+
+	var block netip.Prefix
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+
+		//The lister may lag behind the claims of other nodes, read the resource from the API
+		tenant, err := c.tenantClient.Jovik31V1alpha1().Tenants(namespace).Get(context.TODO(), name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := c.checkClusterCIDR(tenant.Spec.ClusterCIDR); err != nil {
+			return err
+		}
+
+		index := -1
+		claimed := []string{}
+		for i, node := range tenant.Spec.Nodes {
+			if node.Name == nodeName {
+				index = i
+				continue
+			}
+			if node.CIDR != "" {
+				claimed = append(claimed, node.CIDR)
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("node %s is not part of tenant %s", nodeName, name)
+		}
+
+		if current, err := netip.ParsePrefix(tenant.Spec.Nodes[index].CIDR); err == nil {
+			cluster, _ := netip.ParsePrefix(tenant.Spec.ClusterCIDR)
+			if cluster.Contains(current.Addr()) {
+				block = current.Masked()
+				return nil
+			}
+		}
+
+		block, err = ipam.ClusterBlock(tenant.Spec.ClusterCIDR, tenant.Spec.Prefix, claimed)
+		if err != nil {
+			return err
+		}
+		newTenant := tenant.DeepCopy()
+		newTenant.Spec.Nodes[index].CIDR = block.String()
+		_, err = c.tenantClient.Jovik31V1alpha1().Tenants(namespace).Update(context.TODO(), newTenant, v1.UpdateOptions{FieldManager: "tenant-controller"})
+		return err
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	log.Printf("Node %s claimed block %s of tenant %s", nodeName, block.String(), name)
+	return block, nil
+}
+
+// The tenant cluster CIDR must not overlap the cluster PodCIDR, the node CIDRs are carved out of it
+func (c *Controller) checkClusterCIDR(clusterCIDR string) error {
+
+	cluster, err := netip.ParsePrefix(clusterCIDR)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ipam.ErrInvalidClusterCIDR, clusterCIDR)
+	}
+	podCIDR, err := netip.ParsePrefix(c.podCIDR)
+	if err != nil {
+		return nil
+	}
+	if podCIDR.Overlaps(cluster) {
+		return fmt.Errorf("%w: %s overlaps the cluster PodCIDR %s", ipam.ErrInvalidClusterCIDR, clusterCIDR, c.podCIDR)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/jovik31/tenant/pkg/client/clientset/versioned/scheme"
 	tenantInformer "github.com/jovik31/tenant/pkg/client/informers/externalversions/jovik31.dev/v1alpha1"
 	tenantLister "github.com/jovik31/tenant/pkg/client/listers/jovik31.dev/v1alpha1"
+	"github.com/jovik31/tenant/pkg/network/ipam"
 
 	corev1 "k8s.io/api/core/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -25,8 +27,10 @@ import (
 	podLister "k8s.io/client-go/listers/core/v1"
 )
 
-var (
-	defaultNodeDir = "/var/lib/cni/tenantcni"
+const (
+	//Retries of a tenant delete waiting for its pods to release their IPs, about a minute and a half with the
+	//exponential backoff of the default rate limiter
+	maxDeleteRetries = 14
 )
 
 type Controller struct {
@@ -51,6 +55,18 @@ type Controller struct {
 
 	//event recorder
 	recorder record.EventRecorder
+
+	//storage of the node, tenant and pod stores, shared with the CNI plugin
+	storage ipam.Storage
+
+	//cluster PodCIDR, tenant cluster CIDRs must not overlap it
+	podCIDR string
+
+	//audit log of the IP and subnet changes made by the daemon, shared with the CNI plugin
+	audit *ipam.AuditLog
+
+	//backend of the ConfigMap set up for new tenants without a backend in their spec
+	backendType string
 }
 
 func NewController(
@@ -58,7 +74,11 @@ func NewController(
 	tenantClient tenantClientset.Interface,
 	kubeClient kubernetes.Interface,
 	tenantInformer tenantInformer.TenantInformer,
-	kubeInformer podInformers.PodInformer) *Controller {
+	kubeInformer podInformers.PodInformer,
+	storage ipam.Storage,
+	podCIDR string,
+	audit *ipam.AuditLog,
+	backendType string) *Controller {
 
 	logger := klog.FromContext(ctx)
 
@@ -82,6 +102,10 @@ func NewController(
 		podLister:    kubeInformer.Lister(),
 		workqueue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Tenant"),
 		recorder:     recorder,
+		storage:      storage,
+		podCIDR:      podCIDR,
+		audit:        audit,
+		backendType:  backendType,
 	}
 
 	//Add tenant informer for checking what tenants are available on the cluster at a specific time
@@ -179,14 +203,24 @@ func (c *Controller) processNextItem(ctx context.Context) bool {
 
 	if objEvent.eventType == "Delete" {
 
-		err = c.deleteTenant(objEvent)
+		//Give up waiting for the pods of the tenant to release their IPs after the last retry
+		force := c.workqueue.NumRequeues(obj) >= maxDeleteRetries
+		err = c.deleteTenant(objEvent, force)
 		if err == nil {
 			//No errors in deleting a tenant, tell the queue to stop tracking history for this object
 			c.workqueue.Forget(obj)
 			return true
 		}
-		c.workqueue.Forget(obj)
-		return true
+		//Failed deletes are retried like the tenants still in use, the forced last retry gives up
+		if !force {
+			if errors.Is(err, ipam.ErrTenantInUse) {
+				log.Printf("Tenant still in use, retrying delete: %s", err.Error())
+			} else {
+				utilruntime.HandleError(fmt.Errorf("%v failed with : %v, retrying delete", obj, err))
+			}
+			c.workqueue.AddRateLimited(obj)
+			return true
+		}
 
 	}
 	if objEvent.eventType != "Add" && objEvent.eventType != "Update" && objEvent.eventType != "Delete" {
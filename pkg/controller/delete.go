@@ -7,14 +7,15 @@ import (
 
 	"github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
 	"github.com/jovik31/tenant/pkg/k8s"
-	"github.com/jovik31/tenant/pkg/network/backend"
 	"github.com/jovik31/tenant/pkg/network/ipam"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
-func (c *Controller) deleteTenant(obj *EventObject) error {
+// Removes the tenant from the node once its pods released their IPs, forced removes it with IPs still allocated
+func (c *Controller) deleteTenant(obj *EventObject, force bool) error {
 
 	log.Print("Delete Tenant Received")
 	deletedTenant := obj.oldObj.(*v1alpha1.Tenant)
@@ -54,7 +55,7 @@ func (c *Controller) deleteTenant(obj *EventObject) error {
 		//Get pod list from the pod controller
 		//Send delete signal to every pod
 
-		podStore, err := ipam.NewPodStore()
+		podStore, err := ipam.NewPodStore(c.storage)
 		if err != nil {
 			log.Printf("Error creating pod store: %s", err.Error())
 		}
@@ -64,14 +65,6 @@ func (c *Controller) deleteTenant(obj *EventObject) error {
 		if err != nil {
 			log.Printf("Error creating pod ipam: %s", err.Error())
 		}
-		podData := pim.PodStore.Data
-		var deletePods []string
-		for podName, tenantName := range podData.Pods {
-			if tenantName == deletedTenant.Name {
-				deletePods = append(deletePods, podName)
-
-			}
-		}
 		podList, err := c.kubeClient.CoreV1().Pods("").List(context.TODO(), v1.ListOptions{})
 		if err != nil {
 			log.Printf("Failed to list pods with err %s", err.Error())
@@ -80,7 +73,9 @@ func (c *Controller) deleteTenant(obj *EventObject) error {
 		//Deletes all Pods related to the tenant
 		for _, pod := range podList.Items {
 
-			if slices.Contains(deletePods, pod.Name) {
+			//Pods already terminating from a previous attempt are not deleted again
+			podInfo, ok := pim.PodStore.GetPod(pod.Namespace, pod.Name, string(pod.UID))
+			if ok && slices.Contains(podInfo.Tenants, deletedTenant.Name) && pod.DeletionTimestamp == nil {
 				err = c.kubeClient.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, v1.DeleteOptions{})
 				if err != nil {
 					log.Printf("Failed to delete pod %s in namespace %s: %s", pod.Name, pod.Namespace, err.Error())
@@ -91,74 +86,61 @@ func (c *Controller) deleteTenant(obj *EventObject) error {
 
 		}
 
-		//Get tenant fields to delete network devices
-		t, err := ipam.NewTenantStore(defaultNodeDir, deletedTenant.Name)
+		//Get tenant fields to delete network devices, before the tenant store is removed
+		t, err := ipam.NewTenantStore(c.storage, deletedTenant.Name)
 		if err != nil {
 			log.Println("Error creating tenant store", err.Error())
+			return err
 		}
 		t.LoadTenantData()
 		tim, err := ipam.NewTenantIPAM(t, deletedTenant.Name)
 		if err != nil {
 			log.Println("Error creating tenant IPAM", err.Error())
 		}
-		tim.TenantStore.LoadTenantData()
-		//No need to delete routes. When devices are deleted, the routes are removed.
-		tenantBridge := tim.TenantStore.Data.Bridge.Name
-		vtepDevice := tim.TenantStore.Data.Vxlan.VtepName
-
-		//Need to wait for all pods to be deleted from tenant before deleting devices and tenantStore
-		//We reload tenant daata until we get all pods removed
-		//log.Print(pim.PodStore.Data.Pods.)
-		//for len()!=0 {
-		//tim.TenantStore.LoadTenantData()
-		//log.Print(tim.TenantStore.Data.IPs)
-
-		//}
-		log.Printf("All pods are deleted, proceed with node deletion process")
-		//Delete all network devices from the tenant in the node
-		if err := backend.DeleteTenantBridge(tenantBridge); err != nil {
-			log.Printf("Error deleting bridge %s", err)
-		}
-
-		if err := backend.DeleteVxLANDevice(vtepDevice); err != nil {
-			log.Printf("Error deleting vtep device: %s", err)
-		}
-
 		tenantName := tim.TenantName
+		leaked := len(tim.TenantStore.Data.IPs)
 
-		//Delete tenantStore and get tenantCIDR
-		if err := ipam.DeleteTenantStore(tenantName); err != nil {
-			log.Printf("Failed in deleting tenant store from node with err %s", err)
-		}
-
-		//Delete tenant from list in NodeStore and add to the avail list again
-		nodeStore, err := ipam.NewNodeStore(defaultNodeDir, currentNodeName)
+		//Delete tenantStore and return the tenantCIDR to the avail list in a single transaction.
+		//Pods of the tenant are still terminating while it has IPs allocated, the delete is retried until they are gone
+		nodeStore, err := ipam.NewNodeStore(c.storage, currentNodeName)
 		if err != nil {
 			log.Printf("Failed retrieving node store: %s", err)
+			return err
 		}
-		nodeStore.LoadNodeData()
 		nim, err := ipam.NewNodeIPAM(nodeStore, currentNodeName)
 		if err != nil {
 			log.Printf("Failed creating node IPAM: %s", err)
 		}
-		tenantList := nim.NodeStore.Data.TenantList
-		availList := nim.NodeStore.Data.AvailableList
-
-		for tenant, network := range tenantList {
-			if tenant == tenantName {
+		nim.Audit = c.audit
+		if err := nim.RemoveTenant(tenantName, force); err != nil {
+			log.Printf("Failed in removing tenant %s from node with err %s", tenantName, err)
+			return err
+		}
+		if force && leaked > 0 {
+			c.recorder.Eventf(deletedTenant, corev1.EventTypeWarning, "ForcedRemoval", "Tenant removed from node %s with %d IPs still allocated", currentNodeName, leaked)
+		}
 
-				//Remove tenantCIDR and return to AvailList
-				netS := network.String()
-				availList = append(availList, netS)
-				delete(tenantList, tenant)
+		log.Printf("All pods are deleted, proceed with node deletion process")
+		//Delete all network devices from the tenant in the node
+		//Routes through the devices are removed with them, routes of the remote nodes through the node uplink are not
+		if tim.TenantStore.Data.TenantName != "" {
+			be, local, err := tenantBackend(tim.TenantStore.Data)
+			if err != nil {
+				log.Printf("Error getting backend of tenant %s: %s", tenantName, err.Error())
+				return nil
+			}
+			for _, node := range deletedTenant.Spec.Nodes {
+				if remote, err := remoteNode(deletedTenant, node); err == nil && node.Name != currentNodeName {
+					if err := be.RemoveRemoteNode(local, remote); err != nil {
+						log.Printf("Error removing remote node %s of tenant %s: %s", node.Name, tenantName, err.Error())
+					}
+				}
+			}
+			if err := be.TeardownTenant(local); err != nil {
+				log.Printf("Error deleting devices of tenant %s: %s", tenantName, err.Error())
 			}
-
 		}
-		nim.NodeStore.Data.TenantList = tenantList
-		nim.NodeStore.Data.AvailableList = availList
-		nim.NodeStore.StoreNodeData()
 
-		//Delete tenant from list in NodeStore and add to the avail list again
 		return nil
 	}
 
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Periodically releases the IPs of containers whose DEL never arrived. An allocation is stale when its network
+// namespace is gone or its pod is no longer scheduled on the node, and it is released once it stayed stale for the
+// grace period. Reclaimed IPs are quarantined like the ones released by the CNI plugin.
+func (c *Controller) RunIPGC(ctx context.Context, nodeName string, interval time.Duration, grace time.Duration, quarantine time.Duration) {
+
+	if interval <= 0 {
+		log.Printf("Leaked IP collection disabled")
+		return
+	}
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.tenantSynced, c.podSynced); !ok {
+		log.Println("Cache not synced, leaked IP collection not started")
+		return
+	}
+	log.Printf("Collecting leaked IPs every %s with a grace period of %s", interval, grace)
+
+	staleSince := make(map[string]time.Time)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		c.collectLeakedIPs(nodeName, grace, quarantine, staleSince)
+	}, interval)
+}
+
+func (c *Controller) collectLeakedIPs(nodeName string, grace time.Duration, quarantine time.Duration, staleSince map[string]time.Time) {
+
+	nodeStore, err := ipam.NewNodeStore(c.storage, nodeName)
+	if err != nil {
+		log.Printf("Error creating node store: %s", err.Error())
+		return
+	}
+	if err := nodeStore.LoadNodeData(); err != nil {
+		log.Printf("Error loading node store: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for tenantName := range nodeStore.Data.TenantList {
+
+		t, err := ipam.NewTenantStore(c.storage, tenantName)
+		if err != nil {
+			log.Printf("Error creating tenant store: %s", err.Error())
+			continue
+		}
+		if err := t.LoadTenantData(); err != nil {
+			log.Printf("Error loading tenant store %s: %s", tenantName, err.Error())
+			continue
+		}
+		tim, err := ipam.NewTenantIPAM(t, tenantName)
+		if err != nil {
+			log.Printf("Error creating tenant IPAM: %s", err.Error())
+			continue
+		}
+		tim.Quarantine = quarantine
+		tim.Audit = c.audit
+
+		for ip, info := range t.Data.IPs {
+			key := tenantName + "/" + info.ID
+			if !c.isStaleIP(nodeName, info) {
+				continue
+			}
+			seen[key] = true
+			if _, ok := staleSince[key]; !ok {
+				log.Printf("IP %s of container %s in tenant %s is stale, releasing after %s", ip, info.ID, tenantName, grace)
+				staleSince[key] = now
+			}
+			if now.Sub(staleSince[key]) < grace {
+				continue
+			}
+
+			released, err := tim.ReleaseIP(info.ID)
+			if err != nil {
+				log.Printf("Error releasing leaked IP %s of container %s: %s", ip, info.ID, err.Error())
+				continue
+			}
+			delete(staleSince, key)
+			if released == nil {
+				continue
+			}
+			log.Printf("Released leaked IP %s of container %s in tenant %s", ip, info.ID, tenantName)
+			c.recorder.Eventf(c.tenantRef(tenantName, nodeName), corev1.EventTypeWarning, "ReclaimedIP",
+				"Leaked IP %s of container %s (pod %s/%s) reclaimed on node %s", ip, info.ID, info.Namespace, info.Name, nodeName)
+		}
+	}
+
+	//Allocations that are live again or already released restart their grace period
+	for key := range staleSince {
+		if !seen[key] {
+			delete(staleSince, key)
+		}
+	}
+}
+
+// An allocation is stale when its network namespace is known to be gone, its pod is not scheduled on the node or the
+// pod was recreated under the same name
+func (c *Controller) isStaleIP(nodeName string, info ipam.ContainerNetInfo) bool {
+
+	if info.NetNS != "" {
+		if _, err := os.Stat(info.NetNS); os.IsNotExist(err) {
+			//A missing parent directory means the namespaces are not visible from the daemon, rely on the pod only
+			if _, err := os.Stat(filepath.Dir(info.NetNS)); err == nil {
+				return true
+			}
+		}
+	}
+	//Allocations recorded without the pod namespace can only be judged by their network namespace
+	if info.Namespace == "" || info.Name == "" {
+		return false
+	}
+	pod, err := c.podLister.Pods(info.Namespace).Get(info.Name)
+	if err != nil {
+		return true
+	}
+	if info.UID != "" && string(pod.UID) != info.UID {
+		return true
+	}
+	return pod.Spec.NodeName != nodeName
+}
+
+// Events of a tenant store are recorded on its tenant, or on the node when the tenant resource is gone
+func (c *Controller) tenantRef(tenantName string, nodeName string) runtime.Object {
+
+	if tenant := c.findTenant(tenantName); tenant != nil {
+		return tenant
+	}
+	return &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: k8stypes.UID(nodeName)}
+}
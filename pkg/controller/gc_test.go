@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	podLister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+)
+
+func TestIsStaleIP(t *testing.T) {
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pods := []*corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1", UID: "uid1"}, Spec: corev1.PodSpec{NodeName: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "moved", UID: "uid2"}, Spec: corev1.PodSpec{NodeName: "node2"}},
+	}
+	for _, pod := range pods {
+		if err := indexer.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &Controller{podLister: podLister.NewPodLister(indexer)}
+
+	//A namespace directory without the namespace of the pod
+	netnsDir := t.TempDir()
+	goneNetNS := filepath.Join(netnsDir, "cni-gone")
+
+	tests := []struct {
+		name string
+		info ipam.ContainerNetInfo
+		want bool
+	}{
+		{name: "pod on the node", info: ipam.ContainerNetInfo{Namespace: "default", Name: "pod1", UID: "uid1"}, want: false},
+		{name: "pod without a recorded UID", info: ipam.ContainerNetInfo{Namespace: "default", Name: "pod1"}, want: false},
+		{name: "pod recreated under the same name", info: ipam.ContainerNetInfo{Namespace: "default", Name: "pod1", UID: "uid0"}, want: true},
+		{name: "pod on another node", info: ipam.ContainerNetInfo{Namespace: "default", Name: "moved", UID: "uid2"}, want: true},
+		{name: "pod gone", info: ipam.ContainerNetInfo{Namespace: "default", Name: "pod2", UID: "uid3"}, want: true},
+		//The lister is not consulted without the namespace, pod1 in the default namespace must not be matched
+		{name: "no namespace", info: ipam.ContainerNetInfo{Name: "pod2"}, want: false},
+		{name: "no namespace and netns gone", info: ipam.ContainerNetInfo{Name: "pod1", NetNS: goneNetNS}, want: true},
+		{name: "netns gone", info: ipam.ContainerNetInfo{Namespace: "default", Name: "pod1", UID: "uid1", NetNS: goneNetNS}, want: true},
+		{name: "netns directory not visible", info: ipam.ContainerNetInfo{Namespace: "default", Name: "pod1", UID: "uid1", NetNS: "/nonexistent/netns/cni-1"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := c.isStaleIP("node1", tt.info); got != tt.want {
+				t.Fatalf("stale %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,15 +3,12 @@ package controller
 import (
 	"log"
 
+	"github.com/jovik31/tenant/pkg/k8s"
 	"github.com/jovik31/tenant/pkg/network/ipam"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
-const (
-	podTenantAnnotationKey = "jovik31.dev.tenants"
-)
-
 func (c *Controller) handleAdd(obj interface{}) {
 
 	key, err := cache.MetaNamespaceKeyFunc(obj)
@@ -68,7 +65,7 @@ func (c *Controller) handleDelete(obj interface{}) {
 func (c *Controller) handlePodAdd(obj interface{}) {
 
 	newPod := obj.(*v1.Pod)
-	p, err := ipam.NewPodStore()
+	p, err := ipam.NewPodStore(c.storage)
 	if err != nil {
 		log.Printf("Failed to get pod storage %v", err)
 	}
@@ -78,19 +75,16 @@ func (c *Controller) handlePodAdd(obj interface{}) {
 	if err != nil {
 		log.Printf("Failed to generate pod ipam, %v", err)
 	}
-	pod_map := pim.PodStore.Data.Pods
-	tenantAnnotation := newPod.Annotations[podTenantAnnotationKey]
 	if newPod.Spec.HostNetwork {
 		p.Unlock()
 		return
 	}else{
-		if tenantAnnotation == "" {
-			pod_map[newPod.Name] = "defaulttenant"
-			
-
-		}else {
-			pod_map[newPod.Name] = tenantAnnotation
+		podInfo := ipam.PodInfo{
+			UID:     string(newPod.UID),
+			Tenants: k8s.PodTenants(newPod),
+			IP:      k8s.PodRequestedIP(newPod),
 		}
+		pim.PodStore.SetPod(newPod.Namespace, newPod.Name, podInfo)
 	p.StorePodData()
 	p.Unlock()
 	log.Printf("Pod Added: %s, with namespace %s", newPod.Name, newPod.Namespace)
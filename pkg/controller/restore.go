@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"net"
+
+	"github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
+	"github.com/jovik31/tenant/pkg/network/backend"
+	"github.com/jovik31/tenant/pkg/network/ipam"
+	"github.com/jovik31/tenant/pkg/network/routing"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// Rebuilds the dataplane of the tenants in the node store after a restart or a reboot: bridges, vxlan devices,
+// the fdb, arp and route entries of the remote nodes and the iptables rules. The vtep information of the node is
+// published again on the tenant resources. Tenants removed while the daemon was down are queued for deletion.
+func (c *Controller) RestoreNode(ctx context.Context, nodeName string, mtu int) {
+
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.tenantSynced); !ok {
+		log.Println("Cache not synced, node not restored")
+		return
+	}
+
+	nodeStore, err := ipam.NewNodeStore(c.storage, nodeName)
+	if err != nil {
+		log.Printf("Error creating node store: %s", err.Error())
+		return
+	}
+	if err := nodeStore.LoadNodeData(); err != nil {
+		log.Printf("Error loading node store: %s", err.Error())
+		return
+	}
+
+	for tenantName, tenantCIDR := range nodeStore.Data.TenantList {
+
+		t, err := ipam.NewTenantStore(c.storage, tenantName)
+		if err != nil {
+			log.Printf("Error creating tenant store: %s", err.Error())
+			continue
+		}
+		if err := t.LoadTenantData(); err != nil || t.Data.TenantName == "" {
+			log.Printf("Tenant store %s missing, not restored", tenantName)
+			continue
+		}
+
+		tenant := c.findTenant(tenantName)
+		if tenant == nil || !existsNode(tenant.Spec.Nodes, nodeName) {
+			log.Printf("Tenant %s removed from the node while the daemon was down, deleting it", tenantName)
+			c.queueStaleTenant(tenant, tenantName, nodeName)
+			continue
+		}
+
+		log.Printf("Restoring tenant %s with subnet %s", tenantName, tenantCIDR.String())
+		if t.Data.Bridge != nil && t.Data.Bridge.Gateway.IsValid() {
+			gateway := &net.IPNet{IP: net.IP(t.Data.Bridge.Gateway.AsSlice()), Mask: net.CIDRMask(tenantCIDR.Bits(), 32)}
+			if _, err := backend.CreateTenantBridge(t.Data.Bridge.Name, mtu, gateway); err != nil {
+				log.Printf("Error restoring bridge %s: %s", t.Data.Bridge.Name, err.Error())
+			}
+		}
+		c.addRemoteNodes(tenant, nodeName)
+		if err := c.publishVtep(tenant, nodeStore.Data.NodeIP, t.Data, nodeName); err != nil {
+			log.Printf("Error publishing vtep of tenant %s: %s", tenantName, err.Error())
+		}
+
+		//Forwarding rules are only added when missing
+		if err := routing.AllowForwardingTenant(t.Data.TenantCIDR); err != nil {
+			log.Printf("Error restoring forwarding of tenant %s: %s", tenantName, err.Error())
+		}
+		for other, otherCIDR := range nodeStore.Data.TenantList {
+			if other != tenantName && other != "defaulttenant" && tenantName != "defaulttenant" {
+				routing.BlockTenant2TenantTraffic(t.Data.TenantCIDR, otherCIDR.String())
+			}
+		}
+		c.recorder.Event(tenant, corev1.EventTypeNormal, "Restored", "Tenant has been restored on node: "+nodeName)
+	}
+}
+
+// Returns the tenant resource of the tenant store, nil when it does not exist
+func (c *Controller) findTenant(tenantName string) *v1alpha1.Tenant {
+
+	tenants, err := c.tenantLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	for _, tenant := range tenants {
+		if tenant.Name == tenantName {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// Queues the delete of a tenant left on the node, with the node in the node list so the delete handler removes it
+func (c *Controller) queueStaleTenant(tenant *v1alpha1.Tenant, tenantName string, nodeName string) {
+
+	stale := &v1alpha1.Tenant{
+		ObjectMeta: v1.ObjectMeta{Name: tenantName},
+		Spec: v1alpha1.TenantSpec{
+			Name:  tenantName,
+			Nodes: []v1alpha1.Node{{Name: nodeName}},
+		},
+	}
+	if tenant != nil {
+		stale = tenant.DeepCopy()
+		stale.Spec.Nodes = append(stale.Spec.Nodes, v1alpha1.Node{Name: nodeName})
+	}
+	key, err := cache.MetaNamespaceKeyFunc(stale)
+	if err != nil {
+		log.Printf("Failed in getting key of tenant %s: %s", tenantName, err.Error())
+		return
+	}
+	c.workqueue.Add(&EventObject{
+		eventType: "Delete",
+		newObj:    nil,
+		oldObj:    stale,
+		key:       key,
+	})
+}
+
+// Publishes the vtep of the node on the tenant resource when it differs from the tenant store, e.g. after the node
+// entry was edited while the daemon was down
+func (c *Controller) publishVtep(tenant *v1alpha1.Tenant, nodeIP string, data *ipam.TenantData, nodeName string) error {
+
+	if data.Vxlan == nil {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+
+		current, err := c.tenantClient.Jovik31V1alpha1().Tenants(tenant.Namespace).Get(context.TODO(), tenant.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		newTenant := current.DeepCopy()
+		for index, node := range newTenant.Spec.Nodes {
+			if node.Name != nodeName {
+				continue
+			}
+			if node.NodeIP == nodeIP && node.VtepIp == data.Vxlan.VtepIP && node.VtepMac == data.Vxlan.VtepMac {
+				return nil
+			}
+			newTenant.Spec.Nodes[index].NodeIP = nodeIP
+			newTenant.Spec.Nodes[index].VtepIp = data.Vxlan.VtepIP
+			newTenant.Spec.Nodes[index].VtepMac = data.Vxlan.VtepMac
+			if data.ClusterCIDR != "" {
+				newTenant.Spec.Nodes[index].CIDR = data.TenantCIDR
+			}
+			_, err = c.tenantClient.Jovik31V1alpha1().Tenants(newTenant.Namespace).Update(context.TODO(), newTenant, v1.UpdateOptions{FieldManager: "tenant-controller"})
+			return err
+		}
+		return nil
+	})
+}
@@ -2,14 +2,11 @@ package controller
 
 import (
 	"log"
-	"net"
 	"reflect"
 
 	"github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
 	"github.com/jovik31/tenant/pkg/k8s"
 	"github.com/jovik31/tenant/pkg/network/ipam"
-	"github.com/jovik31/tenant/pkg/network/routing"
-	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/retry"
@@ -89,79 +86,46 @@ func (c *Controller) updateTenant(obj *EventObject) error {
 			}
 			newTenant = tenant.DeepCopy()
 
-			for _, node := range newTenant.Spec.Nodes {
-
-				//Add arp, fdb and route entries for the remote vtep nodes, excludes current node
-
-				if node.Name != currentNodeName {
-
-					if node.NodeIP == "" || node.VtepIp == "" || node.VtepMac == "" {
-						log.Printf("Node %s not initialized, update when node has been initialized", node.Name)
-						continue
-					}
-					t, err := ipam.NewTenantStore(defaultNodeDir, newTenant.Name)
-					if err != nil {
-						log.Println("Error creating tenant store", err.Error())
-					}
-					t.LoadTenantData()
-					tim, err := ipam.NewTenantIPAM(t, newTenant.Name)
-					if err != nil {
-						log.Println("Error creating tenant IPAM", err.Error())
-					}
-					//local vtep device information
-					vtepName := tim.TenantStore.Data.Vxlan.VtepName
-					vtepDevice, err := netlink.LinkByName(vtepName)
-					if err != nil {
-						log.Println("Error getting vtep device", err.Error())
-					}
-					vtepIndex := vtepDevice.Attrs().Index
-
-					//remote vtep information
-					vtepMac, err := net.ParseMAC(node.VtepMac)
-					vtepIP := net.ParseIP(node.VtepIp)
-					nodeIP := net.ParseIP(node.NodeIP)
-					if err != nil {
-						log.Println("Error parsing mac address", err.Error())
-					}
-
-					//Add arp, fdb and route entries for the remote vtep nodes
-					err = routing.AddARP(vtepIndex, vtepIP, vtepMac)
-					if err != nil {
-						log.Println("Error adding arp entry", err.Error())
-					}
-					routing.AddFDB(vtepIndex, nodeIP, vtepMac)
-					if err != nil {
-						log.Println("Error adding fdb entry", err.Error())
-					}
-					mask := net.CIDRMask(newTenant.Spec.Prefix, 32)
-
-					remoteCIDR := net.IPNet{IP: vtepIP, Mask: mask}
-					err = routing.AddRoutes(vtepIndex, &remoteCIDR, vtepIP)
-					if err != nil {
-						log.Println("Error adding route entry", err.Error())
-					}
-
-					//Update tenant
-				}
-				continue
-
-			}
+			//Reach the tenant on the new remote nodes and stop reaching it on the removed ones, excludes current node
+			c.addRemoteNodes(newTenant, currentNodeName)
+			c.removeRemoteNodes(newTenant, removedNodes(oldTenant.Spec.Nodes, newTenant.Spec.Nodes), currentNodeName)
 			c.recorder.Event(newTenant, corev1.EventTypeNormal, "Update", "Tenant has been updated on node: "+currentNodeName)
 		}
 
 	}
 
+	if existsNode(newTenant.Spec.Nodes, currentNodeName) && !reflect.DeepEqual(newTenant.Spec.DNS, oldTenant.Spec.DNS) {
+
+		//DNS settings can be changed, new pods receive the updated values
+		t, err := ipam.NewTenantStore(c.storage, newTenant.Name)
+		if err != nil {
+			log.Println("Error creating tenant store", err.Error())
+			return err
+		}
+		tim, err := ipam.NewTenantIPAM(t, newTenant.Name)
+		if err != nil {
+			log.Println("Error creating tenant IPAM", err.Error())
+			return err
+		}
+		if err := tim.SetDNS(tenantDNS(newTenant.Spec)); err != nil {
+			log.Println("Error storing tenant DNS", err.Error())
+			return err
+		}
+	}
+
 	if existsNode(newTenant.Spec.Nodes, currentNodeName) {
-		//Changing the Name, VNI or Prefix is not allowed. Revert changes with the ones applied at Tenant Addition.
+		//Changing the Name, VNI, Prefix, ClusterCIDR or Backend is not allowed. Revert changes with the ones applied at Tenant Addition.
 		if !reflect.DeepEqual(newTenant.Spec.Prefix, oldTenant.Spec.Prefix) ||
+			!reflect.DeepEqual(newTenant.Spec.ClusterCIDR, oldTenant.Spec.ClusterCIDR) ||
 			!reflect.DeepEqual(newTenant.Spec.VNI, oldTenant.Spec.VNI) ||
+			!reflect.DeepEqual(newTenant.Spec.Backend, oldTenant.Spec.Backend) ||
 			!reflect.DeepEqual(newTenant.ObjectMeta.Name, oldTenant.ObjectMeta.Name) ||
 			!reflect.DeepEqual(newTenant.Spec.Name, oldTenant.Spec.Name) {
-			c.recorder.Event(newTenant, corev1.EventTypeWarning, "Failed Update", "Fields: Name, VNI and Prefix cannot be changed"+currentNodeName)
+			c.recorder.Event(newTenant, corev1.EventTypeWarning, "Failed Update", "Fields: Name, VNI, Prefix, ClusterCIDR and Backend cannot be changed"+currentNodeName)
 
 			//We need the values saved on node
 			//Get tenant values saved on Node
-			t, err := ipam.NewTenantStore(defaultNodeDir, newTenant.Name)
+			t, err := ipam.NewTenantStore(c.storage, newTenant.Name)
 			if err != nil {
 
 				log.Println("Error creating tenant store", err.Error())
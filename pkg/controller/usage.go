@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jovik31/tenant/pkg/network/ipam"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	//Node condition set while the tenant subnets take more than the threshold of the node CIDR
+	NodeSubnetPressure corev1.NodeConditionType = "TenantSubnetPressure"
+	//Node condition set while a tenant uses more than the threshold of its subnet on the node
+	NodeIPPressure corev1.NodeConditionType = "TenantIPPressure"
+)
+
+// Usage level of a tenant or of the node subnets, events are recorded when it changes
+type usageLevel int
+
+const (
+	usageNormal usageLevel = iota
+	usageHigh
+	usageExhausted
+)
+
+func levelOf(utilization float64, exhausted bool, threshold float64) usageLevel {
+
+	switch {
+	case exhausted:
+		return usageExhausted
+	case utilization >= threshold:
+		return usageHigh
+	}
+	return usageNormal
+}
+
+// Periodically computes the usage of the node subnets and of the tenant subnets from the stores. Tenants crossing the
+// threshold, or running out of IPs, get a warning event and the node conditions report the pressure on the node.
+func (c *Controller) RunUsageReport(ctx context.Context, nodeName string, interval time.Duration, threshold float64) {
+
+	if interval <= 0 {
+		log.Printf("IPAM usage reporting disabled")
+		return
+	}
+	if ok := cache.WaitForCacheSync(ctx.Done(), c.tenantSynced); !ok {
+		log.Println("Cache not synced, IPAM usage reporting not started")
+		return
+	}
+	log.Printf("Reporting IPAM usage every %s with a threshold of %.0f%%", interval, threshold*100)
+
+	levels := make(map[string]usageLevel)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		c.reportUsage(ctx, nodeName, threshold, levels)
+	}, interval)
+}
+
+func (c *Controller) reportUsage(ctx context.Context, nodeName string, threshold float64, levels map[string]usageLevel) {
+
+	usage, err := ipam.NodeUtilization(c.storage, nodeName)
+	if err != nil {
+		log.Printf("Error computing IPAM usage: %s", err.Error())
+		return
+	}
+
+	pressured := []string{}
+	seen := make(map[string]bool)
+	for _, tenant := range usage.Tenants {
+		seen[tenant.Tenant] = true
+		level := levelOf(tenant.Utilization(), tenant.Exhausted(), threshold)
+		if level != usageNormal {
+			pressured = append(pressured, fmt.Sprintf("%s %.0f%%", tenant.Tenant, tenant.Utilization()*100))
+		}
+		if level == levels[tenant.Tenant] {
+			continue
+		}
+		levels[tenant.Tenant] = level
+
+		ref := c.tenantRef(tenant.Tenant, nodeName)
+		switch level {
+		case usageExhausted:
+			log.Printf("Tenant %s exhausted its subnet %s on the node", tenant.Tenant, tenant.CIDR)
+			c.recorder.Eventf(ref, corev1.EventTypeWarning, "IPsExhausted",
+				"No IP left in subnet %s on node %s, %d allocated and %d quarantined", tenant.CIDR, nodeName, tenant.Allocated, tenant.Quarantined)
+		case usageHigh:
+			log.Printf("Tenant %s uses %.0f%% of its subnet %s on the node", tenant.Tenant, tenant.Utilization()*100, tenant.CIDR)
+			c.recorder.Eventf(ref, corev1.EventTypeWarning, "IPUsageHigh",
+				"%.0f%% of subnet %s used on node %s, %d allocated, %d quarantined and %d free", tenant.Utilization()*100,
+				tenant.CIDR, nodeName, tenant.Allocated, tenant.Quarantined, tenant.Free)
+		default:
+			c.recorder.Eventf(ref, corev1.EventTypeNormal, "IPUsageNormal",
+				"%.0f%% of subnet %s used on node %s", tenant.Utilization()*100, tenant.CIDR, nodeName)
+		}
+	}
+	//Tenants removed from the node start from the normal level when they come back
+	for name := range levels {
+		if !seen[name] {
+			delete(levels, name)
+		}
+	}
+
+	subnetCondition := corev1.NodeCondition{
+		Type:    NodeSubnetPressure,
+		Status:  corev1.ConditionFalse,
+		Reason:  "SubnetsAvailable",
+		Message: fmt.Sprintf("%.0f%% of node CIDR %s used by tenants, fragmentation %.2f", usage.Utilization()*100, usage.NodeCIDR, usage.Fragmentation),
+	}
+	switch levelOf(usage.Utilization(), usage.Free == 0, threshold) {
+	case usageExhausted:
+		subnetCondition.Status = corev1.ConditionTrue
+		subnetCondition.Reason = "SubnetsExhausted"
+	case usageHigh:
+		subnetCondition.Status = corev1.ConditionTrue
+		subnetCondition.Reason = "SubnetUsageHigh"
+	}
+
+	ipCondition := corev1.NodeCondition{
+		Type:    NodeIPPressure,
+		Status:  corev1.ConditionFalse,
+		Reason:  "IPsAvailable",
+		Message: fmt.Sprintf("All tenants below %.0f%% of their subnet", threshold*100),
+	}
+	if len(pressured) > 0 {
+		ipCondition.Status = corev1.ConditionTrue
+		ipCondition.Reason = "IPUsageHigh"
+		ipCondition.Message = "Tenants above the threshold: " + strings.Join(pressured, ", ")
+	}
+
+	if err := c.setNodeConditions(ctx, nodeName, subnetCondition, ipCondition); err != nil {
+		log.Printf("Error updating conditions of node %s: %s", nodeName, err.Error())
+	}
+}
+
+// Patches the conditions on the node status. The transition time is kept while the status of a condition is unchanged
+func (c *Controller) setNodeConditions(ctx context.Context, nodeName string, conditions ...corev1.NodeCondition) error {
+
+	node, err := c.kubeClient.CoreV1().Nodes().Get(ctx, nodeName, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := v1.Now()
+	for i := range conditions {
+		conditions[i].LastHeartbeatTime = now
+		conditions[i].LastTransitionTime = now
+		for _, current := range node.Status.Conditions {
+			if current.Type == conditions[i].Type && current.Status == conditions[i].Status {
+				conditions[i].LastTransitionTime = current.LastTransitionTime
+			}
+		}
+	}
+
+	//Conditions are merged on their type, the conditions of the kubelet are left untouched
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": conditions,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().Nodes().PatchStatus(ctx, nodeName, patch)
+	return err
+}
+
+// Events of an allocation failing for lack of subnets are recorded on the node as well, the node is the one full
+func (c *Controller) recordSubnetsExhausted(nodeName string, tenantName string, cause error) {
+
+	ref := &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: k8stypes.UID(nodeName)}
+	c.recorder.Eventf(ref, corev1.EventTypeWarning, "SubnetsExhausted", "Tenant %s could not be allocated a subnet: %s", tenantName, cause.Error())
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"log"
 
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/jovik31/tenant/pkg/apis/jovik31.dev/v1alpha1"
 	"github.com/jovik31/tenant/pkg/network/ipam"
 
+	corev1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 )
 
 
@@ -50,6 +53,8 @@ func (c *Controller) UpdateTenantResource(tenant *v1alpha1.Tenant, tenantOnFile
 	newTenant.ObjectMeta.Name = tenantOnFile.TenantName
 	newTenant.Spec.VNI = tenantOnFile.Vxlan.VNI
 	newTenant.Spec.Prefix = tenantOnFile.TenantPrefix
+	newTenant.Spec.ClusterCIDR = tenantOnFile.ClusterCIDR
+	newTenant.Spec.Backend = tenantOnFile.Backend
 
 	_, err := c.tenantClient.Jovik31V1alpha1().Tenants(namespace).Update(context.TODO(), newTenant, metaV1.UpdateOptions{FieldManager: "tenant-operator"})
 	if err!=nil{
@@ -58,4 +63,26 @@ func (c *Controller) UpdateTenantResource(tenant *v1alpha1.Tenant, tenantOnFile
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// Converts the tenant DNS settings to the format returned in the CNI result
+func tenantDNS(spec v1alpha1.TenantSpec) *types.DNS {
+
+	if spec.DNS == nil {
+		return nil
+	}
+	dns := &types.DNS{
+		Nameservers: spec.DNS.Nameservers,
+		Domain:      spec.DNS.Domain,
+		Search:      spec.DNS.Search,
+		Options:     spec.DNS.Options,
+	}
+	return dns.Copy()
+}
+
+// Records a warning on the node when a store was corrupted and restored from its previous generation
+func (c *Controller) RecordStoreRecovery(nodeName string, key string, cause error) {
+
+	ref := &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: k8stypes.UID(nodeName)}
+	c.recorder.Eventf(ref, corev1.EventTypeWarning, "StoreRecovered", "Store %s restored from its previous generation: %s", key, cause.Error())
+}
@@ -54,6 +54,33 @@ func RegisterTenantCRD(config *rest.Config) {
 									"prefix": {	
 										Type: "integer",
 									},
+									"clusterCIDR": {
+										Type: "string",
+									},
+									"backend": {
+										Type: "string",
+										Enum: []apixv1.JSON{{Raw: []byte(`"vxlan"`)}, {Raw: []byte(`"host-gw"`)}},
+									},
+									"dns": {
+										Type: "object",
+										Properties: map[string]apixv1.JSONSchemaProps{
+											"nameservers": {
+												Type:  "array",
+												Items: &apixv1.JSONSchemaPropsOrArray{Schema: &apixv1.JSONSchemaProps{Type: "string"}},
+											},
+											"domain": {
+												Type: "string",
+											},
+											"search": {
+												Type:  "array",
+												Items: &apixv1.JSONSchemaPropsOrArray{Schema: &apixv1.JSONSchemaProps{Type: "string"}},
+											},
+											"options": {
+												Type:  "array",
+												Items: &apixv1.JSONSchemaPropsOrArray{Schema: &apixv1.JSONSchemaProps{Type: "string"}},
+											},
+										},
+									},
 									"nodes": {
 										Type: "array",
 										Items: &apixv1.JSONSchemaPropsOrArray{
@@ -75,6 +102,9 @@ func RegisterTenantCRD(config *rest.Config) {
 													"nodeIP": {
 														Type: "string",
 													},
+													"cidr": {
+														Type: "string",
+													},
 												},
 											},
 										},
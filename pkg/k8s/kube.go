@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 
 	"github.com/pkg/errors"
@@ -20,6 +22,13 @@ import (
 
 const (
 	tenantNodeAnnotationKey = "jovik31.dev.tenantcni"
+
+	//Pod annotation selecting the tenant of the pod
+	PodTenantAnnotationKey = "jovik31.dev.tenants"
+	//Pod annotation requesting a fixed IP inside the tenant
+	PodIPAnnotationKey = "jovik31.dev.ip"
+	//Tenant of the pods without a tenant annotation
+	DefaultTenant = "defaulttenant"
 )
 
 func GetCurrentNodeName(clientset *kubernetes.Clientset) (string, error) {
@@ -60,6 +69,52 @@ func GetKubeClientSet() (*kubernetes.Clientset, error) {
 
 }
 
+// Builds a clientset from a kubeconfig file, used outside of the cluster pods such as by the CNI plugin
+func GetKubeClientSetFromFile(kubeconfig string) (*kubernetes.Clientset, error) {
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Returns the pod, failing if it was recreated with a different UID
+func GetPod(clientset *kubernetes.Clientset, namespace string, name string, uid string) (*v1.Pod, error) {
+
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if uid != "" && string(pod.UID) != uid {
+		return nil, errors.Errorf("pod %s/%s has uid %s, expected %s", namespace, name, pod.UID, uid)
+	}
+	return pod, nil
+}
+
+// Returns the ordered tenant list of the tenant annotation, the first tenant holds the primary interface.
+// Pods without annotation belong to the default tenant
+func PodTenants(pod *v1.Pod) []string {
+
+	var tenants []string
+	for _, tenant := range strings.Split(pod.Annotations[PodTenantAnnotationKey], ",") {
+		tenant = strings.TrimSpace(tenant)
+		if tenant == "" || slices.Contains(tenants, tenant) {
+			continue
+		}
+		tenants = append(tenants, tenant)
+	}
+	if len(tenants) == 0 {
+		tenants = []string{DefaultTenant}
+	}
+	return tenants
+}
+
+// Returns the IP requested through the pod annotation, empty when the pod takes any free IP
+func PodRequestedIP(pod *v1.Pod) string {
+	return pod.Annotations[PodIPAnnotationKey]
+}
+
 func InitKubeConfig() (*rest.Config, error) {
 	var kubeconfig *string
 
@@ -1,18 +1,29 @@
 package log
 
 import (
+	"fmt"
 	"log"
 	"os"
 )
 
 var (
-	logFile= "/var/log/tenantcni.log"
+	logFile  = "/var/log/tenantcni.log"
+	logLevel = levelInfo
 )
 
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
 
-func LoadLogFile() *os.File {
+func LoadLogFile(path string) *os.File {
 
-	file, err := openLogFile(logFile)
+	if path == "" {
+		path = logFile
+	}
+	file, err := openLogFile(path)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -22,10 +33,36 @@ func LoadLogFile() *os.File {
 	return file
 }
 
+// SetLevel sets the minimum level written by the leveled helpers, unknown levels fall back to info
+func SetLevel(level string) {
+	switch level {
+	case "debug":
+		logLevel = levelDebug
+	case "warn":
+		logLevel = levelWarn
+	case "error":
+		logLevel = levelError
+	default:
+		logLevel = levelInfo
+	}
+}
+
+func Debugf(format string, v ...interface{}) {
+	if logLevel <= levelDebug {
+		log.Output(2, "DEBUG "+fmt.Sprintf(format, v...))
+	}
+}
+
+func Warnf(format string, v ...interface{}) {
+	if logLevel <= levelWarn {
+		log.Output(2, "WARN "+fmt.Sprintf(format, v...))
+	}
+}
+
 func openLogFile(path string) (*os.File, error) {
 	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
 	return logFile, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	//Tenant bridge with a vxlan device per tenant, remote tenant subnets are reached through the vxlan overlay
+	TypeVxlan = "vxlan"
+	//Tenant bridge only, remote tenant subnets are routed to the remote node IP. The nodes must share a L2 segment
+	TypeHostGW = "host-gw"
+)
+
+var (
+	ErrUnsupportedBackend = errors.New("unsupported backend type")
+)
+
+// Tenant is the node local state of a tenant needed by the backends
+type Tenant struct {
+	Name string
+	//Tenant subnet of the node
+	CIDR *net.IPNet
+	//Vxlan device of the tenant, unused by backends without overlay
+	VtepName string
+	VNI      int
+	VtepMac  string
+	Bridge   string
+	//Other nodes of the tenant
+	RemoteNodes []string
+}
+
+// RemoteNode is a remote node of the tenant as published on the tenant resource
+type RemoteNode struct {
+	Name    string
+	NodeIP  net.IP
+	VtepIP  net.IP
+	VtepMac net.HardwareAddr
+	//Tenant subnet of the remote node
+	CIDR *net.IPNet
+}
+
+// Backend sets up the node devices and routes carrying the traffic of a tenant between the nodes of the tenant.
+// Every call must be idempotent, they are repeated on updates and when the node is restored after a restart.
+type Backend interface {
+	Type() string
+	//Creates the devices of the tenant reaching the remote nodes
+	InitTenant(tenant *Tenant) error
+	//Makes the tenant subnet of the remote node reachable from the node
+	AddRemoteNode(tenant *Tenant, node *RemoteNode) error
+	//Removes the entries added for the remote node
+	RemoveRemoteNode(tenant *Tenant, node *RemoteNode) error
+	//Deletes the devices of the tenant, missing devices are not an error
+	TeardownTenant(tenant *Tenant) error
+	//Validates the devices of the tenant
+	CheckTenant(tenant *Tenant) error
+}
+
+// Returns the backend of the type, an empty type is the vxlan backend
+func New(backendType string) (Backend, error) {
+
+	switch backendType {
+	case "", TypeVxlan:
+		return &VxlanBackend{}, nil
+	case TypeHostGW:
+		return &HostGWBackend{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedBackend, backendType)
+}
@@ -1,20 +1,24 @@
 package backend
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
-	"net/netip"
 	"os"
 	"syscall"
 
 	"github.com/vishvananda/netlink"
 
+	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 )
 
-func CreateTenantBridge(bridgeName string, mtu int, gateway netip.Addr) (netlink.Link, error) {
+// Creates the tenant bridge holding the gateway address, the gateway mask is the tenant subnet mask
+func CreateTenantBridge(bridgeName string, mtu int, gateway *net.IPNet) (netlink.Link, error) {
 	if l, _ := netlink.LinkByName(bridgeName); l != nil {
 		return l, nil
 	}
@@ -35,14 +39,7 @@ func CreateTenantBridge(bridgeName string, mtu int, gateway netip.Addr) (netlink
 	if err != nil {
 		return nil, err
 	}
-	gatewayString := gateway.String()
-	gatewayString = gatewayString+"/24"
-
-	ip, ipnet, err := net.ParseCIDR(gatewayString)
-	if err != nil {
-		return nil, err
-	}
-	if err := netlink.AddrAdd(dev, &netlink.Addr{IPNet: &net.IPNet{IP:ip, Mask: ipnet.Mask}}); err != nil {
+	if err := netlink.AddrAdd(dev, &netlink.Addr{IPNet: gateway}); err != nil && err != syscall.EEXIST {
 		return nil, err
 	}
 
@@ -61,16 +58,24 @@ func DeleteTenantBridge(bridgeName string) error{
 	return netlink.LinkDel(bridge)
 }
 
-func SetupVeth(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podIP *net.IPNet, gateway net.IP) error {
+// Creates the pod veth pair attached to the tenant bridge, returns the host and container interfaces.
+// A nil gateway sets up a secondary interface, reaching only the tenant subnet
+func SetupVeth(netns ns.NetNS, br netlink.Link, mtu int, containerID string, ifName string, podIP *net.IPNet, gateway net.IP, hairpinMode bool, routes []*types.Route) (*current.Interface, *current.Interface, error) {
+	hostVethName := HostVethName(containerID, ifName)
 	hostIface := &current.Interface{}
+	containerIface := &current.Interface{}
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithName(ifName, hostVethName, mtu, "", hostNS)
 		if err != nil {
 			return err
 		}
 		hostIface.Name = hostVeth.Name
+		hostIface.Mac = hostVeth.HardwareAddr.String()
+		containerIface.Name = containerVeth.Name
+		containerIface.Mac = containerVeth.HardwareAddr.String()
+		containerIface.Sandbox = netns.Path()
 
 		// set ip for container veth
 		conLink, err := netlink.LinkByName(containerVeth.Name)
@@ -86,66 +91,177 @@ func SetupVeth(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podIP *n
 			return err
 		}
 
+		if gateway == nil {
+			return nil
+		}
+
 		// add default route
 		if err := ip.AddDefaultRoute(gateway, conLink); err != nil {
 			return err
 		}
 
+		// add extra routes from the ipam configuration through the tenant gateway
+		for _, r := range routes {
+			gw := r.GW
+			if gw == nil {
+				gw = gateway
+			}
+			if err := ip.AddRoute(&r.Dst, gw, conLink); err != nil {
+				return fmt.Errorf("failed to add route %s: %v", r.Dst.String(), err)
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// need to lookup hostVeth again as its index has changed during ns move
 	hostVeth, err := netlink.LinkByName(hostIface.Name)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
+		return nil, nil, fmt.Errorf("failed to lookup %q: %v", hostIface.Name, err)
 	}
 
 	if hostVeth == nil {
-		return fmt.Errorf("nil hostveth")
+		return nil, nil, fmt.Errorf("nil hostveth")
 	}
 
 	// connect host veth end to the bridge
 	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
 	}
 
-	return nil
+	// allow traffic to be reflected back to the pod it came from
+	if hairpinMode {
+		if err := netlink.LinkSetHairpin(hostVeth, true); err != nil {
+			return nil, nil, fmt.Errorf("failed to setup hairpin mode for %q: %v", hostVeth.Attrs().Name, err)
+		}
+	}
+
+	return hostIface, containerIface, nil
+}
+
+// Host side veth name derived from the attachment, so it can be removed without entering the pod netns
+func HostVethName(containerID string, ifName string) string {
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	return "veth" + hex.EncodeToString(sum[:])[:11]
 }
 
 func DelVeth(netns ns.NetNS, ifName string) error {
 	return netns.Do(func(ns.NetNS) error {
-		l, err := netlink.LinkByName(ifName)
-		if os.IsNotExist(err) {
-			return nil
-		}
-		if err != nil {
-			return err
-		}
-		return netlink.LinkDel(l)
+		return delLink(ifName)
 	})
 }
 
-func CheckVeth(netns ns.NetNS, ifName string, ip net.IP) error {
-	return netns.Do(func(ns.NetNS) error {
+// Removes the host side veth of the attachment, succeeds if it is already gone
+func DelHostVeth(containerID string, ifName string) error {
+	return delLink(HostVethName(containerID, ifName))
+}
+
+func delLink(name string) error {
+	l, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkDel(l); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var (
+	ErrAddressMismatch    = errors.New("container address mismatch")
+	ErrRouteMismatch      = errors.New("container default route mismatch")
+	ErrMTUMismatch        = errors.New("mtu mismatch")
+	ErrHostVethMissing    = errors.New("host veth missing")
+	ErrBridgeMismatch     = errors.New("host veth not attached to tenant bridge")
+	ErrVxlanDeviceDown    = errors.New("tenant vxlan device down")
+	ErrVxlanDeviceMissing = errors.New("tenant vxlan device missing")
+)
+
+// Validates the whole pod attachment: container address, default route and MTU, and the host veth
+// enslaved to the tenant bridge. Secondary interfaces have no default route and pass a nil gateway
+func CheckVeth(netns ns.NetNS, containerID string, ifName string, podIP *net.IPNet, gateway net.IP, bridgeName string, mtu int) error {
+	err := netns.Do(func(ns.NetNS) error {
 		l, err := netlink.LinkByName(ifName)
 		if err != nil {
 			return err
 		}
+		if l.Attrs().MTU != mtu {
+			return fmt.Errorf("%w: %s has mtu %d, expected %d", ErrMTUMismatch, ifName, l.Attrs().MTU, mtu)
+		}
 
 		ips, err := netlink.AddrList(l, netlink.FAMILY_V4)
 		if err != nil {
 			return err
 		}
-
+		found := false
 		for _, addr := range ips {
-			if addr.IP.Equal(ip) {
-				return nil
+			if addr.IPNet.String() == podIP.String() {
+				found = true
+				break
 			}
 		}
+		if !found {
+			return fmt.Errorf("%w: failed to find ip %s for %s", ErrAddressMismatch, podIP.String(), ifName)
+		}
 
-		return fmt.Errorf("failed to find ip %s for %s", ip, ifName)
+		if gateway == nil {
+			return nil
+		}
+
+		routes, err := netlink.RouteList(l, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			if (route.Dst == nil || route.Dst.String() == "0.0.0.0/0") && route.Gw.Equal(gateway) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: no default route via %s on %s", ErrRouteMismatch, gateway.String(), ifName)
 	})
-}
\ No newline at end of file
+	if err != nil {
+		return err
+	}
+
+	hostVethName := HostVethName(containerID, ifName)
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrHostVethMissing, hostVethName, err)
+	}
+	if hostVeth.Attrs().MTU != mtu {
+		return fmt.Errorf("%w: %s has mtu %d, expected %d", ErrMTUMismatch, hostVethName, hostVeth.Attrs().MTU, mtu)
+	}
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf("%w: bridge %s: %v", ErrBridgeMismatch, bridgeName, err)
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return fmt.Errorf("%w: %s is not enslaved to %s", ErrBridgeMismatch, hostVethName, bridgeName)
+	}
+	return nil
+}
+
+// Validates the tenant vxlan device is up. Tenants present on a single node have no vxlan device, the device is only
+// required when the tenant has remote nodes.
+func CheckVxlanDevice(vtepName string, remoteNodes bool) error {
+	l, err := netlink.LinkByName(vtepName)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		if remoteNodes {
+			return fmt.Errorf("%w: %s", ErrVxlanDeviceMissing, vtepName)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if l.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%w: %s", ErrVxlanDeviceDown, vtepName)
+	}
+	return nil
+}
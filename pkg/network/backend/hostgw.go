@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"github.com/jovik31/tenant/pkg/network/routing"
+)
+
+// HostGWBackend routes the tenant subnets of the remote nodes to the remote node IPs, without encapsulation.
+// The nodes of the tenant must be on the same L2 segment
+type HostGWBackend struct{}
+
+func (b *HostGWBackend) Type() string {
+	return TypeHostGW
+}
+
+// The tenant bridge is the only device of the tenant, created by the CNI plugin with the first pod
+func (b *HostGWBackend) InitTenant(tenant *Tenant) error {
+	return nil
+}
+
+func (b *HostGWBackend) AddRemoteNode(tenant *Tenant, node *RemoteNode) error {
+	return routing.AddHostRoute(node.CIDR, node.NodeIP)
+}
+
+func (b *HostGWBackend) RemoveRemoteNode(tenant *Tenant, node *RemoteNode) error {
+	return routing.DelHostRoute(node.CIDR, node.NodeIP)
+}
+
+func (b *HostGWBackend) TeardownTenant(tenant *Tenant) error {
+	return delLink(tenant.Bridge)
+}
+
+// The tenant bridge is validated with the pod attachments
+func (b *HostGWBackend) CheckTenant(tenant *Tenant) error {
+	return nil
+}
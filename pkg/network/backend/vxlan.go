@@ -1,11 +1,13 @@
 package backend
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"net"
 	"strings"
 	"syscall"
 	"log"
 
+	"github.com/jovik31/tenant/pkg/network/routing"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
 )
@@ -22,6 +24,17 @@ func NewHardwareAddr() (net.HardwareAddr, error) {
 	return hardwareAddr, nil
 }
 
+// Derives the hardware address from the seed, so the VTEP of a tenant keeps its address across restarts
+func StableHardwareAddr(seed string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(seed))
+	hardwareAddr := net.HardwareAddr(sum[:6])
+
+	// ensure that address is locally administered and unicast
+	hardwareAddr[0] = (hardwareAddr[0] & 0xfe) | 0x02
+
+	return hardwareAddr
+}
+
 func getIfaceAddr(iface *net.Interface) ([]netlink.Addr, error) {
 	return netlink.AddrList(&netlink.Device{
 		LinkAttrs: netlink.LinkAttrs{
@@ -162,4 +175,70 @@ func InitVxlanDevice(podCidr string, vtepName string, vni int, vtepMac string) (
 	}
 
 	return vxlanLink, nil
-}
\ No newline at end of file
+}
+// VxlanBackend carries the tenant traffic between nodes over a vxlan device per tenant, with the arp, fdb and route
+// entries of every remote node of the tenant on the device
+type VxlanBackend struct{}
+
+func (b *VxlanBackend) Type() string {
+	return TypeVxlan
+}
+
+func (b *VxlanBackend) InitTenant(tenant *Tenant) error {
+	_, err := InitVxlanDevice(tenant.CIDR.String(), tenant.VtepName, tenant.VNI, tenant.VtepMac)
+	return err
+}
+
+func (b *VxlanBackend) AddRemoteNode(tenant *Tenant, node *RemoteNode) error {
+
+	//The device is recreated when it is gone, e.g. after a reboot
+	vtepDevice, err := InitVxlanDevice(tenant.CIDR.String(), tenant.VtepName, tenant.VNI, tenant.VtepMac)
+	if err != nil {
+		return err
+	}
+	vtepIndex := vtepDevice.Attrs().Index
+
+	if err := routing.AddARP(vtepIndex, node.VtepIP, node.VtepMac); err != nil {
+		return errors.Wrap(err, "adding arp entry")
+	}
+	if err := routing.AddFDB(vtepIndex, node.NodeIP, node.VtepMac); err != nil {
+		return errors.Wrap(err, "adding fdb entry")
+	}
+	return routing.AddRoutes(vtepIndex, node.CIDR, node.VtepIP)
+}
+
+func (b *VxlanBackend) RemoveRemoteNode(tenant *Tenant, node *RemoteNode) error {
+
+	vtep, err := netlink.LinkByName(tenant.VtepName)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	vtepIndex := vtep.Attrs().Index
+
+	if err := routing.DelRoutes(vtepIndex, node.CIDR, node.VtepIP); err != nil {
+		log.Printf("Error deleting route to %s: %s", node.CIDR.String(), err.Error())
+	}
+	if err := routing.DelARP(vtepIndex, node.VtepIP, node.VtepMac); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return errors.Wrap(err, "deleting arp entry")
+	}
+	if err := routing.DelFDB(vtepIndex, node.NodeIP, node.VtepMac); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return errors.Wrap(err, "deleting fdb entry")
+	}
+	return nil
+}
+
+// Routes through the devices are removed with them
+func (b *VxlanBackend) TeardownTenant(tenant *Tenant) error {
+
+	if err := delLink(tenant.Bridge); err != nil {
+		return err
+	}
+	return delLink(tenant.VtepName)
+}
+
+func (b *VxlanBackend) CheckTenant(tenant *Tenant) error {
+	return CheckVxlanDevice(tenant.VtepName, len(tenant.RemoteNodes) > 0)
+}
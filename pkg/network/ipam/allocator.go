@@ -0,0 +1,275 @@
+package ipam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"net/netip"
+)
+
+// Strategy selects which free address of the tenant pool is handed out next
+type Strategy string
+
+const (
+	//Next free address after the last allocated one, wrapping around the pool
+	StrategySequential Strategy = "sequential"
+	//Free address found from a random position of the pool
+	StrategyRandom Strategy = "random"
+	//Lowest free address of the pool
+	StrategyLowestFree Strategy = "lowest-free"
+)
+
+var (
+	ErrNoFreeIP        = errors.New("no more available IPs")
+	ErrUnknownStrategy = errors.New("unknown allocation strategy")
+)
+
+// Returns the strategy named by the configuration, an empty name is the sequential strategy
+func ParseStrategy(name string) (Strategy, error) {
+
+	switch Strategy(name) {
+	case "", StrategySequential:
+		return StrategySequential, nil
+	case StrategyRandom, StrategyLowestFree:
+		return Strategy(name), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownStrategy, name)
+}
+
+// Allocator tracks the used addresses of a tenant CIDR in a bitmap, one bit per address, and indexes
+// the allocated addresses by container ID.
+// A second level bitmap flags the words of the first level that are full, so a free address is found
+// skipping 4096 used addresses per summary word. Only the search is constant time, the tenant store
+// holding the allocations is persisted whole.
+type Allocator struct {
+	base  uint32
+	size  uint32
+	words []uint64
+	full  []uint64
+	used  uint32
+	ids   map[string]netip.Addr
+}
+
+// Creates an empty allocator for the IPv4 prefix, an invalid prefix gives an allocator without addresses
+func NewAllocator(prefix netip.Prefix) (*Allocator, error) {
+
+	a := &Allocator{
+		ids: make(map[string]netip.Addr),
+	}
+	if !prefix.IsValid() {
+		return a, nil
+	}
+	if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("only IPv4 tenant CIDRs are supported: %s", prefix.String())
+	}
+
+	prefix = prefix.Masked()
+	a.base = addrToUint32(prefix.Addr())
+	a.size = uint32(1) << (32 - prefix.Bits())
+	nwords := (a.size + 63) / 64
+	a.words = make([]uint64, nwords)
+	a.full = make([]uint64, (nwords+63)/64)
+
+	//Bits past the end of the pool are permanently used, so full words and summary words stay consistent
+	if rest := a.size % 64; rest != 0 {
+		a.words[nwords-1] = ^uint64(0) << rest
+	}
+	for w := nwords; w < uint32(len(a.full))*64; w++ {
+		a.full[w/64] |= 1 << (w % 64)
+	}
+	return a, nil
+}
+
+// Marks the address as used without an owner, for the network, gateway and broadcast addresses
+func (a *Allocator) Reserve(addr netip.Addr) error {
+
+	off, ok := a.offset(addr)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrIPOutOfRange, addr.String())
+	}
+	if a.isSet(off) {
+		return fmt.Errorf("%w: %s", ErrIPInUse, addr.String())
+	}
+	a.set(off)
+	return nil
+}
+
+// Frees an address marked by Reserve, addresses allocated to a container are left untouched
+func (a *Allocator) Unreserve(addr netip.Addr) {
+
+	off, ok := a.offset(addr)
+	if !ok {
+		return
+	}
+	for _, used := range a.ids {
+		if used == addr {
+			return
+		}
+	}
+	a.clear(off)
+}
+
+// Marks the address as used by the container. Addresses outside the pool are only indexed
+func (a *Allocator) Mark(addr netip.Addr, id string) error {
+
+	if off, ok := a.offset(addr); ok {
+		if a.isSet(off) {
+			return fmt.Errorf("%w: %s", ErrIPInUse, addr.String())
+		}
+		a.set(off)
+	}
+	a.ids[id] = addr
+	return nil
+}
+
+// Returns a free address picked by the strategy without marking it.
+// The sequential strategy continues after last, the previously allocated address
+func (a *Allocator) Next(strategy Strategy, last netip.Addr) (netip.Addr, error) {
+
+	if a.used >= a.size {
+		return netip.Addr{}, ErrNoFreeIP
+	}
+
+	var start uint32
+	switch strategy {
+	case "", StrategySequential:
+		if off, ok := a.offset(last); ok {
+			start = off + 1
+		}
+	case StrategyRandom:
+		start = rand.Uint32N(a.size)
+	case StrategyLowestFree:
+		start = 0
+	default:
+		return netip.Addr{}, fmt.Errorf("%w: %q", ErrUnknownStrategy, strategy)
+	}
+	if start >= a.size {
+		start = 0
+	}
+
+	off, ok := a.scan(start, a.size)
+	if !ok {
+		off, ok = a.scan(0, start)
+	}
+	if !ok {
+		return netip.Addr{}, ErrNoFreeIP
+	}
+	return uint32ToAddr(a.base + off), nil
+}
+
+// Frees the address of the container, returns the released address
+func (a *Allocator) Release(id string) (netip.Addr, bool) {
+
+	addr, ok := a.ids[id]
+	if !ok {
+		return netip.Addr{}, false
+	}
+	delete(a.ids, id)
+	if off, ok := a.offset(addr); ok {
+		a.clear(off)
+	}
+	return addr, true
+}
+
+// Returns the address allocated to the container
+func (a *Allocator) Lookup(id string) (netip.Addr, bool) {
+
+	addr, ok := a.ids[id]
+	return addr, ok
+}
+
+// Reports if the address is used, either reserved or allocated
+func (a *Allocator) Contains(addr netip.Addr) bool {
+
+	off, ok := a.offset(addr)
+	if !ok {
+		for _, used := range a.ids {
+			if used == addr {
+				return true
+			}
+		}
+		return false
+	}
+	return a.isSet(off)
+}
+
+// Number of free addresses in the pool
+func (a *Allocator) Free() int {
+	return int(a.size - a.used)
+}
+
+// Returns the first free offset in [from, to)
+func (a *Allocator) scan(from uint32, to uint32) (uint32, bool) {
+
+	w := from / 64
+	for w*64 < to {
+		if a.full[w/64]&(1<<(w%64)) != 0 {
+			//Jump to the next word with a free address flagged by the summary word
+			free := ^a.full[w/64] >> (w % 64)
+			if free == 0 {
+				w = (w/64 + 1) * 64
+			} else {
+				w += uint32(bits.TrailingZeros64(free))
+			}
+			continue
+		}
+
+		free := ^a.words[w]
+		if w == from/64 {
+			free &= ^uint64(0) << (from % 64)
+		}
+		if free != 0 {
+			off := w*64 + uint32(bits.TrailingZeros64(free))
+			return off, off < to
+		}
+		w++
+	}
+	return 0, false
+}
+
+func (a *Allocator) offset(addr netip.Addr) (uint32, bool) {
+
+	if !addr.Is4() || a.size == 0 {
+		return 0, false
+	}
+	off := addrToUint32(addr) - a.base
+	return off, addrToUint32(addr) >= a.base && off < a.size
+}
+
+func (a *Allocator) isSet(off uint32) bool {
+	return a.words[off/64]&(1<<(off%64)) != 0
+}
+
+func (a *Allocator) set(off uint32) {
+
+	w := off / 64
+	a.words[w] |= 1 << (off % 64)
+	if a.words[w] == ^uint64(0) {
+		a.full[w/64] |= 1 << (w % 64)
+	}
+	a.used++
+}
+
+func (a *Allocator) clear(off uint32) {
+
+	if !a.isSet(off) {
+		return
+	}
+	w := off / 64
+	a.words[w] &^= 1 << (off % 64)
+	a.full[w/64] &^= 1 << (w % 64)
+	a.used--
+}
+
+func addrToUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func uint32ToAddr(v uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b)
+}
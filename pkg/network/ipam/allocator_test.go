@@ -0,0 +1,302 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func newTestAllocator(t testing.TB, cidr string) *Allocator {
+
+	t.Helper()
+	a, err := NewAllocator(netip.MustParsePrefix(cidr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Marks the addresses [from, to) of the pool as used by containers c<offset>
+func markRange(t testing.TB, a *Allocator, from uint32, to uint32) {
+
+	t.Helper()
+	for off := from; off < to; off++ {
+		if err := a.Mark(uint32ToAddr(a.base+off), fmt.Sprintf("c%d", off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAllocatorSummaryBitmap(t *testing.T) {
+
+	a := newTestAllocator(t, "10.0.0.0/16")
+
+	//The first 10 words are full, the summary flags them and the scan skips to word 10
+	markRange(t, a, 0, 640)
+	if got := a.full[0] & (1<<10 - 1); got != 1<<10-1 {
+		t.Fatalf("summary word %b, expected the first 10 words flagged full", a.full[0])
+	}
+	next, err := a.Next(StrategyLowestFree, netip.Addr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("10.0.2.128"); next != want {
+		t.Fatalf("next %s, expected %s", next, want)
+	}
+
+	//Releasing an address of a full word clears its summary bit
+	if _, ok := a.Release("c130"); !ok {
+		t.Fatal("c130 not released")
+	}
+	if a.full[0]&(1<<2) != 0 {
+		t.Fatal("summary bit of word 2 still set after release")
+	}
+	next, err = a.Next(StrategyLowestFree, netip.Addr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("10.0.0.130"); next != want {
+		t.Fatalf("next %s, expected %s", next, want)
+	}
+
+	//A full pool flags every summary word
+	a = newTestAllocator(t, "10.0.0.0/20")
+	markRange(t, a, 0, a.size)
+	for i, word := range a.full {
+		if word != ^uint64(0) {
+			t.Fatalf("summary word %d is %b on a full pool", i, word)
+		}
+	}
+	if _, err := a.Next(StrategyLowestFree, netip.Addr{}); !errors.Is(err, ErrNoFreeIP) {
+		t.Fatalf("expected ErrNoFreeIP on a full pool, got %v", err)
+	}
+}
+
+func TestAllocatorPartialWord(t *testing.T) {
+
+	//A /29 uses 8 bits of its only word, the rest of the word counts as used
+	a := newTestAllocator(t, "10.0.0.0/29")
+	if a.Free() != 8 {
+		t.Fatalf("free %d, expected 8", a.Free())
+	}
+	markRange(t, a, 0, 8)
+	if a.Free() != 0 {
+		t.Fatalf("free %d, expected 0", a.Free())
+	}
+	if a.full[0]&1 == 0 {
+		t.Fatal("partial word not flagged full")
+	}
+	if _, err := a.Next(StrategySequential, netip.Addr{}); !errors.Is(err, ErrNoFreeIP) {
+		t.Fatalf("expected ErrNoFreeIP, got %v", err)
+	}
+}
+
+func TestAllocatorSequentialWraparound(t *testing.T) {
+
+	a := newTestAllocator(t, "10.0.0.0/24")
+	a.Reserve(netip.MustParseAddr("10.0.0.0"))
+	a.Reserve(netip.MustParseAddr("10.0.0.255"))
+	markRange(t, a, 1, 4)
+	markRange(t, a, 250, 255)
+
+	//The pool has no free address after the last one, the scan wraps around to the start
+	next, err := a.Next(StrategySequential, netip.MustParseAddr("10.0.0.254"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("10.0.0.4"); next != want {
+		t.Fatalf("next %s, expected %s", next, want)
+	}
+
+	//The broadcast address as last wraps around as well
+	next, err = a.Next(StrategySequential, netip.MustParseAddr("10.0.0.255"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("10.0.0.4"); next != want {
+		t.Fatalf("next %s, expected %s", next, want)
+	}
+}
+
+func TestAllocatorReserveUnreserve(t *testing.T) {
+
+	a := newTestAllocator(t, "10.0.0.0/24")
+	gateway := netip.MustParseAddr("10.0.0.1")
+
+	if err := a.Reserve(gateway); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reserve(gateway); !errors.Is(err, ErrIPInUse) {
+		t.Fatalf("expected ErrIPInUse reserving twice, got %v", err)
+	}
+	if err := a.Reserve(netip.MustParseAddr("10.0.1.1")); !errors.Is(err, ErrIPOutOfRange) {
+		t.Fatalf("expected ErrIPOutOfRange, got %v", err)
+	}
+	if !a.Contains(gateway) || a.Free() != 255 {
+		t.Fatalf("gateway not reserved, free %d", a.Free())
+	}
+
+	a.Unreserve(gateway)
+	if a.Contains(gateway) || a.Free() != 256 {
+		t.Fatalf("gateway still reserved, free %d", a.Free())
+	}
+
+	//Unreserve leaves the addresses allocated to a container in use
+	pod := netip.MustParseAddr("10.0.0.10")
+	if err := a.Mark(pod, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	a.Unreserve(pod)
+	if !a.Contains(pod) {
+		t.Fatal("allocated address freed by Unreserve")
+	}
+	if addr, ok := a.Lookup("c1"); !ok || addr != pod {
+		t.Fatalf("lookup c1 %s %v", addr, ok)
+	}
+}
+
+func TestAllocatorStrategies(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		strategy Strategy
+		last     string
+		want     string
+	}{
+		{name: "sequential after last", strategy: StrategySequential, last: "10.0.0.20", want: "10.0.0.21"},
+		{name: "sequential without last", strategy: StrategySequential, want: "10.0.0.5"},
+		{name: "empty is sequential", strategy: "", last: "10.0.0.20", want: "10.0.0.21"},
+		{name: "lowest free ignores last", strategy: StrategyLowestFree, last: "10.0.0.20", want: "10.0.0.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			a := newTestAllocator(t, "10.0.0.0/24")
+			markRange(t, a, 0, 5)
+			markRange(t, a, 6, 21)
+			var last netip.Addr
+			if tt.last != "" {
+				last = netip.MustParseAddr(tt.last)
+			}
+			next, err := a.Next(tt.strategy, last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next.String() != tt.want {
+				t.Fatalf("next %s, expected %s", next, tt.want)
+			}
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+
+		a := newTestAllocator(t, "10.0.0.0/24")
+		markRange(t, a, 0, 250)
+		for i := 0; i < 100; i++ {
+			next, err := a.Next(StrategyRandom, netip.Addr{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Contains(next) {
+				t.Fatalf("random strategy returned used address %s", next)
+			}
+		}
+		markRange(t, a, 250, 256)
+		if _, err := a.Next(StrategyRandom, netip.Addr{}); !errors.Is(err, ErrNoFreeIP) {
+			t.Fatalf("expected ErrNoFreeIP, got %v", err)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+
+		a := newTestAllocator(t, "10.0.0.0/24")
+		if _, err := a.Next("first-fit", netip.Addr{}); !errors.Is(err, ErrUnknownStrategy) {
+			t.Fatalf("expected ErrUnknownStrategy, got %v", err)
+		}
+	})
+}
+
+// Picking an address in memory does not depend on the addresses already used
+func BenchmarkAllocatorNext(b *testing.B) {
+
+	for _, used := range []uint32{0, 16384, 65000} {
+		b.Run(fmt.Sprintf("/16-used-%d", used), func(b *testing.B) {
+
+			a := newTestAllocator(b, "10.0.0.0/16")
+			markRange(b, a, 0, used)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				addr, err := a.Next(StrategyLowestFree, netip.Addr{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				a.Mark(addr, "bench")
+				a.Release("bench")
+			}
+		})
+	}
+}
+
+// Tenant store of a /16 with the first used addresses allocated to containers
+func benchTenantStore(b *testing.B, storage Storage, used int) *TenantIPAM {
+
+	b.Helper()
+	store, err := NewTenantStore(storage, "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	store.Data = &TenantData{
+		TenantName:   "bench",
+		TenantPrefix: 16,
+		TenantCIDR:   "10.0.0.0/16",
+		Bridge:       &Bridge{Name: "bench", Gateway: netip.MustParseAddr("10.0.0.1")},
+		IPs:          make(map[string]ContainerNetInfo),
+	}
+	for off := 2; off < used+2; off++ {
+		id := fmt.Sprintf("c%d", off)
+		store.Data.IPs[uint32ToAddr(0x0a000000+uint32(off)).String()] = ContainerNetInfo{ID: id, IFname: "eth0"}
+	}
+	if err := store.StoreTenantData(); err != nil {
+		b.Fatal(err)
+	}
+	tim, err := NewTenantIPAM(store, "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return tim
+}
+
+// ADD and DEL of one container through the tenant store. The store is loaded and written whole on every call, so
+// the cost grows with the IPs allocated in the tenant while the allocator itself stays constant
+func BenchmarkAllocateIP(b *testing.B) {
+
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, used := range []int{0, 1000, 10000} {
+		for _, backend := range []string{StorageFile, "memory"} {
+			b.Run(fmt.Sprintf("%s/16-used-%d", backend, used), func(b *testing.B) {
+
+				var storage Storage = NewMemoryStorage()
+				if backend == StorageFile {
+					storage = NewFileStorage(b.TempDir())
+				}
+				tim := benchTenantStore(b, storage, used)
+				info := ContainerNetInfo{ID: "bench", IFname: "eth0"}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := tim.AllocateIP(info); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := tim.ReleaseIP(info.ID); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
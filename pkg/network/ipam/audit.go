@@ -0,0 +1,240 @@
+package ipam
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+const (
+	AuditAllocateIP     = "allocate-ip"
+	AuditReleaseIP      = "release-ip"
+	AuditAllocateSubnet = "allocate-subnet"
+	AuditReleaseSubnet  = "release-subnet"
+
+	DefaultAuditMaxSize  = 10 << 20
+	DefaultAuditMaxFiles = 5
+)
+
+// Entry of the audit log, one JSON line per IP or subnet change
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Node        string    `json:"node,omitempty"`
+	Tenant      string    `json:"tenant"`
+	IP          string    `json:"ip,omitempty"`
+	CIDR        string    `json:"cidr,omitempty"`
+	ContainerID string    `json:"containerID,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	UID         string    `json:"uid,omitempty"`
+	//Why an IP was released other than by a CNI DEL, e.g. a forced tenant removal
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditLog appends the IP and subnet changes of the node to a JSON lines file shared by the daemon and the plugin.
+// The file is rotated to <file>.1 ... <file>.<MaxFiles> once it grows past MaxSize, under a lock held by the writer.
+type AuditLog struct {
+	File     string
+	Node     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+func NewAuditLog(file string, nodeName string) *AuditLog {
+	return &AuditLog{
+		File:     file,
+		Node:     nodeName,
+		MaxSize:  DefaultAuditMaxSize,
+		MaxFiles: DefaultAuditMaxFiles,
+	}
+}
+
+// Appends the event, stamped with the time and node when unset. A nil audit log records nothing
+func (l *AuditLog) Record(event AuditEvent) error {
+
+	if l == nil || l.File == "" {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Node == "" {
+		event.Node = l.Node
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(l.File), 0755); err != nil {
+		return err
+	}
+	lock, err := filemutex.New(l.File + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err := l.rotate(int64(len(line))); err != nil {
+		log.Printf("Error rotating audit log %s: %s", l.File, err.Error())
+	}
+	f, err := os.OpenFile(l.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Records the event and logs the failure, an allocation is never failed by its audit entry
+func (l *AuditLog) record(event AuditEvent) {
+
+	if err := l.Record(event); err != nil {
+		log.Printf("Error writing audit log: %s", err.Error())
+	}
+}
+
+// Shifts the rotated files by one and moves the current file to <file>.1 when the line does not fit
+func (l *AuditLog) rotate(next int64) error {
+
+	fi, err := os.Stat(l.File)
+	if err != nil || l.MaxSize <= 0 || fi.Size()+next <= l.MaxSize {
+		return nil
+	}
+	maxFiles := max(l.MaxFiles, 1)
+	if err := os.Remove(rotatedAuditFile(l.File, maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedAuditFile(l.File, i), rotatedAuditFile(l.File, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.File, rotatedAuditFile(l.File, 1))
+}
+
+func rotatedAuditFile(file string, i int) string {
+	return fmt.Sprintf("%s.%d", file, i)
+}
+
+func auditIP(action string, tenant string, ip string, info ContainerNetInfo) AuditEvent {
+	return AuditEvent{
+		Action:      action,
+		Tenant:      tenant,
+		IP:          ip,
+		ContainerID: info.ID,
+		Namespace:   info.Namespace,
+		Name:        info.Name,
+		UID:         info.UID,
+	}
+}
+
+// Reads the events of the audit log and of its rotated files, oldest first. Lines that cannot be parsed are skipped
+func ReadAuditLog(file string) ([]AuditEvent, error) {
+
+	files, err := filepath.Glob(file + ".*")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, file)
+
+	events := []AuditEvent{}
+	found := false
+	for _, name := range files {
+		if filepath.Ext(name) == ".lock" {
+			continue
+		}
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			event := AuditEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				log.Printf("Skipping line %d of %s: %s", line, name, err.Error())
+				continue
+			}
+			events = append(events, event)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no audit log at %s", file)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
+}
+
+// Owners of the IPs and subnets of a node at a point in time, the allocation event of each IP and subnet in use
+type AuditState struct {
+	//Allocations keyed by tenant/ip
+	IPs map[string]AuditEvent
+	//Allocations keyed by tenant
+	Subnets map[string]AuditEvent
+	//Time of the oldest event, the state before it is not known
+	Since time.Time
+}
+
+// Replays the events up to the time at to rebuild which container held each IP and which subnet each tenant held
+func ReplayAudit(events []AuditEvent, at time.Time) *AuditState {
+
+	state := &AuditState{
+		IPs:     make(map[string]AuditEvent),
+		Subnets: make(map[string]AuditEvent),
+	}
+	for _, event := range events {
+		if event.Time.After(at) {
+			break
+		}
+		if state.Since.IsZero() {
+			state.Since = event.Time
+		}
+		key := event.Tenant + "/" + event.IP
+		switch event.Action {
+		case AuditAllocateIP:
+			state.IPs[key] = event
+		case AuditReleaseIP:
+			delete(state.IPs, key)
+		case AuditAllocateSubnet:
+			state.Subnets[event.Tenant] = event
+		case AuditReleaseSubnet:
+			delete(state.Subnets, event.Tenant)
+			//IPs left in a removed tenant are gone with it
+			for ipKey, allocation := range state.IPs {
+				if allocation.Tenant == event.Tenant {
+					delete(state.IPs, ipKey)
+				}
+			}
+		}
+	}
+	return state
+}
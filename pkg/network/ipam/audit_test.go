@@ -0,0 +1,117 @@
+package ipam
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var auditStart = time.Date(2024, 5, 2, 14, 0, 0, 0, time.UTC)
+
+// Allocation of 10.244.0.1<i> in tenant1 at auditStart plus i seconds, every event encodes to a line of the same size
+func testAuditEvent(i int) AuditEvent {
+	return AuditEvent{
+		Time:        auditStart.Add(time.Duration(i) * time.Second),
+		Action:      AuditAllocateIP,
+		Tenant:      "tenant1",
+		IP:          "10.244.0.1" + strconv.Itoa(i),
+		ContainerID: "c" + strconv.Itoa(i),
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "audit.log")
+	auditLog := NewAuditLog(file, "node1")
+	line, err := json.Marshal(AuditEvent{Node: "node1", Time: auditStart, Action: AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.10", ContainerID: "c0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Two lines per file, the current file and two rotated ones
+	auditLog.MaxSize = int64(len(line)+1) * 2
+	auditLog.MaxFiles = 2
+
+	for i := 1; i <= 7; i++ {
+		if err := auditLog.Record(testAuditEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, wantLines := range map[string]int{file: 1, file + ".1": 2, file + ".2": 2} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(line)+1)*int64(wantLines) {
+			t.Fatalf("%s holds %d bytes, expected %d lines", name, fi.Size(), wantLines)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("rotated past MaxFiles: %v", err)
+	}
+
+	//Events 1 and 2 were in the rotated file dropped by the last rotation
+	events, err := ReadAuditLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("read %d events, expected 5", len(events))
+	}
+	for i, event := range events {
+		want := testAuditEvent(i + 3)
+		if event.IP != want.IP || !event.Time.Equal(want.Time) || event.Node != "node1" {
+			t.Fatalf("event %d is %+v, expected %+v", i, event, want)
+		}
+	}
+}
+
+func TestReplayAudit(t *testing.T) {
+
+	at := func(second int) time.Time { return auditStart.Add(time.Duration(second) * time.Second) }
+	events := []AuditEvent{
+		{Time: at(0), Action: AuditAllocateSubnet, Tenant: "tenant1", CIDR: "10.244.0.0/24"},
+		{Time: at(1), Action: AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.2", ContainerID: "c1"},
+		{Time: at(2), Action: AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.3", ContainerID: "c2"},
+		{Time: at(3), Action: AuditReleaseIP, Tenant: "tenant1", IP: "10.244.0.2", ContainerID: "c1"},
+		{Time: at(4), Action: AuditAllocateIP, Tenant: "tenant1", IP: "10.244.0.2", ContainerID: "c3"},
+		{Time: at(5), Action: AuditReleaseSubnet, Tenant: "tenant1", CIDR: "10.244.0.0/24"},
+	}
+
+	tests := []struct {
+		name       string
+		at         time.Time
+		wantOwners map[string]string
+		wantSubnet bool
+	}{
+		{name: "before the log", at: at(-1), wantOwners: map[string]string{}},
+		{name: "first allocation", at: at(1), wantOwners: map[string]string{"10.244.0.2": "c1"}, wantSubnet: true},
+		{name: "between allocations", at: at(2).Add(500 * time.Millisecond), wantOwners: map[string]string{"10.244.0.2": "c1", "10.244.0.3": "c2"}, wantSubnet: true},
+		{name: "after the release", at: at(3), wantOwners: map[string]string{"10.244.0.3": "c2"}, wantSubnet: true},
+		{name: "IP reused", at: at(4), wantOwners: map[string]string{"10.244.0.2": "c3", "10.244.0.3": "c2"}, wantSubnet: true},
+		{name: "tenant removed", at: at(6), wantOwners: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			state := ReplayAudit(events, tt.at)
+			if len(state.IPs) != len(tt.wantOwners) {
+				t.Fatalf("owners %v, expected %v", state.IPs, tt.wantOwners)
+			}
+			for ip, id := range tt.wantOwners {
+				if got := state.IPs["tenant1/"+ip].ContainerID; got != id {
+					t.Fatalf("%s owned by %q, expected %s", ip, got, id)
+				}
+			}
+			if _, ok := state.Subnets["tenant1"]; ok != tt.wantSubnet {
+				t.Fatalf("tenant1 subnet held %v, expected %v", ok, tt.wantSubnet)
+			}
+			if tt.at.Before(at(0)) != state.Since.IsZero() {
+				t.Fatalf("replay since %s", state.Since)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+)
+
+var (
+	ErrInvalidClusterCIDR = errors.New("invalid tenant cluster CIDR")
+	ErrSubnetOverlap      = errors.New("tenant subnet overlaps a subnet in use on the node")
+)
+
+// Picks the block of the tenant cluster CIDR for a node out of the blocks not claimed by the other nodes of the
+// tenant, with the same best fit as the node subnets. The claimed blocks are recorded on the tenant resource.
+func ClusterBlock(clusterCIDR string, prefix int, claimed []string) (netip.Prefix, error) {
+
+	cluster, err := netip.ParsePrefix(clusterCIDR)
+	if err != nil || !cluster.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("%w: %q", ErrInvalidClusterCIDR, clusterCIDR)
+	}
+	cluster = cluster.Masked()
+	if prefix == 0 {
+		prefix = DefaultTenantPrefix
+	}
+	if prefix > maxTenantPrefix || prefix < cluster.Bits() {
+		return netip.Prefix{}, fmt.Errorf("%w: /%d in cluster CIDR %s", ErrInvalidTenantPrefix, prefix, cluster.String())
+	}
+
+	free := []netip.Prefix{cluster}
+	for _, block := range parseSubnets(claimed) {
+		if !cluster.Contains(block.Addr()) || block.Bits() < cluster.Bits() {
+			log.Printf("Skipping block %s claimed outside of cluster CIDR %s", block.String(), cluster.String())
+			continue
+		}
+		free = reserveSubnet(free, block)
+	}
+
+	block, _, err := allocateSubnet(free, prefix)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("cluster CIDR %s: %w", cluster.String(), err)
+	}
+	return block, nil
+}
+
+// Removes the subnet from the free blocks, splitting the free block holding it
+func reserveSubnet(free []netip.Prefix, subnet netip.Prefix) []netip.Prefix {
+
+	i := slices.IndexFunc(free, func(block netip.Prefix) bool {
+		return block.Bits() <= subnet.Bits() && block.Contains(subnet.Addr())
+	})
+	if i < 0 {
+		return free
+	}
+	block := free[i]
+	free = slices.Delete(slices.Clone(free), i, i+1)
+	for block.Bits() < subnet.Bits() {
+		lower, upper := splitSubnet(block)
+		if lower.Contains(subnet.Addr()) {
+			free = append(free, upper)
+			block = lower
+		} else {
+			free = append(free, lower)
+			block = upper
+		}
+	}
+	sortSubnets(free)
+	return free
+}
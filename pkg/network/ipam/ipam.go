@@ -6,16 +6,20 @@ import (
 	"log"
 	"net"
 	"net/netip"
+	"slices"
 
 	//"golang.org/x/exp/maps"
 
-	cip "github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/jovik31/tenant/pkg/network/backend"
 	"github.com/seancfoley/ipaddress-go/ipaddr"
 )
 
 var (
-	ErrIPOverflow = errors.New(" ip overflow")
+	ErrIPOverflow   = errors.New(" ip overflow")
+	ErrIPInUse      = errors.New("ip already in use")
+	ErrIPOutOfRange = errors.New("ip outside of tenant range")
+	ErrTenantInUse  = errors.New("tenant has IPs allocated")
 )
 
 func NewNodeIPAM(store *NodeStore, nodeName string) (*NodeIPAM, error) {
@@ -57,82 +61,259 @@ func ListSubnets(original string, newPrefix int) []string {
 	return subnetList
 }
 
-// Check if it is possible to create a tenantStore outside and pass it to the function only updating the tenantCIDR
-func (nim *NodeIPAM) AllocateTenant(tenantName string, tenantVNI int, tenantPrefix int) error {
-	nim.NodeStore.Lock()
-	defer nim.NodeStore.Unlock()
-
-	if err := nim.NodeStore.LoadNodeData(); err != nil {
+// Records the node IP and CIDR in the node store. The available subnets are rebuilt from the node CIDR minus the
+// subnets held by the tenants already on the node, so restarts keep the tenant allocations
+func (nim *NodeIPAM) InitNode(nodeIP string, nodeCIDR string) error {
 
+	txn, err := Begin(nim.NodeStore.Storage, nim.NodeStore.Key)
+	if err != nil {
 		return err
 	}
+	defer txn.Rollback()
 
-	availableList := nim.NodeStore.Data.AvailableList
-	if len(availableList) <= 0 {
-		log.Println("No more available subnets for tenants in this node")
-		return nil
+	nodeData := &NodeData{}
+	if err := txn.Load(nim.NodeStore.Key, nodeData); err != nil {
+		return err
 	}
+	if nodeData.TenantList == nil {
+		nodeData.TenantList = make(map[string]netip.Prefix)
+	}
+	if nodeData.NodeCIDR != "" && nodeData.NodeCIDR != nodeCIDR {
+		log.Printf("Node CIDR changed from %s to %s, tenants keep their subnets", nodeData.NodeCIDR, nodeCIDR)
+	}
+	nodeData.NodeIP = nodeIP
+	nodeData.NodeCIDR = nodeCIDR
 
-	tenantCIDR, err := netip.ParsePrefix(availableList[0])
+	prefix, err := netip.ParsePrefix(nodeCIDR)
 	if err != nil {
+		return fmt.Errorf("invalid node CIDR %q: %w", nodeCIDR, err)
+	}
+	free := []netip.Prefix{prefix.Masked()}
+	for tenantName, subnet := range nodeData.TenantList {
+		if !prefix.Contains(subnet.Addr()) {
+			continue
+		}
+		log.Printf("Tenant %s holds %s", tenantName, subnet.String())
+		free = reserveSubnet(free, subnet)
+	}
+	nodeData.AvailableList = formatSubnets(free)
 
-		log.Printf("Failed parsing tenant CIDR prefix from available list")
+	if err := txn.Store(nim.NodeStore.Key, nodeData); err != nil {
+		return err
 	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	nim.NodeStore.Data = nodeData
+	return nil
+}
+
+// Takes the next available subnet for the tenant and creates the tenant store, the node and tenant stores are
+// updated in a single transaction
+func (nim *NodeIPAM) AllocateTenant(tenantName string, tenantVNI int, tenantPrefix int) error {
+	return nim.allocateTenant(tenantName, tenantVNI, tenantPrefix, "", netip.Prefix{})
+}
+
+// Creates the tenant store with the block of the tenant cluster CIDR claimed by the node, the free subnets of the
+// node CIDR are left untouched
+func (nim *NodeIPAM) AllocateTenantBlock(tenantName string, tenantVNI int, clusterCIDR string, block netip.Prefix) error {
+	return nim.allocateTenant(tenantName, tenantVNI, block.Bits(), clusterCIDR, block.Masked())
+}
 
-	//Update values for available subnet slice and for tenants map
-	nim.NodeStore.Data.AvailableList = availableList[1:]
-	nim.NodeStore.Data.TenantList[tenantName] = tenantCIDR
-	nim.NodeStore.StoreNodeData()
+func (nim *NodeIPAM) allocateTenant(tenantName string, tenantVNI int, tenantPrefix int, clusterCIDR string, block netip.Prefix) error {
 
-	tenantStore, err := NewTenantStore(defaultStoreDir, tenantName)
+	txn, err := Begin(nim.NodeStore.Storage, nim.NodeStore.Key, tenantName)
 	if err != nil {
-		log.Printf("Failed to create a tenant Store")
+		return err
 	}
+	defer txn.Rollback()
 
-	tenantStore.Data.TenantName = tenantName
-	tenantStore.Data.TenantPrefix = tenantPrefix
-	tenantStore.Data.TenantCIDR = tenantCIDR.String()
+	nodeData := &NodeData{}
+	if err := txn.Load(nim.NodeStore.Key, nodeData); err != nil {
+		return err
+	}
+	if nodeData.TenantList == nil {
+		nodeData.TenantList = make(map[string]netip.Prefix)
+	}
 
-	//Generate a new bridge name for the tenant
-	tenantStore.Data.Bridge = &Bridge{
-		Name:    "br-" + tenantName,
-		Gateway: tenantCIDR.Addr().Next(),
+	//Repeated allocations, e.g. the tenant add events replayed on restart, keep the stored tenant
+	existing := &TenantData{}
+	if err := txn.Load(tenantName, existing); err != nil {
+		return err
+	}
+	if _, ok := nodeData.TenantList[tenantName]; ok && existing.TenantName != "" {
+		log.Printf("Tenant %s already allocated %s on the node", tenantName, existing.TenantCIDR)
+		nim.NodeStore.Data = nodeData
+		return nil
 	}
-	log.Printf("Bridge name: %s and IP: %s", tenantStore.Data.Bridge.Name, tenantStore.Data.Bridge.Gateway.String())
-	tenantStore.Data.Last = tenantStore.Data.Bridge.Gateway.String()
 
-	if len(tenantStore.Data.Bridge.Name) >= 13 {
-		log.Printf("Bridge name too long: %s", tenantStore.Data.Bridge.Name)
-		tenantStore.Data.Bridge.Name = "br-default"
+	if tenantPrefix == 0 {
+		tenantPrefix = DefaultTenantPrefix
+	}
+	nodeCIDR, _ := netip.ParsePrefix(nodeData.NodeCIDR)
+	if block.IsValid() {
+		//Blocks are carved out of the tenant cluster CIDR, the node CIDR does not bound their prefix
+		cluster, err := netip.ParsePrefix(clusterCIDR)
+		if err != nil || !cluster.Masked().Contains(block.Addr()) {
+			return fmt.Errorf("%w: %q does not hold %s", ErrInvalidClusterCIDR, clusterCIDR, block.String())
+		}
+		if tenantPrefix > maxTenantPrefix || tenantPrefix < cluster.Bits() {
+			return fmt.Errorf("%w: /%d in cluster CIDR %s", ErrInvalidTenantPrefix, tenantPrefix, clusterCIDR)
+		}
+	} else if tenantPrefix > maxTenantPrefix || (nodeCIDR.IsValid() && tenantPrefix < nodeCIDR.Bits()) {
+		return fmt.Errorf("%w: /%d in node CIDR %s", ErrInvalidTenantPrefix, tenantPrefix, nodeData.NodeCIDR)
 	}
 
-	//Generate a new hardware address for the Vxlan device
-	macAddress, err := backend.NewHardwareAddr()
-	if err != nil {
-		log.Println("Failed to generate a new hardware address")
+	tenantCIDR := block
+	if tenantCIDR.IsValid() {
+		//Blocks of a tenant cluster CIDR live outside of the node CIDR and must not overlap the other tenants
+		if nodeCIDR.IsValid() && nodeCIDR.Overlaps(tenantCIDR) {
+			return fmt.Errorf("%w: %s in node CIDR %s", ErrSubnetOverlap, tenantCIDR.String(), nodeCIDR.String())
+		}
+		for name, subnet := range nodeData.TenantList {
+			if name != tenantName && subnet.Overlaps(tenantCIDR) {
+				return fmt.Errorf("%w: %s of tenant %s", ErrSubnetOverlap, tenantCIDR.String(), name)
+			}
+		}
+		log.Printf("Tenant %s allocated %s of cluster CIDR %s", tenantName, tenantCIDR.String(), clusterCIDR)
+	} else {
+		//Best fit subnet of the tenant prefix out of the free blocks of the node
+		free := mergeSubnets(parseSubnets(nodeData.AvailableList), nodeCIDR)
+		tenantCIDR, free, err = allocateSubnet(free, tenantPrefix)
+		if err != nil {
+			log.Printf("No more available subnets for tenant %s in this node: %s", tenantName, err.Error())
+			return err
+		}
+		nodeData.AvailableList = formatSubnets(free)
+		log.Printf("Tenant %s allocated %s, node subnet fragmentation %.2f", tenantName, tenantCIDR.String(), Fragmentation(free))
+	}
+	nodeData.TenantList[tenantName] = tenantCIDR
+
+	tenantData := &TenantData{
+		TenantName:   tenantName,
+		TenantPrefix: tenantPrefix,
+		TenantCIDR:   tenantCIDR.String(),
+		ClusterCIDR:  clusterCIDR,
+		Backend:      nim.Backend,
+		IPs:          make(map[string]ContainerNetInfo),
+	}
+	if tenantData.Backend == "" {
+		tenantData.Backend = backend.TypeVxlan
 	}
 
-	sMac := macAddress.String()
-	if err != nil {
+	//Generate a new bridge name for the tenant
+	tenantData.Bridge = &Bridge{
+		Name:    "br-" + tenantName,
+		Gateway: tenantCIDR.Addr().Next(),
+	}
+	log.Printf("Bridge name: %s and IP: %s", tenantData.Bridge.Name, tenantData.Bridge.Gateway.String())
+	tenantData.Last = tenantData.Bridge.Gateway.String()
 
-		log.Println("Failed to convert hardware address to string")
+	if len(tenantData.Bridge.Name) >= 13 {
+		log.Printf("Bridge name too long: %s", tenantData.Bridge.Name)
+		tenantData.Bridge.Name = "br-default"
 	}
+
+	//The hardware address of the Vxlan device is derived from the node and tenant, the remote nodes keep a valid
+	//FDB entry when the tenant store is rebuilt
+	macAddress := backend.StableHardwareAddr(nim.NodeName + "/" + tenantName)
+
 	//Store the Vxlan information on the tenant store
 	vtepName := fmt.Sprintf("%s.%v", tenantName, tenantVNI)
 	log.Println(vtepName)
-	tenantStore.Data.Vxlan = &Vxlan{
+	tenantData.Vxlan = &Vxlan{
 		VtepName: vtepName,
 		VtepIP:   tenantCIDR.Addr().String(),
-		VtepMac:  sMac,
+		VtepMac:  macAddress.String(),
 		VNI:      tenantVNI,
 	}
 
-	return tenantStore.StoreTenantData()
+	if err := txn.Store(nim.NodeStore.Key, nodeData); err != nil {
+		return err
+	}
+	if err := txn.Store(tenantName, tenantData); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	nim.NodeStore.Data = nodeData
+	nim.Audit.record(AuditEvent{Action: AuditAllocateSubnet, Tenant: tenantName, CIDR: tenantCIDR.String()})
+	return nil
 
 }
 
-func (nim *NodeIPAM) RemoveTenant(tenantName string) {
+// Returns the tenant CIDR to the available subnets and deletes the tenant store, the node and tenant stores are
+// updated in a single transaction. Fails with ErrTenantInUse while the tenant has IPs allocated unless forced.
+// Removing a tenant that is not on the node is a no-op, so repeated deletes release the CIDR once.
+func (nim *NodeIPAM) RemoveTenant(tenantName string, force bool) error {
+
+	txn, err := Begin(nim.NodeStore.Storage, nim.NodeStore.Key, tenantName)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
 
+	nodeData := &NodeData{}
+	if err := txn.Load(nim.NodeStore.Key, nodeData); err != nil {
+		return err
+	}
+	tenantData := &TenantData{}
+	if err := txn.Load(tenantName, tenantData); err != nil {
+		return err
+	}
+	tenantCIDR, allocated := nodeData.TenantList[tenantName]
+	if !allocated && tenantData.TenantName == "" {
+		log.Printf("Tenant %s not present on the node, nothing to remove", tenantName)
+		nim.NodeStore.Data = nodeData
+		return nil
+	}
+
+	if len(tenantData.IPs) > 0 {
+		if !force {
+			return fmt.Errorf("%w: %s has %d IPs allocated", ErrTenantInUse, tenantName, len(tenantData.IPs))
+		}
+		log.Printf("Forcing removal of tenant %s with %d IPs allocated", tenantName, len(tenantData.IPs))
+	}
+
+	//The tenant subnet is merged back with its free buddies, blocks of a tenant cluster CIDR are released with the
+	//node entry of the tenant resource
+	if allocated {
+		nodeCIDR, _ := netip.ParsePrefix(nodeData.NodeCIDR)
+		free := mergeSubnets(parseSubnets(nodeData.AvailableList), nodeCIDR)
+		if nodeCIDR.IsValid() && nodeCIDR.Contains(tenantCIDR.Addr()) {
+			if slices.ContainsFunc(free, tenantCIDR.Overlaps) {
+				log.Printf("Subnet %s of tenant %s already available, not released again", tenantCIDR.String(), tenantName)
+			} else {
+				free = releaseSubnet(free, tenantCIDR, nodeCIDR)
+			}
+		}
+		nodeData.AvailableList = formatSubnets(free)
+		delete(nodeData.TenantList, tenantName)
+	}
+
+	if err := txn.Store(nim.NodeStore.Key, nodeData); err != nil {
+		return err
+	}
+	if err := txn.Delete(tenantName); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	nim.NodeStore.Data = nodeData
+
+	for ip, info := range tenantData.IPs {
+		event := auditIP(AuditReleaseIP, tenantName, ip, info)
+		event.Reason = "tenant removed"
+		nim.Audit.record(event)
+	}
+	cidr := tenantData.TenantCIDR
+	if allocated {
+		cidr = tenantCIDR.String()
+	}
+	nim.Audit.record(AuditEvent{Action: AuditReleaseSubnet, Tenant: tenantName, CIDR: cidr})
+	return nil
 }
 
 func GetTenantIP(tenantList []string) netip.Prefix {
@@ -144,62 +325,151 @@ func GetTenantIP(tenantList []string) netip.Prefix {
 	return subnet
 }
 
-func (tim *TenantIPAM) AllocateIP(id string, ifName string, netns string, pod_name string) (net.IP, error) {
+// Allocates a free IP of the tenant to the container with the strategy of the tenant IPAM.
+// Repeated ADD for the same container returns the same IP
+func (tim *TenantIPAM) AllocateIP(info ContainerNetInfo) (net.IP, error) {
 
 	tim.TenantStore.Lock()
 	defer tim.TenantStore.Unlock()
 
 	if err := tim.TenantStore.LoadTenantData(); err != nil {
-		log.Println("Failed to load tenant data")
+		return nil, err
 	}
-	//Get tenant gateway
-	gtw := tim.TenantStore.Data.Bridge.Gateway.String()
 
-	//Check if ID already exists
-	ip, _ := tim.TenantStore.GetIPByID(id)
-	if len(ip) > 0 {
+	if ip, ok := tim.TenantStore.GetIPByID(info.ID); ok {
 		log.Println("ID already exists")
 		return ip, nil
 	}
-	lastIP := tim.TenantStore.Last()
-	if len(lastIP) == 0 {
-		lastIP = net.IP(gtw)
-	}
-	start := make(net.IP, len(lastIP))
-	copy(start, lastIP)
-	log.Printf("Last IP: %s, Start IP %s and gateway is: %s", lastIP.String(), start.String(), gtw)
-	for {
-		next, err := tim.NextIP(start)
-		if err == ErrIPOverflow && !lastIP.Equal(net.IP(gtw)) {
-			start = net.IP(gtw)
-			continue
-		} else if err != nil {
-			log.Println("Error getting next IP: ", err)
-			return nil, err
-		}
-		if !tim.TenantStore.Contains(next) {
-			err := tim.TenantStore.Add(next, id, ifName, netns, pod_name)
-			tim.TenantStore.Data.Last = next.String()
-			tim.TenantStore.StoreTenantData()
-			return next, err
+
+	last, _ := netip.ParseAddr(tim.TenantStore.Data.Last)
+	addr, err := tim.TenantStore.allocator.Next(tim.Strategy, last)
+	if errors.Is(err, ErrNoFreeIP) {
+		//Quarantined IPs are only handed out once the pool is otherwise exhausted
+		if oldest, ok := tim.TenantStore.oldestQuarantined(); ok {
+			log.Printf("Tenant %s exhausted, taking %s out of quarantine", tim.TenantName, oldest.String())
+			addr, err = oldest, nil
 		}
-		start = next
-		if start.Equal(lastIP) {
-			break
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", tim.TenantName, err)
+	}
+	tim.TenantStore.Data.Last = addr.String()
+	if err := tim.TenantStore.Add(net.IP(addr.AsSlice()), info); err != nil {
+		return nil, err
+	}
+	tim.Audit.record(auditIP(AuditAllocateIP, tim.TenantName, addr.String(), info))
+	return net.IP(addr.AsSlice()), nil
+}
+
+// Allocates the requested IP to the container, the IP must be a free host address of the tenant CIDR
+func (tim *TenantIPAM) AllocateStaticIP(ip net.IP, info ContainerNetInfo) (net.IP, error) {
+
+	tim.TenantStore.Lock()
+	defer tim.TenantStore.Unlock()
+
+	if err := tim.TenantStore.LoadTenantData(); err != nil {
+		return nil, err
+	}
+
+	//Repeated ADD for the same container returns the same IP
+	if current, ok := tim.TenantStore.GetIPByID(info.ID); ok {
+		if current.Equal(ip) {
+			return current, nil
 		}
-		log.Printf("Next IP: %s", next.String())
+		return nil, fmt.Errorf("container %s already holds %s, requested %s", info.ID, current.String(), ip.String())
+	}
+
+	if err := tim.validateStaticIP(ip); err != nil {
+		return nil, err
+	}
+	//A requested IP is handed out even when quarantined, the pod asked for it explicitly
+	if tim.TenantStore.Contains(ip) && !tim.TenantStore.Quarantined(ip) {
+		return nil, fmt.Errorf("%w: %s in tenant %s", ErrIPInUse, ip.String(), tim.TenantName)
+	}
+	if err := tim.TenantStore.Add(ip, info); err != nil {
+		return nil, err
+	}
+	tim.Audit.record(auditIP(AuditAllocateIP, tim.TenantName, ip.String(), info))
+	return ip, nil
+}
+
+func (tim *TenantIPAM) validateStaticIP(ip net.IP) error {
+
+	_, ipnet, err := net.ParseCIDR(tim.TenantStore.Data.TenantCIDR)
+	if err != nil {
+		return err
+	}
+	ip = ip.To4()
+	if ip == nil || !ipnet.Contains(ip) {
+		return fmt.Errorf("%w: %s not in %s", ErrIPOutOfRange, ip, ipnet.String())
 	}
-	return nil, fmt.Errorf("no more available IPs")
 
+	broadcast := make(net.IP, len(ipnet.IP))
+	for i := range ipnet.IP {
+		broadcast[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+	}
+	gateway := net.ParseIP(tim.TenantStore.Data.Bridge.Gateway.String())
+	if ip.Equal(ipnet.IP) || ip.Equal(broadcast) || ip.Equal(gateway) {
+		return fmt.Errorf("%w: %s is reserved in %s", ErrIPOutOfRange, ip.String(), ipnet.String())
+	}
+	return nil
 }
-func (tim *TenantIPAM) ReleaseIP(id string) error {
+
+// Releases the IP of the container, returns the released attachment or nil when the container had no IP
+func (tim *TenantIPAM) ReleaseIP(id string) (*ContainerNetInfo, error) {
 	tim.TenantStore.Lock()
 	defer tim.TenantStore.Unlock()
 
 	if err := tim.TenantStore.LoadTenantData(); err != nil {
-		return err
+		return nil, err
+	}
+	ip, ok := tim.TenantStore.GetIPByID(id)
+	if !ok {
+		return nil, nil
 	}
-	return tim.TenantStore.Del(id)
+	released := tim.TenantStore.Data.IPs[ip.String()]
+	if err := tim.TenantStore.Del(id, tim.Quarantine); err != nil {
+		return nil, err
+	}
+	tim.Audit.record(auditIP(AuditReleaseIP, tim.TenantName, ip.String(), released))
+	return &released, nil
+}
+
+// Releases every IP whose container attachment is not reported as valid, returns the released IPs
+func (tim *TenantIPAM) ReleaseStaleIPs(valid func(id string, ifName string) bool) ([]net.IP, error) {
+	tim.TenantStore.Lock()
+	defer tim.TenantStore.Unlock()
+
+	if err := tim.TenantStore.LoadTenantData(); err != nil {
+		return nil, err
+	}
+
+	var released []net.IP
+	events := []AuditEvent{}
+	for ip, info := range tim.TenantStore.Data.IPs {
+		if valid(info.ID, info.IFname) {
+			continue
+		}
+		if addr, ok := tim.TenantStore.allocator.Release(info.ID); ok {
+			tim.TenantStore.hold(addr, tim.Quarantine)
+		}
+		delete(tim.TenantStore.Data.IPs, ip)
+		released = append(released, net.ParseIP(ip))
+
+		event := auditIP(AuditReleaseIP, tim.TenantName, ip, info)
+		event.Reason = "stale attachment"
+		events = append(events, event)
+	}
+	if len(released) == 0 {
+		return nil, nil
+	}
+	if err := tim.TenantStore.StoreTenantData(); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		tim.Audit.record(event)
+	}
+	return released, nil
 }
 
 func (tim *TenantIPAM) CheckIP(id string) (net.IP, error) {
@@ -218,23 +488,53 @@ func (tim *TenantIPAM) CheckIP(id string) (net.IP, error) {
 	return ip, nil
 }
 
-func (tim *TenantIPAM) NextIP(ip net.IP) (net.IP, error) {
+// Stores the DNS settings handed to the pods of the tenant, nil removes them
+func (tim *TenantIPAM) SetDNS(dns *types.DNS) error {
+	tim.TenantStore.Lock()
+	defer tim.TenantStore.Unlock()
+
+	if err := tim.TenantStore.LoadTenantData(); err != nil {
+		return err
+	}
+	tim.TenantStore.Data.DNS = dns
+	return tim.TenantStore.StoreTenantData()
+}
 
-	next := cip.NextIP(ip)
-	log.Println("Next IP: ", next.String())
+// Stores the other nodes of the tenant, the backend devices of a tenant with remote nodes are expected to exist
+func (tim *TenantIPAM) SetRemoteNodes(nodes []string) error {
+	tim.TenantStore.Lock()
+	defer tim.TenantStore.Unlock()
 
-	subnet := tim.TenantStore.Data.TenantCIDR
-	_, ipnet, err := net.ParseCIDR(subnet)
+	if err := tim.TenantStore.LoadTenantData(); err != nil {
+		return err
+	}
+	tim.TenantStore.Data.RemoteNodes = nodes
+	return tim.TenantStore.StoreTenantData()
+}
+
+// Node local state of the tenant handed to its backend
+func (d *TenantData) BackendTenant() (*backend.Tenant, error) {
+
+	_, cidr, err := net.ParseCIDR(d.TenantCIDR)
 	if err != nil {
-		log.Printf("Failed to parse CIDR: %s", err)
 		return nil, err
 	}
-	if !ipnet.Contains(next) {
-		log.Println("IP overflow")
-		return nil, ErrIPOverflow
+	tenant := &backend.Tenant{
+		Name:        d.TenantName,
+		CIDR:        cidr,
+		RemoteNodes: d.RemoteNodes,
+	}
+	if d.Bridge != nil {
+		tenant.Bridge = d.Bridge.Name
 	}
-	return next, nil
+	if d.Vxlan != nil {
+		tenant.VtepName = d.Vxlan.VtepName
+		tenant.VNI = d.Vxlan.VNI
+		tenant.VtepMac = d.Vxlan.VtepMac
+	}
+	return tenant, nil
 }
+
 func (tim *TenantIPAM) IPNet(ip net.IP) *net.IPNet {
 
 	_, ipNet, err := net.ParseCIDR(tim.TenantStore.Data.TenantCIDR)
@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func newTestNodeIPAM(t *testing.T, nodeCIDR string) *NodeIPAM {
+
+	t.Helper()
+	nodeStore, err := NewNodeStore(NewMemoryStorage(), "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nim, err := NewNodeIPAM(nodeStore, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nim.InitNode("192.168.0.10", nodeCIDR); err != nil {
+		t.Fatal(err)
+	}
+	return nim
+}
+
+func TestAllocateTenantBlockPrefix(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		clusterCIDR string
+		block       string
+		wantErr     error
+	}{
+		//The node CIDR is a /24, blocks of a tenant cluster CIDR are only bounded by the cluster CIDR
+		{name: "block larger than the node CIDR", clusterCIDR: "10.100.0.0/16", block: "10.100.2.0/23"},
+		{name: "whole cluster CIDR", clusterCIDR: "10.100.0.0/22", block: "10.100.0.0/22"},
+		{name: "block larger than the cluster CIDR", clusterCIDR: "10.100.0.0/23", block: "10.100.0.0/22", wantErr: ErrInvalidTenantPrefix},
+		{name: "block under the smallest tenant subnet", clusterCIDR: "10.100.0.0/16", block: "10.100.0.0/31", wantErr: ErrInvalidTenantPrefix},
+		{name: "block outside the cluster CIDR", clusterCIDR: "10.100.0.0/16", block: "10.101.0.0/24", wantErr: ErrInvalidClusterCIDR},
+		{name: "invalid cluster CIDR", clusterCIDR: "10.100.0.0", block: "10.100.0.0/24", wantErr: ErrInvalidClusterCIDR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			nim := newTestNodeIPAM(t, "10.244.0.0/24")
+			block := netip.MustParsePrefix(tt.block)
+			err := nim.AllocateTenantBlock("tenant1", 1, tt.clusterCIDR, block)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := nim.NodeStore.Data.TenantList["tenant1"]; got != block {
+				t.Fatalf("tenant subnet %s, expected %s", got, block)
+			}
+		})
+	}
+}
+
+func TestAllocateTenantPrefixInNodeCIDR(t *testing.T) {
+
+	nim := newTestNodeIPAM(t, "10.244.0.0/24")
+	if err := nim.AllocateTenant("tenant1", 1, 23); !errors.Is(err, ErrInvalidTenantPrefix) {
+		t.Fatalf("expected ErrInvalidTenantPrefix for a /23 in a /24 node CIDR, got %v", err)
+	}
+	if err := nim.AllocateTenant("tenant1", 1, 25); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestTenantIPAM(t *testing.T, nim *NodeIPAM, tenantName string) *TenantIPAM {
+
+	t.Helper()
+	tenantStore, err := NewTenantStore(nim.NodeStore.Storage, tenantName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tim, err := NewTenantIPAM(tenantStore, tenantName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tim
+}
+
+func TestAllocateStaticIP(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		id      string
+		ip      string
+		wantErr error
+	}{
+		{name: "free IP", id: "c2", ip: "10.244.0.10"},
+		{name: "repeated ADD of the holder", id: "c1", ip: "10.244.0.20"},
+		{name: "outside the tenant subnet", id: "c2", ip: "10.244.1.10", wantErr: ErrIPOutOfRange},
+		{name: "network address", id: "c2", ip: "10.244.0.0", wantErr: ErrIPOutOfRange},
+		{name: "broadcast address", id: "c2", ip: "10.244.0.255", wantErr: ErrIPOutOfRange},
+		{name: "gateway address", id: "c2", ip: "10.244.0.1", wantErr: ErrIPOutOfRange},
+		{name: "IPv6 address", id: "c2", ip: "fd00::10", wantErr: ErrIPOutOfRange},
+		{name: "IP in use", id: "c2", ip: "10.244.0.20", wantErr: ErrIPInUse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			nim := newTestNodeIPAM(t, "10.244.0.0/22")
+			if err := nim.AllocateTenant("tenant1", 1, 24); err != nil {
+				t.Fatal(err)
+			}
+			tim := newTestTenantIPAM(t, nim, "tenant1")
+			if _, err := tim.AllocateStaticIP(net.ParseIP("10.244.0.20"), ContainerNetInfo{ID: "c1", IFname: "eth0"}); err != nil {
+				t.Fatal(err)
+			}
+
+			ip, err := tim.AllocateStaticIP(net.ParseIP(tt.ip), ContainerNetInfo{ID: tt.id, IFname: "eth0"})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				if _, ok := tim.TenantStore.GetIPByID(tt.id); ok {
+					t.Fatalf("container %s holds an IP after a failed allocation", tt.id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ip.Equal(net.ParseIP(tt.ip)) {
+				t.Fatalf("allocated %s, expected %s", ip, tt.ip)
+			}
+			if held, ok := tim.TenantStore.GetIPByID(tt.id); !ok || !held.Equal(ip) {
+				t.Fatalf("container %s holds %v, expected %s", tt.id, held, ip)
+			}
+		})
+	}
+
+	t.Run("second IP for the holder", func(t *testing.T) {
+
+		nim := newTestNodeIPAM(t, "10.244.0.0/22")
+		if err := nim.AllocateTenant("tenant1", 1, 24); err != nil {
+			t.Fatal(err)
+		}
+		tim := newTestTenantIPAM(t, nim, "tenant1")
+		info := ContainerNetInfo{ID: "c1", IFname: "eth0"}
+		if _, err := tim.AllocateStaticIP(net.ParseIP("10.244.0.20"), info); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tim.AllocateStaticIP(net.ParseIP("10.244.0.21"), info); err == nil {
+			t.Fatal("container allocated a second IP")
+		}
+	})
+}
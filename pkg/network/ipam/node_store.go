@@ -1,38 +1,24 @@
 package ipam
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-func NewNodeStore(dataDir string, nodeName string) (*NodeStore, error) {
-
-	if dataDir == "" {
-		dataDir = defaultStoreDir
-	}
+const (
+	nodeNameFile = "nodename"
+)
 
-	dir := filepath.Join(dataDir, nodeName)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, err
-		}
-	}
+func NewNodeStore(storage Storage, nodeName string) (*NodeStore, error) {
 
-	mutex, err := newFileLock(dir)
+	locker, err := storage.Locker(nodeName)
 	if err != nil {
 		log.Printf("Failed in creating file lock for node store: %s", err.Error())
-	}
-	file := filepath.Join(dir, nodeName+".json")
-
-	if err != nil {
-		log.Printf("Failed in parsing CIDR: %s", err.Error())
-	}
-
-	if err != nil {
-		log.Printf("Failed in parsing tenant CIDR: %s", err.Error())
+		return nil, err
 	}
 
 	nodeData := &NodeData{
@@ -41,10 +27,10 @@ func NewNodeStore(dataDir string, nodeName string) (*NodeStore, error) {
 	}
 
 	return &NodeStore{
-		FileMutex: mutex,
-		Directory: dir,
-		Data:      nodeData,
-		DataFile:  file,
+		Locker:  locker,
+		Storage: storage,
+		Key:     nodeName,
+		Data:    nodeData,
 	}, nil
 
 }
@@ -67,41 +53,46 @@ func (s *NodeStore) AddNodeIP(nodeIP string) error {
 	return s.StoreNodeData()
 }
 
-// Store node data to a json file
-func (s *NodeStore) StoreNodeData() error {
+// Records the node owning the data directory so the CNI plugin can locate its node store
+func StoreNodeName(dataDir string, nodeName string) error {
 
-	raw, err := json.Marshal(s.Data)
-	if err != nil {
+	if dataDir == "" {
+		dataDir = defaultStoreDir
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return err
 	}
+	return writeFileAtomic(filepath.Join(dataDir, nodeNameFile), []byte(nodeName))
+}
+
+// Returns the node name recorded by the daemon, fails if the daemon has not initialised the data directory
+func LoadNodeName(dataDir string) (string, error) {
 
-	return os.WriteFile(s.DataFile, raw, 0644)
+	if dataDir == "" {
+		dataDir = defaultStoreDir
+	}
+	raw, err := os.ReadFile(filepath.Join(dataDir, nodeNameFile))
+	if err != nil {
+		return "", err
+	}
+	nodeName := strings.TrimSpace(string(raw))
+	if nodeName == "" {
+		return "", fmt.Errorf("empty node name in %s", filepath.Join(dataDir, nodeNameFile))
+	}
+	return nodeName, nil
+}
+
+// Store node data to the storage
+func (s *NodeStore) StoreNodeData() error {
+	return storeRecord(s.Storage, s.Key, s.Data)
 }
 
 // Load node data to a node store
 func (s *NodeStore) LoadNodeData() error {
 	nodeData := &NodeData{}
 
-	raw, err := os.ReadFile(s.DataFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			f, err := os.Create(s.DataFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			_, err = f.Write([]byte("{}"))
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		if err := json.Unmarshal(raw, &nodeData); err != nil {
-			return err
-		}
+	if err := loadRecord(s.Storage, s.Key, nodeData); err != nil {
+		return err
 	}
 	if nodeData.TenantList == nil {
 		nodeData.TenantList = make(map[string]netip.Prefix)
@@ -1,87 +1,90 @@
 package ipam
 
 import (
-	"encoding/json"
 	"log"
-	//"net/netip"
-	"os"
-	"path/filepath"
-	
-	//cip "github.com/containernetworking/plugins/pkg/ip"
 )
 
 const (
-	defaultPodStore= "/var/lib/cni/tenantcni/podlist"
+	podStoreName = "podlist"
 )
 
+func NewPodStore(storage Storage) (*PodStore, error) {
 
-func NewPodStore()(*PodStore, error) {
-
-
-	dir := filepath.Join(defaultPodStore)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, err
-		}
-	}
-
-	mutex, err := newFileLock(dir)
+	locker, err := storage.Locker(podStoreName)
 	if err != nil {
 		log.Printf("Failed in creating file lock for pod store: %s", err.Error())
+		return nil, err
 	}
-	file := filepath.Join(dir, "podlist.json")
 
-	podData:= &PodData{
-		Pods: make(map[string]string),
+	podData := &PodData{
+		Pods: make(map[string]PodInfo),
 	}
 
 	return &PodStore{
-		FileMutex: mutex,
-		Directory: dir,
-		Data:      podData,
-		DataFile:  file,
+		Locker:  locker,
+		Storage: storage,
+		Key:     podStoreName,
+		Data:    podData,
 	}, nil
 
 }
 
 func (s *PodStore) StorePodData() error {
-	raw, err := json.Marshal(s.Data)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.DataFile, raw, 0644)
+	return storeRecord(s.Storage, s.Key, s.Data)
 }
 
-
-func(s *PodStore) LoadPodData() error {
+func (s *PodStore) LoadPodData() error {
 	podData := &PodData{}
 
-	raw, err := os.ReadFile(s.DataFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			f, err := os.Create(s.DataFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			_, err = f.Write([]byte("{}"))
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		if err := json.Unmarshal(raw, &podData); err != nil {
-			return err
-		}
+	if err := loadRecord(s.Storage, s.Key, podData); err != nil {
+		return err
 	}
 	if podData.Pods == nil {
-		podData.Pods = make(map[string]string)
+		podData.Pods = make(map[string]PodInfo)
 	}
 
 	s.Data = podData
 	return nil
 }
+
+// Path changed whenever the pod store is written, watched by the CNI plugin for pod registrations
+func PodStoreWatchPath(storage Storage) string {
+	return storage.WatchPath(podStoreName)
+}
+
+// Key of a pod in the pod store, pod names are only unique within a namespace
+func PodKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// Returns the pod entry, an entry recorded for a different pod UID is stale and not returned. Entries migrated from
+// schema version 0 without a namespace are keyed by the pod name and match the pod in any namespace.
+func (s *PodStore) GetPod(namespace string, name string, uid string) (PodInfo, bool) {
+
+	info, ok := s.Data.Pods[PodKey(namespace, name)]
+	if !ok {
+		info, ok = s.Data.Pods[name]
+	}
+	if !ok {
+		return PodInfo{}, false
+	}
+	if uid != "" && info.UID != "" && info.UID != uid {
+		return PodInfo{}, false
+	}
+	return info, true
+}
+
+// Registers the pod, replacing the entry of the pod name left by schema version 0
+func (s *PodStore) SetPod(namespace string, name string, info PodInfo) {
+	delete(s.Data.Pods, name)
+	s.Data.Pods[PodKey(namespace, name)] = info
+}
+
+// Removes the pod entry unless it belongs to a different pod UID
+func (s *PodStore) DelPod(namespace string, name string, uid string) {
+
+	if _, ok := s.GetPod(namespace, name, uid); ok {
+		delete(s.Data.Pods, PodKey(namespace, name))
+		delete(s.Data.Pods, name)
+	}
+}
@@ -0,0 +1,93 @@
+package ipam
+
+import "testing"
+
+func TestPodStoreKeys(t *testing.T) {
+
+	podStore, err := NewPodStore(NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := podStore.LoadPodData(); err != nil {
+		t.Fatal(err)
+	}
+	//Pods of the same name in two namespaces are separate entries
+	podStore.SetPod("default", "pod1", PodInfo{UID: "uid1", Tenants: []string{"tenant1"}})
+	podStore.SetPod("web", "pod1", PodInfo{UID: "uid2", Tenants: []string{"tenant2"}})
+	if got := PodKey("web", "pod1"); got != "web/pod1" {
+		t.Fatalf("pod key %q, expected web/pod1", got)
+	}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		uid        string
+		want       string
+		wantExists bool
+	}{
+		{name: "matching UID", namespace: "default", uid: "uid1", want: "tenant1", wantExists: true},
+		{name: "no UID", namespace: "web", want: "tenant2", wantExists: true},
+		{name: "stale UID", namespace: "default", uid: "uid2"},
+		{name: "other namespace", namespace: "kube-system"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			info, ok := podStore.GetPod(tt.namespace, "pod1", tt.uid)
+			if ok != tt.wantExists {
+				t.Fatalf("found %v, expected %v", ok, tt.wantExists)
+			}
+			if ok && info.Tenants[0] != tt.want {
+				t.Fatalf("tenants %v, expected %s", info.Tenants, tt.want)
+			}
+		})
+	}
+
+	//A DEL of a previous pod UID leaves the entry of the recreated pod
+	podStore.DelPod("default", "pod1", "uid0")
+	if _, ok := podStore.GetPod("default", "pod1", ""); !ok {
+		t.Fatal("entry removed by a stale UID")
+	}
+	podStore.DelPod("default", "pod1", "uid1")
+	if _, ok := podStore.GetPod("default", "pod1", ""); ok {
+		t.Fatal("entry not removed")
+	}
+	if _, ok := podStore.GetPod("web", "pod1", ""); !ok {
+		t.Fatal("entry of the other namespace removed")
+	}
+}
+
+// Entries migrated from schema version 0 without a namespace are keyed by the pod name until the pod is registered
+func TestPodStoreV0Entry(t *testing.T) {
+
+	storage := NewMemoryStorage()
+	if err := storage.Store(podStoreName, []byte(`{"pods":{"pod1":"tenant1","pod2":"tenant2"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	podStore, err := NewPodStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := podStore.LoadPodData(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, ok := podStore.GetPod("web", "pod1", "uid1")
+	if !ok || len(info.Tenants) != 1 || info.Tenants[0] != "tenant1" {
+		t.Fatalf("pod1 resolved to %+v %v, expected tenant1", info, ok)
+	}
+
+	//Registering the pod replaces the entry of the name
+	podStore.SetPod("web", "pod1", PodInfo{UID: "uid1", Tenants: []string{"tenant3"}})
+	if _, ok := podStore.Data.Pods["pod1"]; ok {
+		t.Fatal("entry of the name kept after the pod registration")
+	}
+	if info, _ := podStore.GetPod("web", "pod1", "uid1"); info.Tenants[0] != "tenant3" {
+		t.Fatalf("pod1 resolved to %v, expected tenant3", info.Tenants)
+	}
+
+	podStore.DelPod("default", "pod2", "uid2")
+	if _, ok := podStore.GetPod("default", "pod2", ""); ok {
+		t.Fatal("entry of the name not removed")
+	}
+}
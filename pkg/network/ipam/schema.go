@@ -0,0 +1,181 @@
+package ipam
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+const (
+	//Schema version written in every node, tenant and pod store. Records without a version are version 0
+	SchemaVersion = 1
+
+	nodeSchema   = "node"
+	tenantSchema = "tenant"
+	podSchema    = "pod"
+)
+
+var (
+	ErrSchemaTooNew = errors.New("store written by a newer version of tenantcni")
+)
+
+// Records upgraded on load and stamped with the schema version on store
+type versionedRecord interface {
+	schema() (kind string, version *int)
+}
+
+func (d *NodeData) schema() (string, *int)   { return nodeSchema, &d.Version }
+func (d *TenantData) schema() (string, *int) { return tenantSchema, &d.Version }
+func (d *PodData) schema() (string, *int)    { return podSchema, &d.Version }
+
+// Upgrades a record from the version of its index to the next one, on the decoded top level fields
+type migration func(record map[string]json.RawMessage) error
+
+// Migrations of every record kind, the migration at index i upgrades version i to i+1
+var migrations = map[string][]migration{
+	nodeSchema:   {nil},
+	tenantSchema: {nil},
+	podSchema:    {migratePodV0},
+}
+
+// Upgrades the record to the schema version of the binary, fails when the record is newer than the binary
+func migrateRecord(kind string, key string, raw []byte) ([]byte, error) {
+
+	record := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, fmt.Errorf("store %s: %w", key, err)
+	}
+	version := 0
+	if v, ok := record["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, fmt.Errorf("store %s: invalid schema version %s", key, string(v))
+		}
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("%w: %s store %s has schema version %d, this binary supports up to %d",
+			ErrSchemaTooNew, kind, key, version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return raw, nil
+	}
+
+	for v := version; v < SchemaVersion; v++ {
+		if v >= len(migrations[kind]) {
+			return nil, fmt.Errorf("store %s: no migration of %s schema version %d", key, kind, v)
+		}
+		if migrate := migrations[kind][v]; migrate != nil {
+			if err := migrate(record); err != nil {
+				return nil, fmt.Errorf("store %s: migrating schema version %d: %w", key, v, err)
+			}
+		}
+	}
+	record["version"] = json.RawMessage(fmt.Sprint(SchemaVersion))
+	log.Printf("Migrated %s store %s from schema version %d to %d", kind, key, version, SchemaVersion)
+	return json.Marshal(record)
+}
+
+// Loads the node store, the pod store and the stores of the tenants of the node, fails with ErrSchemaTooNew when any
+// of them was written by a newer tenantcni. Other load errors are left to the users of the stores.
+func CheckSchemaVersions(storage Storage, nodeName string) error {
+
+	nodeData := &NodeData{}
+	if err := loadRecord(storage, nodeName, nodeData); errors.Is(err, ErrSchemaTooNew) {
+		return err
+	}
+	if err := loadRecord(storage, podStoreName, &PodData{}); errors.Is(err, ErrSchemaTooNew) {
+		return err
+	}
+	for _, tenantName := range sortedKeys(nodeData.TenantList) {
+		if err := loadRecord(storage, tenantName, &TenantData{}); errors.Is(err, ErrSchemaTooNew) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version 0 wrote the pods as the bare tenant name, or as an object with a single tenant. The first layout keyed the
+// pods by name only, those entries are rekeyed to namespace/name when the entry holds the namespace and kept under the
+// name otherwise, the pod store resolves them on lookup until the pod is registered again.
+func migratePodV0(record map[string]json.RawMessage) error {
+
+	raw, ok := record["pods"]
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	pods := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &pods); err != nil {
+		return err
+	}
+
+	//Entries already keyed by namespace/name win over the rekeyed ones
+	keys := sortedKeys(pods)
+	slices.SortStableFunc(keys, func(a, b string) int {
+		return cmp.Compare(podKeyRank(a), podKeyRank(b))
+	})
+	migratedPods := make(map[string]json.RawMessage, len(pods))
+	for _, key := range keys {
+		info, err := migratePodInfoV0(pods[key])
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(key, "/") {
+			var namespace string
+			if ns, ok := info["namespace"]; ok && json.Unmarshal(ns, &namespace) == nil && namespace != "" {
+				key = PodKey(namespace, key)
+			}
+		}
+		delete(info, "namespace")
+		if _, exists := migratedPods[key]; exists {
+			log.Printf("Dropping pod store entry of %s, the pod is already registered", key)
+			continue
+		}
+		migrated, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		migratedPods[key] = migrated
+	}
+	raw, err := json.Marshal(migratedPods)
+	if err != nil {
+		return err
+	}
+	record["pods"] = raw
+	return nil
+}
+
+func podKeyRank(key string) int {
+
+	if strings.Contains(key, "/") {
+		return 0
+	}
+	return 1
+}
+
+// Decodes a version 0 pod entry with the single tenant turned into the tenant list
+func migratePodInfoV0(value json.RawMessage) (map[string]json.RawMessage, error) {
+
+	var tenant string
+	if err := json.Unmarshal(value, &tenant); err == nil {
+		tenants, err := json.Marshal([]string{tenant})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]json.RawMessage{"tenants": tenants}, nil
+	}
+
+	info := map[string]json.RawMessage{}
+	if err := json.Unmarshal(value, &info); err != nil {
+		return nil, err
+	}
+	if single, ok := info["tenant"]; ok {
+		if _, ok := info["tenants"]; !ok {
+			info["tenants"] = json.RawMessage("[" + string(single) + "]")
+		}
+		delete(info, "tenant")
+	}
+	return info, nil
+}
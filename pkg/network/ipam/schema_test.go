@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMigratePodV0(t *testing.T) {
+
+	tests := []struct {
+		name string
+		pods string
+		want map[string]PodInfo
+	}{
+		{
+			name: "bare tenant name keyed by name is kept under the name",
+			pods: `{"pod1":"tenant1"}`,
+			want: map[string]PodInfo{"pod1": {Tenants: []string{"tenant1"}}},
+		},
+		{
+			name: "entry keyed by name without its namespace is kept under the name",
+			pods: `{"pod1":{"uid":"uid1","tenant":"tenant1"}}`,
+			want: map[string]PodInfo{"pod1": {UID: "uid1", Tenants: []string{"tenant1"}}},
+		},
+		{
+			name: "entry keyed by name with its namespace is rekeyed",
+			pods: `{"pod1":{"namespace":"web","uid":"uid1","tenant":"tenant1"}}`,
+			want: map[string]PodInfo{"web/pod1": {UID: "uid1", Tenants: []string{"tenant1"}}},
+		},
+		{
+			name: "single tenant keyed by namespace/name",
+			pods: `{"default/pod1":{"uid":"uid1","tenant":"tenant1"}}`,
+			want: map[string]PodInfo{"default/pod1": {UID: "uid1", Tenants: []string{"tenant1"}}},
+		},
+		{
+			name: "bare tenant name keyed by namespace/name",
+			pods: `{"default/pod1":"tenant1"}`,
+			want: map[string]PodInfo{"default/pod1": {Tenants: []string{"tenant1"}}},
+		},
+		{
+			name: "rekeyed entry does not replace a namespace/name entry",
+			pods: `{"pod1":{"namespace":"web","uid":"old","tenant":"tenant1"},"web/pod1":{"uid":"uid1","tenants":["tenant2"]}}`,
+			want: map[string]PodInfo{"web/pod1": {UID: "uid1", Tenants: []string{"tenant2"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			storage := NewMemoryStorage()
+			if err := storage.Store(podStoreName, []byte(`{"pods":`+tt.pods+`}`)); err != nil {
+				t.Fatal(err)
+			}
+			podStore, err := NewPodStore(storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := podStore.LoadPodData(); err != nil {
+				t.Fatal(err)
+			}
+			if podStore.Data.Version != SchemaVersion {
+				t.Fatalf("schema version %d, expected %d", podStore.Data.Version, SchemaVersion)
+			}
+			if !reflect.DeepEqual(podStore.Data.Pods, tt.want) {
+				t.Fatalf("pods %+v, expected %+v", podStore.Data.Pods, tt.want)
+			}
+		})
+	}
+}
+
+// Version 0 tenant stores wrote the netns and name of the containers under the NetNS and Name keys, they decode into
+// the current fields as is
+func TestLoadTenantV0(t *testing.T) {
+
+	storage := NewMemoryStorage()
+	raw := `{"tenantName":"tenant1","ips":{"10.244.0.2":{"id":"c1","ifname":"eth0","NetNS":"/var/run/netns/c1","Name":"pod1"}}}`
+	if err := storage.Store("tenant1", []byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	data := &TenantData{}
+	if err := loadRecord(storage, "tenant1", data); err != nil {
+		t.Fatal(err)
+	}
+	want := ContainerNetInfo{ID: "c1", IFname: "eth0", NetNS: "/var/run/netns/c1", Name: "pod1"}
+	if got := data.IPs["10.244.0.2"]; got != want {
+		t.Fatalf("container %+v, expected %+v", got, want)
+	}
+	if data.Version != SchemaVersion {
+		t.Fatalf("schema version %d, expected %d", data.Version, SchemaVersion)
+	}
+}
+
+func TestCheckSchemaVersions(t *testing.T) {
+
+	newer := json.RawMessage(`{"version":` + strconv.Itoa(SchemaVersion+1) + `}`)
+	tests := []struct {
+		name    string
+		records map[string]json.RawMessage
+		wantErr bool
+	}{
+		{
+			name:    "empty storage",
+			records: map[string]json.RawMessage{},
+		},
+		{
+			name: "current and older stores",
+			records: map[string]json.RawMessage{
+				"node1":      json.RawMessage(`{"tenantList":{"tenant1":"10.244.0.0/24"}}`),
+				"tenant1":    json.RawMessage(`{"tenantName":"tenant1","version":1}`),
+				podStoreName: json.RawMessage(`{"pods":{"default/pod1":"tenant1"}}`),
+			},
+		},
+		{
+			name:    "newer node store",
+			records: map[string]json.RawMessage{"node1": newer},
+			wantErr: true,
+		},
+		{
+			name: "newer pod store",
+			records: map[string]json.RawMessage{
+				"node1":      json.RawMessage(`{}`),
+				podStoreName: newer,
+			},
+			wantErr: true,
+		},
+		{
+			name: "newer tenant store",
+			records: map[string]json.RawMessage{
+				"node1":   json.RawMessage(`{"tenantList":{"tenant1":"10.244.0.0/24","tenant2":"10.244.1.0/24"}}`),
+				"tenant1": json.RawMessage(`{"tenantName":"tenant1"}`),
+				"tenant2": newer,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			storage := NewMemoryStorage()
+			for key, raw := range tt.records {
+				if err := storage.Store(key, raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := CheckSchemaVersions(storage, "node1")
+			if tt.wantErr && !errors.Is(err, ErrSchemaTooNew) {
+				t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
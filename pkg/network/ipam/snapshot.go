@@ -0,0 +1,512 @@
+package ipam
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	//Version of the snapshot archive layout, the records inside carry their own schema version
+	SnapshotVersion = 1
+
+	snapshotManifest = "manifest.json"
+	snapshotNode     = "node.json"
+	snapshotPods     = "podlist.json"
+	snapshotTenants  = "tenants/"
+
+	//Bound on the size of a single file of the archive
+	maxSnapshotFile = 64 << 20
+	//Attempts at reading the stores while tenants are added or removed on the node
+	snapshotRetries = 3
+)
+
+var (
+	ErrInvalidSnapshot  = errors.New("invalid snapshot")
+	ErrSnapshotConflict = errors.New("node already holds IPAM state")
+)
+
+// Manifest of a snapshot archive, written first in the archive
+type SnapshotManifest struct {
+	Version       int              `json:"version"`
+	SchemaVersion int              `json:"schemaVersion"`
+	NodeName      string           `json:"nodeName"`
+	NodeCIDR      string           `json:"nodeCIDR"`
+	Created       time.Time        `json:"created"`
+	Records       []SnapshotRecord `json:"records"`
+}
+
+// File of the archive holding a store record, with the sha256 of its content
+type SnapshotRecord struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key"`
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// Node store, tenant stores and pod store of a node as read from a snapshot archive
+type Snapshot struct {
+	Manifest SnapshotManifest
+	Node     *NodeData
+	Tenants  map[string]*TenantData
+	Pods     *PodData
+}
+
+// Writes the node store, the stores of the tenants of the node and the pod store as a gzipped tar archive.
+// The stores are read under their locks in a single transaction, so the archive is consistent
+func ExportSnapshot(storage Storage, nodeName string, w io.Writer) (*SnapshotManifest, error) {
+
+	snapshot, err := readSnapshotStores(storage, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	add := func(kind string, key string, file string, v interface{}) error {
+		raw, err := encodeVersioned(v)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		files[file] = raw
+		snapshot.Manifest.Records = append(snapshot.Manifest.Records, SnapshotRecord{
+			Kind: kind, Key: key, File: file, SHA256: hex.EncodeToString(sum[:]),
+		})
+		return nil
+	}
+	if err := add(nodeSchema, nodeName, snapshotNode, snapshot.Node); err != nil {
+		return nil, err
+	}
+	for _, tenantName := range sortedKeys(snapshot.Tenants) {
+		if err := add(tenantSchema, tenantName, snapshotTenantFile(tenantName), snapshot.Tenants[tenantName]); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(podSchema, podStoreName, snapshotPods, snapshot.Pods); err != nil {
+		return nil, err
+	}
+
+	manifest, err := json.MarshalIndent(snapshot.Manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte) error {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: snapshot.Manifest.Created,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := write(snapshotManifest, manifest); err != nil {
+		return nil, err
+	}
+	for _, record := range snapshot.Manifest.Records {
+		if err := write(record.File, files[record.File]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return &snapshot.Manifest, nil
+}
+
+// Reads the stores of the node, retrying when the tenants of the node change between listing and locking them
+func readSnapshotStores(storage Storage, nodeName string) (*Snapshot, error) {
+
+	listed := &NodeData{}
+	if err := loadRecord(storage, nodeName, listed); err != nil {
+		return nil, err
+	}
+	if listed.NodeCIDR == "" {
+		return nil, fmt.Errorf("node store %s not initialised", nodeName)
+	}
+
+	for attempt := 0; attempt < snapshotRetries; attempt++ {
+
+		tenants := sortedKeys(listed.TenantList)
+		txn, err := Begin(storage, append([]string{nodeName, podStoreName}, tenants...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		node := &NodeData{}
+		if err := txn.Load(nodeName, node); err != nil {
+			txn.Rollback()
+			return nil, err
+		}
+		if !slices.Equal(tenants, sortedKeys(node.TenantList)) {
+			txn.Rollback()
+			listed = node
+			continue
+		}
+
+		snapshot := &Snapshot{
+			Manifest: SnapshotManifest{
+				Version:       SnapshotVersion,
+				SchemaVersion: SchemaVersion,
+				NodeName:      nodeName,
+				NodeCIDR:      node.NodeCIDR,
+				Created:       time.Now().UTC(),
+			},
+			Node:    node,
+			Tenants: make(map[string]*TenantData),
+			Pods:    &PodData{Pods: make(map[string]PodInfo)},
+		}
+		for _, tenantName := range tenants {
+			tenantData := &TenantData{}
+			if err := txn.Load(tenantName, tenantData); err != nil {
+				txn.Rollback()
+				return nil, err
+			}
+			snapshot.Tenants[tenantName] = tenantData
+		}
+		if err := txn.Load(podStoreName, snapshot.Pods); err != nil {
+			txn.Rollback()
+			return nil, err
+		}
+		txn.Rollback()
+		return snapshot, nil
+	}
+	return nil, fmt.Errorf("tenants of node %s kept changing during the export", nodeName)
+}
+
+// Reads a snapshot archive, verifying the checksums of the records and the consistency of the stores.
+// Records of an older schema version are migrated, records of a newer one fail with ErrSchemaTooNew
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size > maxSnapshotFile {
+			return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrInvalidSnapshot, header.Name, maxSnapshotFile)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err.Error())
+		}
+		files[header.Name] = data
+	}
+
+	raw, ok := files[snapshotManifest]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidSnapshot, snapshotManifest)
+	}
+	snapshot := &Snapshot{Tenants: make(map[string]*TenantData)}
+	if err := json.Unmarshal(raw, &snapshot.Manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSnapshot, snapshotManifest, err.Error())
+	}
+	if snapshot.Manifest.Version > SnapshotVersion {
+		return nil, fmt.Errorf("%w: archive version %d, this binary supports up to %d",
+			ErrInvalidSnapshot, snapshot.Manifest.Version, SnapshotVersion)
+	}
+
+	for _, record := range snapshot.Manifest.Records {
+		data, ok := files[record.File]
+		if !ok {
+			return nil, fmt.Errorf("%w: missing %s", ErrInvalidSnapshot, record.File)
+		}
+		delete(files, record.File)
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != record.SHA256 {
+			return nil, fmt.Errorf("%w: checksum mismatch on %s", ErrInvalidSnapshot, record.File)
+		}
+		data, err := migrateRecord(record.Kind, record.Key, data)
+		if err != nil {
+			return nil, err
+		}
+
+		switch record.Kind {
+		case nodeSchema:
+			if snapshot.Node != nil || record.Key != snapshot.Manifest.NodeName {
+				return nil, fmt.Errorf("%w: unexpected node store %s", ErrInvalidSnapshot, record.Key)
+			}
+			snapshot.Node = &NodeData{}
+			err = json.Unmarshal(data, snapshot.Node)
+		case tenantSchema:
+			if _, ok := snapshot.Tenants[record.Key]; ok || record.Key == "" || strings.Contains(record.Key, "/") || strings.HasPrefix(record.Key, ".") {
+				return nil, fmt.Errorf("%w: unexpected tenant store %q", ErrInvalidSnapshot, record.Key)
+			}
+			tenantData := &TenantData{}
+			err = json.Unmarshal(data, tenantData)
+			snapshot.Tenants[record.Key] = tenantData
+		case podSchema:
+			if snapshot.Pods != nil {
+				return nil, fmt.Errorf("%w: duplicate pod store", ErrInvalidSnapshot)
+			}
+			snapshot.Pods = &PodData{}
+			err = json.Unmarshal(data, snapshot.Pods)
+		default:
+			return nil, fmt.Errorf("%w: unknown record kind %q", ErrInvalidSnapshot, record.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSnapshot, record.File, err.Error())
+		}
+	}
+	for name := range files {
+		if name != snapshotManifest {
+			return nil, fmt.Errorf("%w: %s not listed in the manifest", ErrInvalidSnapshot, name)
+		}
+	}
+
+	if err := snapshot.Validate(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Checks the stores of the snapshot agree with each other: every tenant of the node store has its tenant store with
+// the same subnet, the tenant subnets and the available subnets do not overlap, and the IPs of every tenant are inside
+// its subnet and held by a single container
+func (s *Snapshot) Validate() error {
+
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshot, fmt.Sprintf(format, args...))
+	}
+	if s.Node == nil {
+		return invalid("missing node store")
+	}
+	if s.Pods == nil {
+		s.Pods = &PodData{}
+	}
+	if s.Pods.Pods == nil {
+		s.Pods.Pods = make(map[string]PodInfo)
+	}
+	if s.Node.TenantList == nil {
+		s.Node.TenantList = make(map[string]netip.Prefix)
+	}
+	nodeCIDR, err := netip.ParsePrefix(s.Node.NodeCIDR)
+	if err != nil {
+		return invalid("node CIDR %q", s.Node.NodeCIDR)
+	}
+	if s.Manifest.NodeCIDR != "" && s.Manifest.NodeCIDR != s.Node.NodeCIDR {
+		return invalid("node CIDR %s of the manifest differs from the node store %s", s.Manifest.NodeCIDR, s.Node.NodeCIDR)
+	}
+
+	used := []netip.Prefix{}
+	for _, tenantName := range sortedKeys(s.Node.TenantList) {
+		subnet := s.Node.TenantList[tenantName]
+		tenantData, ok := s.Tenants[tenantName]
+		if !ok {
+			return invalid("missing tenant store of %s", tenantName)
+		}
+		if tenantData.TenantName != tenantName || tenantData.TenantCIDR != subnet.String() {
+			return invalid("tenant store %s holds %s %s, node store has %s", tenantName,
+				tenantData.TenantName, tenantData.TenantCIDR, subnet.String())
+		}
+		//Blocks of a tenant cluster CIDR are outside the node CIDR
+		if tenantData.ClusterCIDR == "" && !containsSubnet(nodeCIDR, subnet) {
+			return invalid("tenant %s subnet %s outside of node CIDR %s", tenantName, subnet.String(), nodeCIDR.String())
+		}
+		if tenantData.ClusterCIDR != "" {
+			cluster, err := netip.ParsePrefix(tenantData.ClusterCIDR)
+			if err != nil || !containsSubnet(cluster, subnet) {
+				return invalid("tenant %s subnet %s outside of cluster CIDR %s", tenantName, subnet.String(), tenantData.ClusterCIDR)
+			}
+		}
+		if i := slices.IndexFunc(used, subnet.Overlaps); i >= 0 {
+			return invalid("tenant %s subnet %s overlaps %s", tenantName, subnet.String(), used[i].String())
+		}
+		used = append(used, subnet)
+
+		if err := validateTenantIPs(tenantData); err != nil {
+			return invalid("tenant %s: %s", tenantName, err.Error())
+		}
+	}
+	for tenantName := range s.Tenants {
+		if _, ok := s.Node.TenantList[tenantName]; !ok {
+			return invalid("tenant store %s not in the node store", tenantName)
+		}
+	}
+
+	for _, subnet := range parseSubnets(s.Node.AvailableList) {
+		if !containsSubnet(nodeCIDR, subnet) {
+			return invalid("available subnet %s outside of node CIDR %s", subnet.String(), nodeCIDR.String())
+		}
+		if i := slices.IndexFunc(used, subnet.Overlaps); i >= 0 {
+			return invalid("available subnet %s overlaps %s", subnet.String(), used[i].String())
+		}
+		used = append(used, subnet)
+	}
+
+	//The pod store also holds pods of tenants removed since, they are only reported
+	for key, info := range s.Pods.Pods {
+		for _, tenantName := range info.Tenants {
+			if _, ok := s.Tenants[tenantName]; !ok {
+				log.Printf("Pod %s of snapshot references tenant %s not on the node", key, tenantName)
+			}
+		}
+	}
+	return nil
+}
+
+func validateTenantIPs(data *TenantData) error {
+
+	subnet, err := netip.ParsePrefix(data.TenantCIDR)
+	if err != nil {
+		return err
+	}
+	subnet = subnet.Masked()
+	allocator, err := NewAllocator(subnet)
+	if err != nil {
+		return err
+	}
+	for ip, info := range data.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("invalid IP %q", ip)
+		}
+		addr = addr.Unmap()
+		if !subnet.Contains(addr) || addr == subnet.Addr() || addr == lastAddr(subnet) {
+			return fmt.Errorf("IP %s outside of %s", ip, subnet.String())
+		}
+		if data.Bridge != nil && addr == data.Bridge.Gateway {
+			return fmt.Errorf("IP %s is the gateway", ip)
+		}
+		if info.ID == "" {
+			return fmt.Errorf("IP %s without container ID", ip)
+		}
+		if err := allocator.Mark(addr, info.ID); err != nil {
+			return fmt.Errorf("IP %s: %s", ip, err.Error())
+		}
+	}
+	return nil
+}
+
+func containsSubnet(outer netip.Prefix, inner netip.Prefix) bool {
+	return outer.Bits() <= inner.Bits() && outer.Masked().Contains(inner.Addr())
+}
+
+// Writes the stores of the snapshot as the IPAM state of the node in a single transaction. The node CIDR of the
+// snapshot must match nodeCIDR when it is set. A node already holding tenants, or a tenant store of the snapshot
+// already present, fails with ErrSnapshotConflict unless force is set, in which case the tenant stores of the current
+// node state are removed. The daemon restores the dataplane of the imported tenants on its next start.
+func ImportSnapshot(storage Storage, snapshot *Snapshot, nodeName string, nodeCIDR string, force bool) error {
+
+	if err := snapshot.Validate(); err != nil {
+		return err
+	}
+	if nodeName == "" {
+		nodeName = snapshot.Manifest.NodeName
+	}
+	if nodeCIDR != "" && nodeCIDR != snapshot.Node.NodeCIDR {
+		return fmt.Errorf("%w: node CIDR %s of the snapshot differs from the node CIDR %s of %s",
+			ErrInvalidSnapshot, snapshot.Node.NodeCIDR, nodeCIDR, nodeName)
+	}
+
+	current := &NodeData{}
+	if err := loadRecord(storage, nodeName, current); err != nil {
+		return err
+	}
+	keys := []string{nodeName, podStoreName}
+	keys = append(keys, sortedKeys(snapshot.Tenants)...)
+	keys = append(keys, sortedKeys(current.TenantList)...)
+
+	txn, err := Begin(storage, keys...)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	//Reload under the locks, the node store may have changed since the keys were listed
+	current = &NodeData{}
+	if err := txn.Load(nodeName, current); err != nil {
+		return err
+	}
+	for tenantName := range current.TenantList {
+		if !slices.Contains(keys, tenantName) {
+			return fmt.Errorf("tenants of node %s changed during the import", nodeName)
+		}
+	}
+	if !force {
+		if len(current.TenantList) > 0 {
+			return fmt.Errorf("%w: node %s has %d tenants", ErrSnapshotConflict, nodeName, len(current.TenantList))
+		}
+		for tenantName := range snapshot.Tenants {
+			if TenantStoreExists(storage, tenantName) {
+				return fmt.Errorf("%w: tenant store %s exists", ErrSnapshotConflict, tenantName)
+			}
+		}
+	}
+	if current.NodeCIDR != "" && current.NodeCIDR != snapshot.Node.NodeCIDR {
+		log.Printf("Replacing node CIDR %s of node %s with %s", current.NodeCIDR, nodeName, snapshot.Node.NodeCIDR)
+	}
+
+	for tenantName := range current.TenantList {
+		if _, ok := snapshot.Tenants[tenantName]; !ok {
+			if err := txn.Delete(tenantName); err != nil {
+				return err
+			}
+		}
+	}
+	if err := txn.Store(nodeName, snapshot.Node); err != nil {
+		return err
+	}
+	for tenantName, tenantData := range snapshot.Tenants {
+		if err := txn.Store(tenantName, tenantData); err != nil {
+			return err
+		}
+	}
+	if err := txn.Store(podStoreName, snapshot.Pods); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Imported snapshot of node %s taken %s with %d tenants as node %s", snapshot.Manifest.NodeName,
+		snapshot.Manifest.Created.Format(time.RFC3339), len(snapshot.Tenants), nodeName)
+	return nil
+}
+
+// Name of the archive file of a tenant store
+func snapshotTenantFile(tenantName string) string {
+	return snapshotTenants + tenantName + ".json"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,285 @@
+package ipam
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Storage of node1 with tenant1 holding an IP of pod1 and an empty tenant2
+func newSnapshotSource(t *testing.T) Storage {
+
+	t.Helper()
+	nim := newTestNodeIPAM(t, "10.244.0.0/22")
+	for _, tenantName := range []string{"tenant1", "tenant2"} {
+		if err := nim.AllocateTenant(tenantName, 1, 24); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tim := newTestTenantIPAM(t, nim, "tenant1")
+	if _, err := tim.AllocateIP(ContainerNetInfo{ID: "c1", IFname: "eth0", Name: "pod1", Namespace: "default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := nim.NodeStore.Storage
+	podStore, err := NewPodStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := podStore.LoadPodData(); err != nil {
+		t.Fatal(err)
+	}
+	podStore.SetPod("default", "pod1", PodInfo{UID: "uid1", Tenants: []string{"tenant1"}})
+	if err := podStore.StorePodData(); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func exportTestSnapshot(t *testing.T, storage Storage) []byte {
+
+	t.Helper()
+	archive := &bytes.Buffer{}
+	if _, err := ExportSnapshot(storage, "node1", archive); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// Rewrites the files of the archive with edit, the manifest is left untouched
+func editTestArchive(t *testing.T, archive []byte, edit func(name string, data []byte) []byte) []byte {
+
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	gzOut := gzip.NewWriter(out)
+	tr := tar.NewReader(gz)
+	tw := tar.NewWriter(gzOut)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = edit(header.Name, data)
+		header.Size = int64(len(data))
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzOut.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func readTestSnapshot(t *testing.T, archive []byte) *Snapshot {
+
+	t.Helper()
+	snapshot, err := ReadSnapshot(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+// Fails when the node, tenant and pod stores of the two storages differ
+func assertSameStores(t *testing.T, want Storage, got Storage, tenants ...string) {
+
+	t.Helper()
+	for _, pair := range []struct {
+		key       string
+		want, got interface{}
+	}{
+		{key: "node1", want: &NodeData{}, got: &NodeData{}},
+		{key: podStoreName, want: &PodData{}, got: &PodData{}},
+	} {
+		if err := loadRecord(want, pair.key, pair.want); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadRecord(got, pair.key, pair.got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pair.want, pair.got) {
+			t.Fatalf("store %s is %+v, expected %+v", pair.key, pair.got, pair.want)
+		}
+	}
+	for _, tenantName := range tenants {
+		wantData, gotData := &TenantData{}, &TenantData{}
+		if err := loadRecord(want, tenantName, wantData); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadRecord(got, tenantName, gotData); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(wantData, gotData) {
+			t.Fatalf("tenant store %s is %+v, expected %+v", tenantName, gotData, wantData)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+
+	source := newSnapshotSource(t)
+	snapshot := readTestSnapshot(t, exportTestSnapshot(t, source))
+	if snapshot.Manifest.NodeName != "node1" || snapshot.Manifest.NodeCIDR != "10.244.0.0/22" {
+		t.Fatalf("manifest of %s %s", snapshot.Manifest.NodeName, snapshot.Manifest.NodeCIDR)
+	}
+	if got := sortedKeys(snapshot.Tenants); !reflect.DeepEqual(got, []string{"tenant1", "tenant2"}) {
+		t.Fatalf("snapshot tenants %v", got)
+	}
+
+	target := NewMemoryStorage()
+	if err := ImportSnapshot(target, snapshot, "", "10.244.0.0/22", false); err != nil {
+		t.Fatal(err)
+	}
+	assertSameStores(t, source, target, "tenant1", "tenant2")
+	assertJournalEmpty(t, target)
+}
+
+func TestReadSnapshotChecksumMismatch(t *testing.T) {
+
+	archive := editTestArchive(t, exportTestSnapshot(t, newSnapshotSource(t)), func(name string, data []byte) []byte {
+		if name != snapshotTenantFile("tenant1") {
+			return data
+		}
+		return bytes.Replace(data, []byte(`"c1"`), []byte(`"c2"`), 1)
+	})
+	_, err := ReadSnapshot(bytes.NewReader(archive))
+	if !errors.Is(err, ErrInvalidSnapshot) || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestSnapshotValidate(t *testing.T) {
+
+	archive := exportTestSnapshot(t, newSnapshotSource(t))
+	tests := []struct {
+		name   string
+		modify func(s *Snapshot)
+	}{
+		{
+			name:   "node CIDR of the manifest differs from the node store",
+			modify: func(s *Snapshot) { s.Manifest.NodeCIDR = "10.245.0.0/22" },
+		},
+		{
+			name:   "missing tenant store",
+			modify: func(s *Snapshot) { delete(s.Tenants, "tenant2") },
+		},
+		{
+			name:   "tenant store not in the node store",
+			modify: func(s *Snapshot) { s.Tenants["tenant3"] = &TenantData{TenantName: "tenant3"} },
+		},
+		{
+			name: "tenant subnet outside of the node CIDR",
+			modify: func(s *Snapshot) {
+				s.Node.TenantList["tenant2"] = netip.MustParsePrefix("10.245.0.0/24")
+				s.Tenants["tenant2"].TenantCIDR = "10.245.0.0/24"
+			},
+		},
+		{
+			name:   "tenant IP outside of its subnet",
+			modify: func(s *Snapshot) { s.Tenants["tenant1"].IPs["10.244.9.2"] = ContainerNetInfo{ID: "c9"} },
+		},
+		{
+			name:   "missing node store",
+			modify: func(s *Snapshot) { s.Node = nil },
+		},
+	}
+
+	if err := readTestSnapshot(t, archive).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			snapshot := readTestSnapshot(t, archive)
+			tt.modify(snapshot)
+			if err := snapshot.Validate(); !errors.Is(err, ErrInvalidSnapshot) {
+				t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+			}
+		})
+	}
+}
+
+func TestImportSnapshotNodeCIDRMismatch(t *testing.T) {
+
+	snapshot := readTestSnapshot(t, exportTestSnapshot(t, newSnapshotSource(t)))
+	target := NewMemoryStorage()
+	if err := ImportSnapshot(target, snapshot, "node1", "10.245.0.0/22", false); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+	if target.Exists("node1") || target.Exists("tenant1") {
+		t.Fatal("stores written by a failed import")
+	}
+}
+
+func TestImportSnapshotConflict(t *testing.T) {
+
+	source := newSnapshotSource(t)
+	snapshot := readTestSnapshot(t, exportTestSnapshot(t, source))
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T) Storage
+	}{
+		{
+			name: "node with tenants",
+			setup: func(t *testing.T) Storage {
+				nim := newTestNodeIPAM(t, "10.244.0.0/22")
+				if err := nim.AllocateTenant("tenant3", 3, 24); err != nil {
+					t.Fatal(err)
+				}
+				return nim.NodeStore.Storage
+			},
+		},
+		{
+			name: "tenant store of the snapshot exists",
+			setup: func(t *testing.T) Storage {
+				storage := NewMemoryStorage()
+				if err := storeRecord(storage, "tenant1", &TenantData{TenantName: "tenant1"}); err != nil {
+					t.Fatal(err)
+				}
+				return storage
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			target := tt.setup(t)
+			if err := ImportSnapshot(target, snapshot, "node1", "", false); !errors.Is(err, ErrSnapshotConflict) {
+				t.Fatalf("expected ErrSnapshotConflict, got %v", err)
+			}
+			if err := ImportSnapshot(target, snapshot, "node1", "", true); err != nil {
+				t.Fatal(err)
+			}
+			assertSameStores(t, source, target, "tenant1", "tenant2")
+			if target.Exists("tenant3") {
+				t.Fatal("tenant store of the replaced node state kept")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	//Node, tenant and pod stores as JSON files under the data directory, one directory per store
+	StorageFile = "file"
+	//All stores as keys of a single bbolt database in the data directory
+	StorageBolt = "bolt"
+	//Process local stores, for tests and tools that must not touch the node state
+	StorageMemory = "memory"
+)
+
+var (
+	ErrRecordNotFound     = errors.New("record not found")
+	ErrUnsupportedStorage = errors.New("unsupported storage type")
+)
+
+// Storage persists the records of the IPAM stores, one record per node, per tenant and for the pod list.
+// Records are keyed by the store name.
+type Storage interface {
+	//Returns the record, ErrRecordNotFound when it was never stored
+	Load(key string) ([]byte, error)
+	Store(key string, data []byte) error
+	//Removes the record, succeeds when it does not exist
+	Delete(key string) error
+	Exists(key string) bool
+	//Returns the lock serialising read-modify-write cycles of the record, shared by every process on the node
+	Locker(key string) (Locker, error)
+	//Returns the path changed when the record is stored, empty when the storage cannot be watched
+	WatchPath(key string) string
+}
+
+// Locker is the lock of a record, implemented by the file mutex for the storages shared between processes
+type Locker interface {
+	Lock() error
+	Unlock() error
+	RLock() error
+	RUnlock() error
+}
+
+// Creates the storage of the given type rooted at the data directory, an empty type is the file storage
+func NewStorage(storageType string, dataDir string) (Storage, error) {
+
+	if dataDir == "" {
+		dataDir = defaultStoreDir
+	}
+	switch storageType {
+	case "", StorageFile:
+		return NewFileStorage(dataDir), nil
+	case StorageBolt:
+		return NewBoltStorage(dataDir), nil
+	case StorageMemory:
+		return NewMemoryStorage(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedStorage, storageType)
+}
+
+// Unmarshals the record into v, v is left untouched when the record does not exist.
+// Versioned records are upgraded to the schema version of the binary first
+func loadRecord(s Storage, key string, v interface{}) error {
+
+	raw, err := s.Load(key)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	if r, ok := v.(versionedRecord); ok {
+		kind, _ := r.schema()
+		if raw, err = migrateRecord(kind, key, raw); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func storeRecord(s Storage, key string, v interface{}) error {
+
+	raw, err := encodeVersioned(v)
+	if err != nil {
+		return err
+	}
+	return s.Store(key, raw)
+}
+
+// Marshals the record, stamping versioned records with the schema version of the binary
+func encodeVersioned(v interface{}) ([]byte, error) {
+
+	if r, ok := v.(versionedRecord); ok {
+		_, version := r.schema()
+		*version = SchemaVersion
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,118 @@
+package ipam
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltFile        = "tenantcni.db"
+	boltLockDir     = "locks"
+	boltOpenTimeout = 10 * time.Second
+)
+
+var boltBucket = []byte("stores")
+
+// BoltStorage keeps every record as a key of a bbolt database in the data directory.
+// The database is opened per operation, the CNI plugin and the daemon run as separate processes and bbolt
+// holds an exclusive lock on the file while it is open.
+type BoltStorage struct {
+	DataDir string
+}
+
+func NewBoltStorage(dataDir string) *BoltStorage {
+	return &BoltStorage{DataDir: dataDir}
+}
+
+func (s *BoltStorage) open() (*bolt.DB, error) {
+
+	if err := os.MkdirAll(s.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	return bolt.Open(filepath.Join(s.DataDir, boltFile), 0644, &bolt.Options{Timeout: boltOpenTimeout})
+}
+
+func (s *BoltStorage) update(fn func(b *bolt.Bucket) error) error {
+
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+func (s *BoltStorage) view(fn func(b *bolt.Bucket) error) error {
+
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if b == nil {
+			return ErrRecordNotFound
+		}
+		return fn(b)
+	})
+}
+
+func (s *BoltStorage) Load(key string) ([]byte, error) {
+
+	var raw []byte
+	err := s.view(func(b *bolt.Bucket) error {
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrRecordNotFound
+		}
+		//Values are only valid during the transaction
+		raw = append([]byte(nil), v...)
+		return nil
+	})
+	return raw, err
+}
+
+func (s *BoltStorage) Store(key string, data []byte) error {
+	return s.update(func(b *bolt.Bucket) error {
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStorage) Delete(key string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *BoltStorage) Exists(key string) bool {
+
+	_, err := s.Load(key)
+	return err == nil
+}
+
+// Records are locked with file mutexes under <dataDir>/locks, the database lock only covers single operations
+func (s *BoltStorage) Locker(key string) (Locker, error) {
+
+	dir := filepath.Join(s.DataDir, boltLockDir, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return newFileLock(dir)
+}
+
+// Every record is written to the database file, so the data directory is watched
+func (s *BoltStorage) WatchPath(key string) string {
+	return s.DataDir
+}
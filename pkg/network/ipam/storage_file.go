@@ -0,0 +1,216 @@
+package ipam
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	//Suffix of the previous generation of a record, kept as fallback when the current file is corrupted
+	prevSuffix     = ".prev"
+	checksumPrefix = "sha256:"
+)
+
+var (
+	ErrCorruptRecord = errors.New("corrupted record")
+)
+
+// FileStorage keeps every record in <dataDir>/<key>/<key>.json, next to the lock file of the record.
+// Records are written atomically with a checksum, and the previous generation is kept in <key>.json.prev.
+type FileStorage struct {
+	DataDir string
+
+	//Called after a corrupted record was restored from its previous generation
+	OnRecover func(key string, cause error)
+}
+
+// Envelope of the record files, the checksum covers the data bytes
+type fileRecord struct {
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+func NewFileStorage(dataDir string) *FileStorage {
+	return &FileStorage{DataDir: dataDir}
+}
+
+func (s *FileStorage) dir(key string) string {
+	return filepath.Join(s.DataDir, key)
+}
+
+func (s *FileStorage) file(key string) string {
+	return filepath.Join(s.dir(key), key+".json")
+}
+
+// Returns the current generation of the record, falling back to the previous generation when the current file is
+// missing or corrupted. Callers may only hold the read lock, the current file is replaced by the next Store.
+func (s *FileStorage) Load(key string) ([]byte, error) {
+
+	file := s.file(key)
+	data, err := readRecordFile(file)
+	if err == nil {
+		return data, nil
+	}
+	prev, prevErr := readRecordFile(file + prevSuffix)
+	if prevErr != nil {
+		if os.IsNotExist(err) && os.IsNotExist(prevErr) {
+			return nil, ErrRecordNotFound
+		}
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("store %s: %w", key, prevErr)
+		}
+		return nil, fmt.Errorf("store %s: %w", key, err)
+	}
+
+	log.Printf("Recovered store %s from its previous generation: %s", key, err.Error())
+	if s.OnRecover != nil {
+		s.OnRecover(key, err)
+	}
+	return prev, nil
+}
+
+// Writes the record to a temporary file, syncs it and renames it over the current file. The current file is
+// hard linked as the previous generation first, so a current generation exists at every point. A corrupted current
+// file is replaced without becoming the previous generation, which stays the last good one.
+func (s *FileStorage) Store(key string, data []byte) error {
+
+	if err := os.MkdirAll(s.dir(key), 0755); err != nil {
+		return err
+	}
+	raw, err := encodeRecord(data)
+	if err != nil {
+		return err
+	}
+
+	file := s.file(key)
+	if _, err := readRecordFile(file); err == nil {
+		if err := os.Remove(file + prevSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(file, file+prevSuffix); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(file, raw)
+}
+
+// Removes the record and its previous generation. The record directory keeps the lock file, a writer blocked on the
+// lock while the record is deleted must wake up on the same file later lockers open.
+func (s *FileStorage) Delete(key string) error {
+
+	for _, file := range []string{s.file(key), s.file(key) + prevSuffix} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) Exists(key string) bool {
+
+	for _, file := range []string{s.file(key), s.file(key) + prevSuffix} {
+		if _, err := os.Stat(file); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FileStorage) Locker(key string) (Locker, error) {
+
+	if err := os.MkdirAll(s.dir(key), 0755); err != nil {
+		return nil, err
+	}
+	return newFileLock(s.dir(key))
+}
+
+// The record directory is created so it can be watched before the record is first stored
+func (s *FileStorage) WatchPath(key string) string {
+
+	if err := os.MkdirAll(s.dir(key), 0755); err != nil {
+		return ""
+	}
+	return s.dir(key)
+}
+
+func encodeRecord(data []byte) ([]byte, error) {
+
+	//The data is stored compacted, the checksum must match the bytes read back
+	compact := &bytes.Buffer{}
+	if err := json.Compact(compact, data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fileRecord{
+		Checksum: checksum(compact.Bytes()),
+		Data:     compact.Bytes(),
+	})
+}
+
+// Reads and verifies a record file. Files written before checksums were introduced hold the bare record.
+func readRecordFile(path string) ([]byte, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	record := fileRecord{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptRecord, path, err)
+	}
+	if record.Checksum == "" {
+		return raw, nil
+	}
+	if sum := checksum(record.Data); sum != record.Checksum {
+		return nil, fmt.Errorf("%w: %s: checksum %s, expected %s", ErrCorruptRecord, path, sum, record.Checksum)
+	}
+	return record.Data, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return checksumPrefix + hex.EncodeToString(sum[:])
+}
+
+// Replaces the file with the data through a synced temporary file in the same directory
+func writeFileAtomic(path string, data []byte) error {
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	//The rename is only durable once the directory entry is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
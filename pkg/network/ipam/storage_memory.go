@@ -0,0 +1,94 @@
+package ipam
+
+import (
+	"sync"
+)
+
+// MemoryStorage keeps the records in the process memory, locks only serialise goroutines of the process
+type MemoryStorage struct {
+	mu      sync.Mutex
+	records map[string][]byte
+	locks   map[string]*memoryLock
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		records: make(map[string][]byte),
+		locks:   make(map[string]*memoryLock),
+	}
+}
+
+func (s *MemoryStorage) Load(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, ok := s.records[key]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return append([]byte(nil), raw...), nil
+}
+
+func (s *MemoryStorage) Store(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryStorage) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.records[key]
+	return ok
+}
+
+func (s *MemoryStorage) Locker(key string) (Locker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.locks[key]
+	if !ok {
+		l = &memoryLock{}
+		s.locks[key] = l
+	}
+	return l, nil
+}
+
+func (s *MemoryStorage) WatchPath(key string) string {
+	return ""
+}
+
+type memoryLock struct {
+	sync.RWMutex
+}
+
+func (l *memoryLock) Lock() error {
+	l.RWMutex.Lock()
+	return nil
+}
+
+func (l *memoryLock) Unlock() error {
+	l.RWMutex.Unlock()
+	return nil
+}
+
+func (l *memoryLock) RLock() error {
+	l.RWMutex.RLock()
+	return nil
+}
+
+func (l *memoryLock) RUnlock() error {
+	l.RWMutex.RUnlock()
+	return nil
+}
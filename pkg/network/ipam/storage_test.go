@@ -0,0 +1,213 @@
+package ipam
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Every storage type behind the Storage interface, the memory storage stands in for the others in the store tests
+func testStorages(t *testing.T) map[string]Storage {
+
+	return map[string]Storage{
+		StorageMemory: NewMemoryStorage(),
+		StorageFile:   NewFileStorage(t.TempDir()),
+		StorageBolt:   NewBoltStorage(t.TempDir()),
+	}
+}
+
+func TestStorageRoundTrip(t *testing.T) {
+
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+
+			if _, err := storage.Load("tenant1"); !errors.Is(err, ErrRecordNotFound) {
+				t.Fatalf("expected ErrRecordNotFound before the first store, got %v", err)
+			}
+
+			data := []byte(`{"tenantName":"tenant1"}`)
+			if err := storage.Store("tenant1", data); err != nil {
+				t.Fatal(err)
+			}
+			//The stored record does not alias the caller buffer
+			data[2] = 'X'
+			raw, err := storage.Load("tenant1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []byte(`{"tenantName":"tenant1"}`); !bytes.Equal(raw, want) {
+				t.Fatalf("loaded %s, expected %s", raw, want)
+			}
+
+			//A second store replaces the record
+			if err := storage.Store("tenant1", []byte(`{}`)); err != nil {
+				t.Fatal(err)
+			}
+			raw, err = storage.Load("tenant1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(raw, []byte(`{}`)) {
+				t.Fatalf("loaded %s after replace", raw)
+			}
+		})
+	}
+}
+
+func TestStorageExistsDelete(t *testing.T) {
+
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+
+			if storage.Exists("tenant1") {
+				t.Fatal("record exists before the first store")
+			}
+			if err := storage.Store("tenant1", []byte(`{}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Store("tenant2", []byte(`{}`)); err != nil {
+				t.Fatal(err)
+			}
+			if !storage.Exists("tenant1") {
+				t.Fatal("record missing after store")
+			}
+
+			if err := storage.Delete("tenant1"); err != nil {
+				t.Fatal(err)
+			}
+			if storage.Exists("tenant1") {
+				t.Fatal("record exists after delete")
+			}
+			if _, err := storage.Load("tenant1"); !errors.Is(err, ErrRecordNotFound) {
+				t.Fatalf("expected ErrRecordNotFound after delete, got %v", err)
+			}
+			if !storage.Exists("tenant2") {
+				t.Fatal("delete removed another record")
+			}
+			//Deleting a missing record succeeds
+			if err := storage.Delete("tenant1"); err != nil {
+				t.Fatalf("deleting a missing record: %v", err)
+			}
+		})
+	}
+}
+
+// Read-modify-write cycles under the record lock are not lost, each goroutine takes its own locker like the
+// separate processes of the plugin and the daemon
+func TestStorageConcurrentLock(t *testing.T) {
+
+	const workers, increments = 8, 25
+
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+
+			if err := storage.Store("counter", []byte("0")); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < increments; i++ {
+						if err := incrementRecord(storage, "counter"); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			raw, err := storage.Load("counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(raw), strconv.Itoa(workers*increments); got != want {
+				t.Fatalf("counter %s, expected %s", got, want)
+			}
+		})
+	}
+}
+
+func incrementRecord(storage Storage, key string) error {
+
+	lock, err := storage.Locker(key)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	raw, err := storage.Load(key)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return err
+	}
+	//Let the other workers run between the load and the store, a lost update shows without the lock
+	runtime.Gosched()
+	return storage.Store(key, []byte(strconv.Itoa(n+1)))
+}
+
+func TestFileStorageRecoverPrevious(t *testing.T) {
+
+	storage := NewFileStorage(t.TempDir())
+	var recovered []string
+	storage.OnRecover = func(key string, cause error) {
+		recovered = append(recovered, key)
+	}
+	corrupt := func() {
+		t.Helper()
+		if err := os.WriteFile(storage.file("tenant1"), []byte(`{"checksum":"sha256:00","data":{}}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(want string) {
+		t.Helper()
+		raw, err := storage.Load("tenant1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != want {
+			t.Fatalf("loaded %s, expected %s", raw, want)
+		}
+	}
+
+	for _, data := range []string{`{"v":1}`, `{"v":2}`} {
+		if err := storage.Store("tenant1", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt()
+	load(`{"v":1}`)
+	if len(recovered) != 1 || recovered[0] != "tenant1" {
+		t.Fatalf("recoveries %v, expected tenant1", recovered)
+	}
+	//Load only holds the read lock, the corrupted file is left to the next Store
+	if _, err := readRecordFile(storage.file("tenant1")); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("current file rewritten by Load: %v", err)
+	}
+
+	//The corrupted file does not replace the last good generation
+	if err := storage.Store("tenant1", []byte(`{"v":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	load(`{"v":3}`)
+	corrupt()
+	load(`{"v":1}`)
+}
@@ -0,0 +1,145 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+)
+
+const (
+	//Prefix of the tenants created without one
+	DefaultTenantPrefix = 24
+	//Smallest tenant subnet, network, gateway, broadcast and one pod
+	maxTenantPrefix = 30
+)
+
+var (
+	ErrNoSubnets           = errors.New("no available subnet for the tenant prefix")
+	ErrInvalidTenantPrefix = errors.New("invalid tenant prefix")
+)
+
+// Takes a subnet of the requested prefix length out of the free blocks of the node. The best fit is the smallest free
+// block holding the prefix, the lowest one on ties, split in halves until it has the requested size. Returns the
+// subnet and the free blocks left.
+func allocateSubnet(free []netip.Prefix, bits int) (netip.Prefix, []netip.Prefix, error) {
+
+	best := -1
+	for i, block := range free {
+		if block.Bits() > bits {
+			continue
+		}
+		if best < 0 || block.Bits() > free[best].Bits() ||
+			(block.Bits() == free[best].Bits() && block.Addr().Less(free[best].Addr())) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return netip.Prefix{}, free, fmt.Errorf("%w: /%d", ErrNoSubnets, bits)
+	}
+
+	block := free[best]
+	free = slices.Delete(slices.Clone(free), best, best+1)
+	for block.Bits() < bits {
+		lower, upper := splitSubnet(block)
+		free = append(free, upper)
+		block = lower
+	}
+	sortSubnets(free)
+	return block, free, nil
+}
+
+// Returns the subnet to the free blocks, merging it with its buddy while the buddy is free and the merged block stays
+// inside the node CIDR
+func releaseSubnet(free []netip.Prefix, subnet netip.Prefix, nodeCIDR netip.Prefix) []netip.Prefix {
+
+	free = slices.Clone(free)
+	block := subnet.Masked()
+	for nodeCIDR.IsValid() && block.Bits() > nodeCIDR.Bits() {
+		buddy := buddySubnet(block)
+		i := slices.Index(free, buddy)
+		if i < 0 {
+			break
+		}
+		free = slices.Delete(free, i, i+1)
+		block = netip.PrefixFrom(block.Addr(), block.Bits()-1).Masked()
+	}
+	free = append(free, block)
+	sortSubnets(free)
+	return free
+}
+
+// Merges every pair of free buddies, for available lists written before blocks were merged on release
+func mergeSubnets(free []netip.Prefix, nodeCIDR netip.Prefix) []netip.Prefix {
+
+	merged := []netip.Prefix{}
+	for _, block := range free {
+		merged = releaseSubnet(merged, block, nodeCIDR)
+	}
+	return merged
+}
+
+// Fraction of the free addresses outside the largest free block, 0 when the free space is a single block
+func Fragmentation(free []netip.Prefix) float64 {
+
+	var total, largest uint64
+	for _, block := range free {
+		size := uint64(1) << (32 - block.Bits())
+		total += size
+		if size > largest {
+			largest = size
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return 1 - float64(largest)/float64(total)
+}
+
+func splitSubnet(block netip.Prefix) (netip.Prefix, netip.Prefix) {
+
+	lower := netip.PrefixFrom(block.Addr(), block.Bits()+1)
+	upperAddr := uint32ToAddr(addrToUint32(block.Addr()) | (uint32(1) << (31 - block.Bits())))
+	return lower, netip.PrefixFrom(upperAddr, block.Bits()+1)
+}
+
+func buddySubnet(block netip.Prefix) netip.Prefix {
+
+	addr := uint32ToAddr(addrToUint32(block.Addr()) ^ (uint32(1) << (32 - block.Bits())))
+	return netip.PrefixFrom(addr, block.Bits())
+}
+
+func sortSubnets(free []netip.Prefix) {
+	slices.SortFunc(free, func(a, b netip.Prefix) int {
+		return a.Addr().Compare(b.Addr())
+	})
+}
+
+func parseSubnets(list []string) []netip.Prefix {
+
+	subnets := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Printf("Skipping invalid subnet %q in available list: %s", s, err.Error())
+			continue
+		}
+		subnets = append(subnets, p.Masked())
+	}
+	return subnets
+}
+
+func formatSubnets(subnets []netip.Prefix) []string {
+
+	list := make([]string, 0, len(subnets))
+	for _, p := range subnets {
+		list = append(list, p.String())
+	}
+	return list
+}
+
+// Reports the fragmentation of the free subnets of the node
+func (nim *NodeIPAM) Fragmentation() float64 {
+	return Fragmentation(parseSubnets(nim.NodeStore.Data.AvailableList))
+}
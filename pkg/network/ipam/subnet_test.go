@@ -0,0 +1,198 @@
+package ipam
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func prefixes(list ...string) []netip.Prefix {
+
+	subnets := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		subnets = append(subnets, netip.MustParsePrefix(s))
+	}
+	return subnets
+}
+
+func TestAllocateSubnetBestFit(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		free     []string
+		bits     int
+		want     string
+		wantFree []string
+	}{
+		{
+			name:     "exact fit before a larger block",
+			free:     []string{"10.0.0.0/23", "10.0.2.0/24"},
+			bits:     24,
+			want:     "10.0.2.0/24",
+			wantFree: []string{"10.0.0.0/23"},
+		},
+		{
+			name:     "smallest larger block is split",
+			free:     []string{"10.0.0.0/23", "10.0.2.0/25"},
+			bits:     27,
+			want:     "10.0.2.0/27",
+			wantFree: []string{"10.0.0.0/23", "10.0.2.32/27", "10.0.2.64/26"},
+		},
+		{
+			name:     "lowest block on ties",
+			free:     []string{"10.0.3.0/24", "10.0.1.0/24", "10.0.0.0/23"},
+			bits:     25,
+			want:     "10.0.1.0/25",
+			wantFree: []string{"10.0.0.0/23", "10.0.1.128/25", "10.0.3.0/24"},
+		},
+		{
+			name:     "whole node block",
+			free:     []string{"10.0.0.0/22"},
+			bits:     22,
+			want:     "10.0.0.0/22",
+			wantFree: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			got, free, err := allocateSubnet(prefixes(tt.free...), tt.bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != netip.MustParsePrefix(tt.want) {
+				t.Fatalf("allocated %s, expected %s", got, tt.want)
+			}
+			if !slices.Equal(free, prefixes(tt.wantFree...)) {
+				t.Fatalf("free %v, expected %v", free, tt.wantFree)
+			}
+		})
+	}
+
+	t.Run("no block large enough", func(t *testing.T) {
+
+		free := prefixes("10.0.0.0/25", "10.0.1.0/25")
+		_, left, err := allocateSubnet(free, 24)
+		if !errors.Is(err, ErrNoSubnets) {
+			t.Fatalf("expected ErrNoSubnets, got %v", err)
+		}
+		if !slices.Equal(left, free) {
+			t.Fatalf("free blocks changed to %v on failure", left)
+		}
+	})
+}
+
+func TestReleaseSubnetMergesBuddies(t *testing.T) {
+
+	nodeCIDR := netip.MustParsePrefix("10.0.0.0/22")
+
+	//Carve the node in a /24, two /25 and a /23, then return them out of order
+	free := prefixes(nodeCIDR.String())
+	var allocated []netip.Prefix
+	for _, bits := range []int{24, 25, 25, 23} {
+		subnet, left, err := allocateSubnet(free, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		free = left
+		allocated = append(allocated, subnet)
+	}
+	if len(free) != 0 {
+		t.Fatalf("free %v after carving the whole node", free)
+	}
+
+	steps := []struct {
+		release  int
+		wantFree []string
+	}{
+		//The buddy 10.0.1.0/25 is in use, nothing to merge
+		{release: 2, wantFree: []string{"10.0.1.128/25"}},
+		{release: 0, wantFree: []string{"10.0.0.0/24", "10.0.1.128/25"}},
+		//Both /25 free merge to 10.0.1.0/24, which merges with 10.0.0.0/24
+		{release: 1, wantFree: []string{"10.0.0.0/23"}},
+		{release: 3, wantFree: []string{"10.0.0.0/22"}},
+	}
+	for _, step := range steps {
+		free = releaseSubnet(free, allocated[step.release], nodeCIDR)
+		if !slices.Equal(free, prefixes(step.wantFree...)) {
+			t.Fatalf("releasing %s: free %v, expected %v", allocated[step.release], free, step.wantFree)
+		}
+	}
+}
+
+func TestReleaseSubnetStopsAtNodeCIDR(t *testing.T) {
+
+	//10.0.0.0/23 and 10.0.2.0/23 are buddies inside 10.0.0.0/22 but the node only owns the first
+	nodeCIDR := netip.MustParsePrefix("10.0.0.0/23")
+	free := releaseSubnet(prefixes("10.0.0.0/24"), netip.MustParsePrefix("10.0.1.0/24"), nodeCIDR)
+	if want := prefixes("10.0.0.0/23"); !slices.Equal(free, want) {
+		t.Fatalf("free %v, expected %v", free, want)
+	}
+
+	free = releaseSubnet(prefixes("10.0.2.0/23"), netip.MustParsePrefix("10.0.0.0/23"), nodeCIDR)
+	if want := prefixes("10.0.0.0/23", "10.0.2.0/23"); !slices.Equal(free, want) {
+		t.Fatalf("merged past the node CIDR: free %v, expected %v", free, want)
+	}
+}
+
+func TestMergeSubnets(t *testing.T) {
+
+	nodeCIDR := netip.MustParsePrefix("10.0.0.0/22")
+	tests := []struct {
+		name string
+		free []string
+		want []string
+	}{
+		{
+			name: "legacy /24 list",
+			free: []string{"10.0.3.0/24", "10.0.0.0/24", "10.0.2.0/24", "10.0.1.0/24"},
+			want: []string{"10.0.0.0/22"},
+		},
+		{
+			name: "blocks that are not buddies",
+			free: []string{"10.0.1.0/24", "10.0.2.0/24"},
+			want: []string{"10.0.1.0/24", "10.0.2.0/24"},
+		},
+		{
+			name: "empty list",
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			got := mergeSubnets(prefixes(tt.free...), nodeCIDR)
+			if !slices.Equal(got, prefixes(tt.want...)) {
+				t.Fatalf("merged %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+
+	tests := []struct {
+		name string
+		free []string
+		want float64
+	}{
+		{name: "no free space", want: 0},
+		{name: "single block", free: []string{"10.0.0.0/22"}, want: 0},
+		{name: "two equal blocks", free: []string{"10.0.0.0/24", "10.0.2.0/24"}, want: 0.5},
+		{name: "block and a half", free: []string{"10.0.0.0/24", "10.0.2.0/25"}, want: 1.0 / 3},
+		{name: "four /26", free: []string{"10.0.0.0/26", "10.0.1.0/26", "10.0.2.0/26", "10.0.3.0/26"}, want: 0.75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := Fragmentation(prefixes(tt.free...)); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("fragmentation %f, expected %f", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,170 +1,226 @@
 package ipam
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net"
-
-	//"net/netip"
-	"os"
-	"path/filepath"
-	//cip "github.com/containernetworking/plugins/pkg/ip"
+	"net/netip"
+	"time"
 )
 
 const (
 	defaultStoreDir = "/var/lib/cni/tenantcni"
 )
 
-func NewTenantStore(dataDir string, tenantName string) (*TenantStore, error) {
-
-	if dataDir == "" {
-		dataDir = defaultStoreDir
-	}
-
-	dir := filepath.Join(dataDir, tenantName)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, err
-		}
-	}
-	mutex, err := newFileLock(dir)
-	if err != nil {
-		log.Printf("Failed in creating file lock for node store: %s", err.Error())
-	}
-	file := filepath.Join(dir, tenantName+".json")
-
-	if err != nil {
-		log.Printf("Failed in parsing CIDR: %s", err.Error())
-	}
+func NewTenantStore(storage Storage, tenantName string) (*TenantStore, error) {
 
+	locker, err := storage.Locker(tenantName)
 	if err != nil {
-		log.Printf("Failed in parsing tenant CIDR: %s", err.Error())
+		log.Printf("Failed in creating file lock for tenant store: %s", err.Error())
+		return nil, err
 	}
 
 	tenantData := &TenantData{
 		IPs: make(map[string]ContainerNetInfo),
 	}
+	allocator, err := NewAllocator(netip.Prefix{})
+	if err != nil {
+		return nil, err
+	}
 
 	return &TenantStore{
-		FileMutex: mutex,
-		Directory: dir,
+		Locker:    locker,
+		Storage:   storage,
+		Key:       tenantName,
 		Data:      tenantData,
-		DataFile:  file,
+		allocator: allocator,
 	}, nil
 
 }
 
-func DeleteTenantStore(tenantName string) error {
+// Reports if the tenant store was stored, without creating it
+func TenantStoreExists(storage Storage, tenantName string) bool {
+	return storage.Exists(tenantName)
+}
 
-	dataDir := defaultStoreDir
+func DeleteTenantStore(storage Storage, tenantName string) error {
 
-	dirpath := filepath.Join(dataDir, tenantName)
-	child, err := os.ReadDir(dirpath)
-	if err != nil {
-		log.Printf("Failed reading directory %s", err)
-		return err
-	}
-	log.Printf("Delete the following: %s", child)
-	for _, entry := range child {
-		err = os.RemoveAll(filepath.Join(dirpath, entry.Name()))
-		log.Printf("Deleting %s", entry.Name())
-		if err != nil {
-			log.Printf("Failed deleting %s", err)
-			return err
-		}
-	}
-	err = os.RemoveAll(dirpath)
-	if err != nil {
+	log.Printf("Deleting tenant store %s", tenantName)
+	if err := storage.Delete(tenantName); err != nil {
 		log.Printf("Failed deleting %s", err)
 		return err
 	}
 	return nil
-
 }
 
-// Store tenant data to a json file
+// Store tenant data to the storage
 func (s *TenantStore) StoreTenantData() error {
-	raw, err := json.Marshal(s.Data)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.DataFile, raw, 0644)
+	return storeRecord(s.Storage, s.Key, s.Data)
 }
 
 // Load tenant data to a tenant store
 func (s *TenantStore) LoadTenantData() error {
 	tenantData := &TenantData{}
 
-	raw, err := os.ReadFile(s.DataFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			f, err := os.Create(s.DataFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			_, err = f.Write([]byte("{}"))
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		if err := json.Unmarshal(raw, &tenantData); err != nil {
-			return err
-		}
+	if err := loadRecord(s.Storage, s.Key, tenantData); err != nil {
+		return err
 	}
 	if tenantData.IPs == nil {
 		tenantData.IPs = make(map[string]ContainerNetInfo)
 	}
+	allocator, err := newTenantAllocator(tenantData)
+	if err != nil {
+		return err
+	}
 
 	s.Data = tenantData
+	s.allocator = allocator
 	return nil
 }
 
-func (t *TenantStore) GetIPByID(id string) (net.IP, bool) {
+// Builds the allocator of the tenant CIDR with the network, gateway and broadcast addresses reserved
+// and the stored IPs marked
+func newTenantAllocator(data *TenantData) (*Allocator, error) {
 
-	for ip, info := range t.Data.IPs {
-		if info.ID == id {
-			return net.ParseIP(ip), true
+	var prefix netip.Prefix
+	if data.TenantCIDR != "" {
+		p, err := netip.ParsePrefix(data.TenantCIDR)
+		if err != nil {
+			return nil, err
 		}
+		prefix = p.Masked()
+	}
+	allocator, err := NewAllocator(prefix)
+	if err != nil {
+		return nil, err
 	}
-	return nil, false
-}
 
-func (t *TenantStore) Add(ip net.IP, id string, ifname string, netns string, pod_name string) error {
+	if prefix.IsValid() {
+		allocator.Reserve(prefix.Addr())
+		allocator.Reserve(lastAddr(prefix))
+		if data.Bridge != nil && data.Bridge.Gateway.IsValid() {
+			allocator.Reserve(data.Bridge.Gateway)
+		}
+	}
+	for ip, info := range data.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			log.Printf("Skipping invalid IP %q in tenant %s: %s", ip, data.TenantName, err.Error())
+			continue
+		}
+		if err := allocator.Mark(addr.Unmap(), info.ID); err != nil {
+			log.Printf("Duplicate IP %s in tenant %s: %s", ip, data.TenantName, err.Error())
+		}
+	}
 
-	if len(ip) > 0 {
-		t.Data.IPs[ip.String()] = ContainerNetInfo{
-			ID:     id,
-			IFname: ifname,
-			NetNS:  netns,
-			Name:   pod_name,
+	//Quarantined IPs are reserved until they expire, expired entries are dropped on the next store
+	now := time.Now()
+	for ip, until := range data.Quarantine {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !now.Before(until) {
+			delete(data.Quarantine, ip)
+			continue
 		}
-		return t.StoreTenantData()
+		allocator.Reserve(addr.Unmap())
 	}
-	return nil
+	return allocator, nil
+}
+
+// Broadcast address of the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	return uint32ToAddr(addrToUint32(prefix.Addr()) | (^uint32(0) >> prefix.Bits()))
+}
+
+func (t *TenantStore) GetIPByID(id string) (net.IP, bool) {
+
+	addr, ok := t.allocator.Lookup(id)
+	if !ok {
+		return nil, false
+	}
+	return net.IP(addr.AsSlice()), true
+}
+
+func (t *TenantStore) Add(ip net.IP, info ContainerNetInfo) error {
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return fmt.Errorf("invalid IP %v", ip)
+	}
+	//A quarantined IP taken by a static request or an exhausted pool leaves the quarantine
+	t.lift(addr.Unmap())
+	if err := t.allocator.Mark(addr.Unmap(), info.ID); err != nil {
+		return err
+	}
+	t.Data.IPs[addr.Unmap().String()] = info
+	return t.StoreTenantData()
 }
 
 func (t *TenantStore) Contains(ip net.IP) bool {
 
-	_, ok := t.Data.IPs[ip.String()]
-	return ok
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && t.allocator.Contains(addr.Unmap())
+}
+
+// Releases the IP of the container, holding it in quarantine for the given time
+func (t *TenantStore) Del(id string, quarantine time.Duration) error {
+
+	addr, ok := t.allocator.Release(id)
+	if !ok {
+		return nil
+	}
+	delete(t.Data.IPs, addr.String())
+	t.hold(addr, quarantine)
+	log.Printf("Released %s from tenant %s", addr.String(), t.Data.TenantName)
+	return t.StoreTenantData()
+}
+
+// Reports if the IP is held in quarantine
+func (t *TenantStore) Quarantined(ip net.IP) bool {
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	_, held := t.Data.Quarantine[addr.Unmap().String()]
+	return held
+}
+
+func (t *TenantStore) hold(addr netip.Addr, quarantine time.Duration) {
 
+	if quarantine <= 0 {
+		return
+	}
+	if t.Data.Quarantine == nil {
+		t.Data.Quarantine = make(map[string]time.Time)
+	}
+	t.Data.Quarantine[addr.String()] = time.Now().Add(quarantine)
+	t.allocator.Reserve(addr)
+}
+
+func (t *TenantStore) lift(addr netip.Addr) {
+
+	if _, ok := t.Data.Quarantine[addr.String()]; !ok {
+		return
+	}
+	delete(t.Data.Quarantine, addr.String())
+	t.allocator.Unreserve(addr)
 }
 
-func (t *TenantStore) Del(id string) error {
-	for ip, info := range t.Data.IPs {
-		if info.ID == id {
-			delete(t.Data.IPs, ip)
-			log.Printf("New list %v, deleted %v", t.Data.IPs, ip)
-			return t.StoreTenantData()
+// Returns the quarantined IP closest to its expiry
+func (t *TenantStore) oldestQuarantined() (netip.Addr, bool) {
+
+	var oldest netip.Addr
+	var expiry time.Time
+	for ip, until := range t.Data.Quarantine {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		if !oldest.IsValid() || until.Before(expiry) {
+			oldest, expiry = addr, until
 		}
 	}
-	return nil
+	return oldest, oldest.IsValid()
 }
 
 func (t *TenantStore) Last() net.IP {
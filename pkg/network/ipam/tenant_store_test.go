@@ -0,0 +1,143 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTenantStoreAddInvalidIP(t *testing.T) {
+
+	nim := newTestNodeIPAM(t, "10.244.0.0/22")
+	if err := nim.AllocateTenant("tenant1", 1, 24); err != nil {
+		t.Fatal(err)
+	}
+	tim := newTestTenantIPAM(t, nim, "tenant1")
+	store := tim.TenantStore
+	if err := store.LoadTenantData(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []net.IP{nil, {10, 244, 0}} {
+		if err := store.Add(ip, ContainerNetInfo{ID: "c1", IFname: "eth0"}); err == nil {
+			t.Fatalf("invalid IP %v recorded", ip)
+		}
+	}
+	if len(store.Data.IPs) != 0 {
+		t.Fatalf("IPs %v recorded", store.Data.IPs)
+	}
+}
+
+// Tenant IPAM of a /29 tenant, the gateway leaves 5 host addresses from 10.244.0.2 to 10.244.0.6
+func newQuarantineTestIPAM(t *testing.T) *TenantIPAM {
+
+	t.Helper()
+	nim := newTestNodeIPAM(t, "10.244.0.0/22")
+	if err := nim.AllocateTenant("tenant1", 1, 29); err != nil {
+		t.Fatal(err)
+	}
+	tim := newTestTenantIPAM(t, nim, "tenant1")
+	tim.Strategy = StrategyLowestFree
+	tim.Quarantine = time.Hour
+	return tim
+}
+
+func allocateTestIPs(t *testing.T, tim *TenantIPAM, ids ...string) []string {
+
+	t.Helper()
+	var ips []string
+	for _, id := range ids {
+		ip, err := tim.AllocateIP(ContainerNetInfo{ID: id, IFname: "eth0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+func TestQuarantineSkipsReleasedIP(t *testing.T) {
+
+	tim := newQuarantineTestIPAM(t)
+	released := allocateTestIPs(t, tim, "c1")[0]
+	if _, err := tim.ReleaseIP("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if !tim.TenantStore.Quarantined(net.ParseIP(released)) {
+		t.Fatalf("released %s not quarantined", released)
+	}
+
+	//The lowest free strategy would hand out the released IP first
+	for _, ip := range allocateTestIPs(t, tim, "c2", "c3", "c4", "c5") {
+		if ip == released {
+			t.Fatalf("quarantined %s handed out before the pool was exhausted", ip)
+		}
+	}
+
+	//Quarantine survives reloading the store
+	if err := tim.TenantStore.LoadTenantData(); err != nil {
+		t.Fatal(err)
+	}
+	if !tim.TenantStore.Quarantined(net.ParseIP(released)) {
+		t.Fatalf("%s left the quarantine on reload", released)
+	}
+}
+
+func TestQuarantineReusedWhenExhausted(t *testing.T) {
+
+	tim := newQuarantineTestIPAM(t)
+	ips := allocateTestIPs(t, tim, "c1", "c2", "c3", "c4", "c5")
+	if _, err := tim.AllocateIP(ContainerNetInfo{ID: "c6", IFname: "eth0"}); !errors.Is(err, ErrNoFreeIP) {
+		t.Fatalf("expected ErrNoFreeIP, got %v", err)
+	}
+
+	//c2 is released first and is the closest to its expiry
+	if _, err := tim.ReleaseIP("c2"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := tim.ReleaseIP("c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := allocateTestIPs(t, tim, "c6", "c7")
+	if got[0] != ips[1] || got[1] != ips[0] {
+		t.Fatalf("exhausted pool handed out %v, expected %s then %s", got, ips[1], ips[0])
+	}
+	for _, ip := range got {
+		if tim.TenantStore.Quarantined(net.ParseIP(ip)) {
+			t.Fatalf("%s handed out and still quarantined", ip)
+		}
+	}
+	if _, err := tim.AllocateIP(ContainerNetInfo{ID: "c8", IFname: "eth0"}); !errors.Is(err, ErrNoFreeIP) {
+		t.Fatalf("expected ErrNoFreeIP once the quarantine is used up, got %v", err)
+	}
+}
+
+func TestQuarantineLiftedByStaticRequest(t *testing.T) {
+
+	tim := newQuarantineTestIPAM(t)
+	released := allocateTestIPs(t, tim, "c1")[0]
+	if _, err := tim.ReleaseIP("c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := tim.AllocateStaticIP(net.ParseIP(released), ContainerNetInfo{ID: "c2", IFname: "eth0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != released {
+		t.Fatalf("static request got %s, expected %s", ip, released)
+	}
+
+	if err := tim.TenantStore.LoadTenantData(); err != nil {
+		t.Fatal(err)
+	}
+	if tim.TenantStore.Quarantined(ip) {
+		t.Fatalf("%s still quarantined after the static request", ip)
+	}
+	if got, ok := tim.TenantStore.GetIPByID("c2"); !ok || !got.Equal(ip) {
+		t.Fatalf("c2 holds %v, expected %s", got, ip)
+	}
+}
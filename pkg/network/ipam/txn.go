@@ -0,0 +1,322 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+const (
+	//Record of the undo journal of the running transaction. Store names are Kubernetes names and cannot start with a dot
+	journalKey = ".journal"
+)
+
+var (
+	ErrTxnClosed       = errors.New("transaction already committed or rolled back")
+	ErrTxnNotHeld      = errors.New("record not locked by the transaction")
+	ErrJournalConflict = errors.New("stores written since the interrupted transaction were not rolled back")
+)
+
+// Txn updates several store records as a unit. The records are locked in sorted order, after the journal lock that
+// serialises transactions, and the writes are staged until Commit. Commit saves the previous contents of the records in
+// an undo journal first, so a failed or interrupted commit is rolled back.
+type Txn struct {
+	storage Storage
+	keys    []string
+	lockers []Locker
+	staged  map[string]*journalEntry
+	closed  bool
+}
+
+// Undo journal, the contents of the records before the transaction was applied
+type txnJournal struct {
+	Entries []journalEntry `json:"entries"`
+}
+
+// Contents of a record, a missing record is restored by deleting it. After is the checksum of the record written by
+// the transaction, empty when the transaction deletes it, so records written since are told apart on recovery.
+type journalEntry struct {
+	Key    string          `json:"key"`
+	Exists bool            `json:"exists"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	After  string          `json:"after,omitempty"`
+}
+
+// Starts a transaction over the records, rolling back any transaction interrupted by a crash first
+func Begin(storage Storage, keys ...string) (*Txn, error) {
+
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	txn := &Txn{
+		storage: storage,
+		staged:  make(map[string]*journalEntry),
+	}
+	if err := txn.lock(journalKey); err != nil {
+		return nil, err
+	}
+	if _, err := recoverJournal(storage, nil); err != nil {
+		txn.unlock()
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := txn.lock(key); err != nil {
+			txn.unlock()
+			return nil, err
+		}
+	}
+	txn.keys = keys
+	return txn, nil
+}
+
+// Rolls back the transaction left in the journal by a crash, for the daemon to call on start. Records written since the
+// crash, e.g. by the CNI plugin, are kept and reported with ErrJournalConflict.
+func RecoverJournal(storage Storage) error {
+
+	txn := &Txn{storage: storage}
+	if err := txn.lock(journalKey); err != nil {
+		return err
+	}
+	defer txn.unlock()
+
+	conflicts, err := recoverJournal(storage, nil)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", ErrJournalConflict, strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+func (t *Txn) lock(key string) error {
+
+	locker, err := t.storage.Locker(key)
+	if err != nil {
+		return err
+	}
+	if err := locker.Lock(); err != nil {
+		return err
+	}
+	t.lockers = append(t.lockers, locker)
+	return nil
+}
+
+func (t *Txn) unlock() {
+
+	for i := len(t.lockers) - 1; i >= 0; i-- {
+		t.lockers[i].Unlock()
+	}
+	t.lockers = nil
+}
+
+// Unmarshals the record into v, reading the write staged by the transaction if any.
+// v is left untouched when the record does not exist
+func (t *Txn) Load(key string, v interface{}) error {
+
+	if err := t.check(key); err != nil {
+		return err
+	}
+	if entry, ok := t.staged[key]; ok {
+		if !entry.Exists {
+			return nil
+		}
+		return json.Unmarshal(entry.Data, v)
+	}
+	return loadRecord(t.storage, key, v)
+}
+
+// Stages the record, written on Commit
+func (t *Txn) Store(key string, v interface{}) error {
+
+	if err := t.check(key); err != nil {
+		return err
+	}
+	raw, err := encodeVersioned(v)
+	if err != nil {
+		return err
+	}
+	t.staged[key] = &journalEntry{Key: key, Exists: true, Data: raw}
+	return nil
+}
+
+// Stages the removal of the record, applied on Commit
+func (t *Txn) Delete(key string) error {
+
+	if err := t.check(key); err != nil {
+		return err
+	}
+	t.staged[key] = &journalEntry{Key: key}
+	return nil
+}
+
+func (t *Txn) check(key string) error {
+
+	if t.closed {
+		return ErrTxnClosed
+	}
+	if _, found := slices.BinarySearch(t.keys, key); !found {
+		return fmt.Errorf("%w: %s", ErrTxnNotHeld, key)
+	}
+	return nil
+}
+
+// Applies the staged writes and releases the locks. On error the records are restored to their previous contents
+func (t *Txn) Commit() error {
+
+	if t.closed {
+		return ErrTxnClosed
+	}
+	defer t.Rollback()
+
+	//Save the current contents of every written record before touching them
+	journal := &txnJournal{}
+	for _, key := range t.keys {
+		staged, ok := t.staged[key]
+		if !ok {
+			continue
+		}
+		entry := journalEntry{Key: key}
+		if staged.Exists {
+			entry.After = recordChecksum(staged.Data)
+		}
+		raw, err := t.storage.Load(key)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+		case err != nil:
+			return err
+		default:
+			entry.Exists = true
+			entry.Data = raw
+		}
+		journal.Entries = append(journal.Entries, entry)
+	}
+	if len(journal.Entries) == 0 {
+		return nil
+	}
+	if err := storeRecord(t.storage, journalKey, journal); err != nil {
+		return err
+	}
+
+	for _, key := range t.keys {
+		entry, ok := t.staged[key]
+		if !ok {
+			continue
+		}
+		if err := applyEntry(t.storage, entry); err != nil {
+			log.Printf("Failed committing store %s, rolling back: %s", key, err.Error())
+			if _, rbErr := recoverJournal(t.storage, t.keys); rbErr != nil {
+				log.Printf("Failed rolling back transaction: %s", rbErr.Error())
+			}
+			return err
+		}
+	}
+	return clearJournal(t.storage)
+}
+
+// Discards the staged writes and releases the locks, a no-op after Commit
+func (t *Txn) Rollback() {
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.staged = nil
+	t.unlock()
+}
+
+// Restores the records saved in the journal and clears it. The journal lock must be held, the records not in held are
+// locked during the restore. Only records the transaction wrote are restored, records changed since are left in place
+// and returned.
+func recoverJournal(storage Storage, held []string) ([]string, error) {
+
+	journal := &txnJournal{}
+	if err := loadRecord(storage, journalKey, journal); err != nil {
+		return nil, err
+	}
+	if len(journal.Entries) == 0 {
+		return nil, nil
+	}
+
+	log.Printf("Rolling back interrupted transaction on %d stores", len(journal.Entries))
+	var conflicts []string
+	for _, entry := range journal.Entries {
+		var locker Locker
+		if !slices.Contains(held, entry.Key) {
+			var err error
+			if locker, err = storage.Locker(entry.Key); err != nil {
+				return nil, err
+			}
+			if err := locker.Lock(); err != nil {
+				return nil, err
+			}
+		}
+		restored, err := restoreEntry(storage, &entry)
+		if locker != nil {
+			locker.Unlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !restored {
+			log.Printf("Store %s changed since the interrupted transaction, keeping it", entry.Key)
+			conflicts = append(conflicts, entry.Key)
+		}
+	}
+	return conflicts, clearJournal(storage)
+}
+
+// Restores the record when it still holds what the transaction wrote or what it held before, returns false when the
+// record was written since
+func restoreEntry(storage Storage, entry *journalEntry) (bool, error) {
+
+	raw, err := storage.Load(entry.Key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return false, err
+	}
+
+	current := ""
+	if exists {
+		current = recordChecksum(raw)
+	}
+	before := ""
+	if entry.Exists {
+		before = recordChecksum(entry.Data)
+	}
+	switch current {
+	case entry.After:
+		return true, applyEntry(storage, entry)
+	case before:
+		return true, nil
+	}
+	return false, nil
+}
+
+// Checksum of the compacted record, the storages may store the record compacted
+func recordChecksum(data []byte) string {
+
+	compact := &bytes.Buffer{}
+	if err := json.Compact(compact, data); err != nil {
+		return checksum(data)
+	}
+	return checksum(compact.Bytes())
+}
+
+// The journal record is emptied rather than deleted, an empty journal has nothing to roll back
+func clearJournal(storage Storage) error {
+	return storeRecord(storage, journalKey, &txnJournal{})
+}
+
+func applyEntry(storage Storage, entry *journalEntry) error {
+
+	if !entry.Exists {
+		return storage.Delete(entry.Key)
+	}
+	return storage.Store(entry.Key, entry.Data)
+}
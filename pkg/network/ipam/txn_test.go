@@ -0,0 +1,360 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRecord struct {
+	Value string `json:"value"`
+}
+
+func storeTestRecord(t *testing.T, storage Storage, key string, value string) {
+
+	t.Helper()
+	if err := storeRecord(storage, key, &testRecord{Value: value}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Value of the record, empty when it does not exist
+func loadTestRecord(t *testing.T, storage Storage, key string) string {
+
+	t.Helper()
+	record := &testRecord{}
+	if err := loadRecord(storage, key, record); err != nil {
+		t.Fatal(err)
+	}
+	return record.Value
+}
+
+func assertJournalEmpty(t *testing.T, storage Storage) {
+
+	t.Helper()
+	journal := &txnJournal{}
+	if err := loadRecord(storage, journalKey, journal); err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.Entries) != 0 {
+		t.Fatalf("journal holds %d entries", len(journal.Entries))
+	}
+}
+
+// Fails when the transaction locks are still held
+func assertUnlocked(t *testing.T, storage Storage, keys ...string) {
+
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		txn, err := Begin(storage, keys...)
+		if err == nil {
+			txn.Rollback()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("transaction locks still held")
+	}
+}
+
+func TestTxnCommit(t *testing.T) {
+
+	storage := NewMemoryStorage()
+	storeTestRecord(t, storage, "a", "a0")
+	storeTestRecord(t, storage, "b", "b0")
+
+	txn, err := Begin(storage, "c", "b", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("a", &testRecord{Value: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("c", &testRecord{Value: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("d", &testRecord{Value: "d1"}); !errors.Is(err, ErrTxnNotHeld) {
+		t.Fatalf("expected ErrTxnNotHeld, got %v", err)
+	}
+
+	//Staged writes are read back by the transaction and not visible outside of it
+	staged := &testRecord{}
+	if err := txn.Load("a", staged); err != nil || staged.Value != "a1" {
+		t.Fatalf("staged load %q %v", staged.Value, err)
+	}
+	if got := loadTestRecord(t, storage, "a"); got != "a0" {
+		t.Fatalf("record a %q before commit", got)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadTestRecord(t, storage, "a"); got != "a1" {
+		t.Fatalf("record a %q, expected a1", got)
+	}
+	if storage.Exists("b") {
+		t.Fatal("record b not deleted")
+	}
+	if got := loadTestRecord(t, storage, "c"); got != "c1" {
+		t.Fatalf("record c %q, expected c1", got)
+	}
+	assertJournalEmpty(t, storage)
+	assertUnlocked(t, storage, "a", "b", "c")
+
+	if err := txn.Commit(); !errors.Is(err, ErrTxnClosed) {
+		t.Fatalf("expected ErrTxnClosed committing twice, got %v", err)
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+
+	storage := NewMemoryStorage()
+	storeTestRecord(t, storage, "a", "a0")
+
+	txn, err := Begin(storage, "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("a", &testRecord{Value: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("b", &testRecord{Value: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	txn.Rollback()
+
+	if got := loadTestRecord(t, storage, "a"); got != "a0" {
+		t.Fatalf("record a %q after rollback", got)
+	}
+	if storage.Exists("b") {
+		t.Fatal("record b created by a rolled back transaction")
+	}
+	if err := txn.Store("a", &testRecord{}); !errors.Is(err, ErrTxnClosed) {
+		t.Fatalf("expected ErrTxnClosed after rollback, got %v", err)
+	}
+	assertUnlocked(t, storage, "a", "b")
+}
+
+// Stores the journal of a commit writing the given values, as left by a crash before any of them was applied
+func storeTestJournal(t *testing.T, storage Storage, values map[string]string) {
+
+	t.Helper()
+	journal := &txnJournal{}
+	for _, key := range sortedKeys(values) {
+		entry := journalEntry{Key: key}
+		after, err := json.Marshal(&testRecord{Value: values[key]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.After = recordChecksum(after)
+		raw, err := storage.Load(key)
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+		case err != nil:
+			t.Fatal(err)
+		default:
+			entry.Exists = true
+			entry.Data = raw
+		}
+		journal.Entries = append(journal.Entries, entry)
+	}
+	if err := storeRecord(storage, journalKey, journal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Journal left by a commit interrupted after writing the first record: a was updated and c created, b not yet written
+func TestTxnRecoverHalfAppliedJournal(t *testing.T) {
+
+	storage := NewMemoryStorage()
+	storeTestRecord(t, storage, "a", "a0")
+	storeTestRecord(t, storage, "b", "b0")
+
+	storeTestJournal(t, storage, map[string]string{"a": "a1", "b": "b1", "c": "c1"})
+	storeTestRecord(t, storage, "a", "a1")
+	storeTestRecord(t, storage, "c", "c1")
+
+	if err := RecoverJournal(storage); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadTestRecord(t, storage, "a"); got != "a0" {
+		t.Fatalf("record a %q, expected a0", got)
+	}
+	if got := loadTestRecord(t, storage, "b"); got != "b0" {
+		t.Fatalf("record b %q, expected b0", got)
+	}
+	if storage.Exists("c") {
+		t.Fatal("record c created by the interrupted transaction not removed")
+	}
+	assertJournalEmpty(t, storage)
+
+	//Recovering again is a no-op
+	if err := RecoverJournal(storage); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadTestRecord(t, storage, "a"); got != "a0" {
+		t.Fatalf("record a %q after second recovery", got)
+	}
+}
+
+// Records written by the CNI plugin between the crash and the recovery are kept and reported
+func TestTxnRecoverKeepsNewerWrites(t *testing.T) {
+
+	storage := NewMemoryStorage()
+	storeTestRecord(t, storage, "a", "a0")
+	storeTestRecord(t, storage, "b", "b0")
+
+	storeTestJournal(t, storage, map[string]string{"a": "a1", "b": "b1", "c": "c1"})
+	storeTestRecord(t, storage, "a", "a1")
+	storeTestRecord(t, storage, "b", "b1")
+	storeTestRecord(t, storage, "c", "c1")
+
+	//The plugin updated a and deleted c after the crash
+	storeTestRecord(t, storage, "a", "a2")
+	if err := storage.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := RecoverJournal(storage)
+	if !errors.Is(err, ErrJournalConflict) {
+		t.Fatalf("expected ErrJournalConflict, got %v", err)
+	}
+	if !strings.HasSuffix(err.Error(), ": a") {
+		t.Fatalf("conflicts reported as %q, expected only a", err)
+	}
+	if got := loadTestRecord(t, storage, "a"); got != "a2" {
+		t.Fatalf("record a %q, expected the newer a2", got)
+	}
+	if got := loadTestRecord(t, storage, "b"); got != "b0" {
+		t.Fatalf("record b %q, expected b0", got)
+	}
+	if storage.Exists("c") {
+		t.Fatal("record c deleted since the crash restored")
+	}
+	assertJournalEmpty(t, storage)
+}
+
+// Storage failing the writes of one record
+type failingStorage struct {
+	*MemoryStorage
+	failKey string
+}
+
+func (s *failingStorage) Store(key string, data []byte) error {
+
+	if key == s.failKey {
+		return errors.New("disk full")
+	}
+	return s.MemoryStorage.Store(key, data)
+}
+
+func TestTxnCommitFailureRollsBack(t *testing.T) {
+
+	storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	storeTestRecord(t, storage, "a", "a0")
+	storage.failKey = "b"
+
+	txn, err := Begin(storage, "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("a", &testRecord{Value: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Store("b", &testRecord{Value: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err == nil {
+		t.Fatal("commit succeeded with a failing store")
+	}
+
+	//a was written before b failed and is restored from the journal
+	if got := loadTestRecord(t, storage, "a"); got != "a0" {
+		t.Fatalf("record a %q, expected a0", got)
+	}
+	if storage.Exists("b") {
+		t.Fatal("record b exists after the failed commit")
+	}
+	assertJournalEmpty(t, storage)
+	assertUnlocked(t, storage, "a", "b")
+}
+
+// A writer blocked on the record lock while a transaction deletes the record still excludes the writers that come
+// after it
+func TestTxnDeleteKeepsLock(t *testing.T) {
+
+	storage := NewFileStorage(t.TempDir())
+	storeTestRecord(t, storage, "tenant1", "t0")
+
+	txn, err := Begin(storage, "tenant1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete("tenant1"); err != nil {
+		t.Fatal(err)
+	}
+
+	//First writer, blocked on the lock held by the transaction
+	first, err := storage.Locker("tenant1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLocked := make(chan error, 1)
+	go func() { firstLocked <- first.Lock() }()
+	select {
+	case <-firstLocked:
+		t.Fatal("lock acquired while held by the transaction")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists("tenant1") {
+		t.Fatal("record not deleted")
+	}
+	select {
+	case err := <-firstLocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked writer not woken up by the commit")
+	}
+
+	//Second writer, opening the lock after the delete, must wait for the first one
+	second, err := storage.Locker("tenant1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondLocked := make(chan error, 1)
+	go func() { secondLocked <- second.Lock() }()
+	select {
+	case <-secondLocked:
+		t.Fatal("second writer locked the record held by the first one")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-secondLocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+		second.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("second writer not woken up")
+	}
+}
@@ -2,8 +2,9 @@ package ipam
 
 import (
 	"net/netip"
+	"time"
 
-	filemutex "github.com/alexflint/go-filemutex"
+	"github.com/containernetworking/cni/pkg/types"
 )
 
 //All network IPs that have a mask cannot be parsed onto a readable format so we saved them as strings
@@ -11,11 +12,22 @@ import (
 type NodeIPAM struct {
 	NodeName  string
 	NodeStore *NodeStore
+	//Records the tenant subnet changes, nil records nothing
+	Audit *AuditLog
+	//Backend recorded on the tenants allocated on the node, vxlan when empty. Tenants keep the backend they were
+	//allocated with
+	Backend string
 }
 
 type TenantIPAM struct {
 	TenantName  string
 	TenantStore *TenantStore
+	//Strategy of AllocateIP, sequential when empty
+	Strategy Strategy
+	//Time released IPs are held in quarantine, zero releases them immediately
+	Quarantine time.Duration
+	//Records the IP changes, nil records nothing
+	Audit *AuditLog
 }
 
 type PodIPAM struct {
@@ -23,6 +35,7 @@ type PodIPAM struct {
 }
 
 type NodeData struct {
+	Version       int                     `json:"version"`
 	NodeIP        string                  `json:"nodeIP"`
 	NodeCIDR      string                  `json:"nodeCIDR"`
 	AvailableList []string                `json:"availableList"`
@@ -30,39 +43,62 @@ type NodeData struct {
 }
 
 type TenantData struct {
-	TenantName   string  `json:"tenantName"`
-	TenantPrefix int     `json:"tenantPrefix"`
-	TenantCIDR   string  `json:"tenantCIDR"`
-	Bridge       *Bridge `json:"bridge"`
-	Vxlan        *Vxlan  `json:"vxlan"`
+	Version      int        `json:"version"`
+	TenantName   string     `json:"tenantName"`
+	TenantPrefix int        `json:"tenantPrefix"`
+	TenantCIDR   string     `json:"tenantCIDR"`
+	ClusterCIDR  string     `json:"clusterCIDR,omitempty"`
+	Bridge       *Bridge    `json:"bridge"`
+	Vxlan        *Vxlan     `json:"vxlan"`
+	DNS          *types.DNS `json:"dns,omitempty"`
+	//Backend carrying the traffic of the tenant between nodes, vxlan when empty
+	Backend string `json:"backend,omitempty"`
+	//Other nodes of the tenant, recorded by the daemon from the tenant spec
+	RemoteNodes []string `json:"remoteNodes,omitempty"`
 
 	IPs  map[string]ContainerNetInfo `json:"ips"`
 	Last string                      `json:"last"`
+
+	//Released IPs held until the expiry time before they are handed out again
+	Quarantine map[string]time.Time `json:"quarantine,omitempty"`
 }
 
+// Pods are keyed by namespace/name, see PodKey
 type PodData struct {
-	Pods map[string]string `json:"pods"`
+	Version int                `json:"version"`
+	Pods    map[string]PodInfo `json:"pods"`
+}
+
+// Tenants is ordered, the first tenant holds the primary interface of the pod
+type PodInfo struct {
+	UID     string   `json:"uid"`
+	Tenants []string `json:"tenants"`
+	IP      string   `json:"ip,omitempty"`
 }
 
 type NodeStore struct {
-	*filemutex.FileMutex
-	Directory string
-	Data      *NodeData
-	DataFile  string
+	Locker
+	Storage Storage
+	Key     string
+	Data    *NodeData
 }
 
 type TenantStore struct {
-	*filemutex.FileMutex
-	Directory string
-	Data      *TenantData
-	DataFile  string
+	Locker
+	Storage Storage
+	Key     string
+	Data    *TenantData
+
+	//Bitmap of the tenant CIDR and container ID index, rebuilt from Data.IPs on load. Picking a free IP does not
+	//depend on the IPs in use, but ADD and DEL still load and write the whole store, see BenchmarkAllocateIP
+	allocator *Allocator
 }
 
 type PodStore struct {
-	*filemutex.FileMutex
-	Directory string
-	Data      *PodData
-	DataFile  string
+	Locker
+	Storage Storage
+	Key     string
+	Data    *PodData
 }
 
 type Bridge struct {
@@ -78,8 +114,10 @@ type Vxlan struct {
 }
 
 type ContainerNetInfo struct {
-	ID     string `json:"id"`
-	IFname string `json:"ifname"`
-	NetNS  string `json: netns`
-	Name   string `json: name`
+	ID        string `json:"id"`
+	IFname    string `json:"ifname"`
+	NetNS     string `json:"netns"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	UID       string `json:"uid"`
 }
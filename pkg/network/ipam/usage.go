@@ -0,0 +1,134 @@
+package ipam
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+)
+
+// Addresses of a tenant subnet on the node. Reserved counts the network, broadcast and gateway addresses, Free the
+// addresses neither reserved, allocated nor quarantined
+type TenantUsage struct {
+	Tenant      string
+	CIDR        string
+	Size        int
+	Reserved    int
+	Allocated   int
+	Quarantined int
+	Free        int
+}
+
+// Subnets of the node CIDR. Allocated counts the addresses of the tenant subnets carved out of the node CIDR, Free
+// the addresses of the available subnets. LargestFree is the prefix of the largest available subnet, 0 when none is
+type NodeUsage struct {
+	Node          string
+	NodeCIDR      string
+	Size          int
+	Allocated     int
+	Free          int
+	Fragmentation float64
+	LargestFree   int
+	Tenants       []TenantUsage
+}
+
+// Fraction of the usable addresses of the tenant that are allocated or quarantined
+func (u TenantUsage) Utilization() float64 {
+
+	usable := u.Size - u.Reserved
+	if usable <= 0 {
+		return 0
+	}
+	return float64(u.Allocated+u.Quarantined) / float64(usable)
+}
+
+// No address can be handed out, not even out of quarantine
+func (u TenantUsage) Exhausted() bool {
+	return u.Size > 0 && u.Free == 0 && u.Quarantined == 0
+}
+
+// Fraction of the node CIDR held by tenant subnets
+func (u NodeUsage) Utilization() float64 {
+
+	if u.Size == 0 {
+		return 0
+	}
+	return float64(u.Allocated) / float64(u.Size)
+}
+
+// Reports the usage of the node subnets and of every tenant on the node, read from the stores. Tenants whose store
+// fails to load are logged and left out of the report.
+func NodeUtilization(storage Storage, nodeName string) (*NodeUsage, error) {
+
+	nodeData := &NodeData{}
+	if err := loadRecord(storage, nodeName, nodeData); err != nil {
+		return nil, err
+	}
+	nodeCIDR, err := netip.ParsePrefix(nodeData.NodeCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("node store %s: invalid node CIDR %q", nodeName, nodeData.NodeCIDR)
+	}
+	nodeCIDR = nodeCIDR.Masked()
+
+	free := parseSubnets(nodeData.AvailableList)
+	usage := &NodeUsage{
+		Node:          nodeName,
+		NodeCIDR:      nodeCIDR.String(),
+		Size:          1 << (32 - nodeCIDR.Bits()),
+		Fragmentation: Fragmentation(free),
+	}
+	for _, block := range free {
+		usage.Free += 1 << (32 - block.Bits())
+		if usage.LargestFree == 0 || block.Bits() < usage.LargestFree {
+			usage.LargestFree = block.Bits()
+		}
+	}
+
+	for _, tenantName := range sortedKeys(nodeData.TenantList) {
+		subnet := nodeData.TenantList[tenantName]
+		//Blocks of a tenant cluster CIDR do not take space of the node CIDR
+		if containsSubnet(nodeCIDR, subnet) {
+			usage.Allocated += 1 << (32 - subnet.Bits())
+		}
+
+		//A tenant store that fails to load does not hide the usage of the node and the other tenants
+		tenantData := &TenantData{}
+		if err := loadRecord(storage, tenantName, tenantData); err != nil {
+			log.Printf("Error loading tenant %s for usage report, skipping: %s", tenantName, err.Error())
+			continue
+		}
+		tenantUsage, err := TenantUtilization(tenantData)
+		if err != nil {
+			log.Printf("Error computing usage of tenant %s, skipping: %s", tenantName, err.Error())
+			continue
+		}
+		usage.Tenants = append(usage.Tenants, tenantUsage)
+	}
+	return usage, nil
+}
+
+// Reports the usage of the tenant subnet, expired quarantine entries are not counted
+func TenantUtilization(data *TenantData) (TenantUsage, error) {
+
+	usage := TenantUsage{Tenant: data.TenantName, CIDR: data.TenantCIDR}
+	subnet, err := netip.ParsePrefix(data.TenantCIDR)
+	if err != nil {
+		return usage, err
+	}
+	subnet = subnet.Masked()
+	usage.Size = 1 << (32 - subnet.Bits())
+	usage.Reserved = 2
+	if data.Bridge != nil && subnet.Contains(data.Bridge.Gateway) {
+		usage.Reserved++
+	}
+	usage.Allocated = len(data.IPs)
+
+	now := time.Now()
+	for ip, until := range data.Quarantine {
+		if _, allocated := data.IPs[ip]; !allocated && now.Before(until) {
+			usage.Quarantined++
+		}
+	}
+	usage.Free = max(usage.Size-usage.Reserved-usage.Allocated-usage.Quarantined, 0)
+	return usage, nil
+}
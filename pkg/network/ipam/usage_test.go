@@ -0,0 +1,33 @@
+package ipam
+
+import "testing"
+
+func TestNodeUtilizationSkipsBrokenTenants(t *testing.T) {
+
+	nim := newTestNodeIPAM(t, "10.244.0.0/22")
+	for i, tenantName := range []string{"tenant1", "tenant2", "tenant3"} {
+		if err := nim.AllocateTenant(tenantName, i+1, 24); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage := nim.NodeStore.Storage
+	//tenant2 cannot be decoded, tenant3 holds no subnet
+	if err := storage.Store("tenant2", []byte(`{"tenantName":`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Store("tenant3", []byte(`{"tenantName":"tenant3","version":1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := NodeUtilization(storage, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Tenants) != 1 || usage.Tenants[0].Tenant != "tenant1" {
+		t.Fatalf("tenants %+v, expected tenant1 only", usage.Tenants)
+	}
+	//The subnets of the skipped tenants still count as allocated in the node CIDR
+	if usage.Allocated != 3*256 || usage.Free != 256 {
+		t.Fatalf("allocated %d free %d, expected 768 and 256", usage.Allocated, usage.Free)
+	}
+}
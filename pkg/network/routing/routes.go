@@ -1,6 +1,7 @@
 package routing
 
 import (
+	"errors"
 	"log"
 	"net"
 	"syscall"
@@ -86,3 +87,43 @@ func CheckARP(localVtepID int) ([]netlink.Neigh, error){
 	return netlink.NeighList(localVtepID, netlink.FAMILY_V4)
 
 }
+
+func DelRoutes(localVtepID int, remoteTenantCIDR *net.IPNet, remoteVtepIP net.IP) error {
+
+	err := netlink.RouteDel(&netlink.Route{
+		LinkIndex: localVtepID,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       remoteTenantCIDR,
+		Gw:        remoteVtepIP,
+		Flags:     syscall.RTNH_F_ONLINK,
+	})
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	log.Printf("Deleted route to %s via %s", remoteTenantCIDR.String(), remoteVtepIP.String())
+	return nil
+}
+
+// Routes the remote tenant subnet to the remote node, replacing the route when it exists
+func AddHostRoute(remoteTenantCIDR *net.IPNet, remoteNodeIP net.IP) error {
+
+	log.Printf("Adding route to %s via node %s", remoteTenantCIDR.String(), remoteNodeIP.String())
+	return netlink.RouteReplace(&netlink.Route{
+		Scope: netlink.SCOPE_UNIVERSE,
+		Dst:   remoteTenantCIDR,
+		Gw:    remoteNodeIP,
+	})
+}
+
+func DelHostRoute(remoteTenantCIDR *net.IPNet, remoteNodeIP net.IP) error {
+
+	err := netlink.RouteDel(&netlink.Route{
+		Scope: netlink.SCOPE_UNIVERSE,
+		Dst:   remoteTenantCIDR,
+		Gw:    remoteNodeIP,
+	})
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}